@@ -88,6 +88,17 @@ func ToArray(obj *Object) (*Object, error) {
 		return structToArray(obj), nil
 	case StringType:
 		return stringToArray(obj), nil
+	case HashtableType:
+		return listToArray(hashtableToList(obj)), nil
+	case VectorType:
+		return ArrayFromElementsNoCopy(vectorValue(obj).elements()), nil
+	case HashMapType:
+		return listToArray(hashMapToList(obj)), nil
+	case BlobType:
+		return listToArray(blobToList(obj)), nil
 	}
-	return nil, Error(ArgumentErrorKey, "to-array expected <array>, <list>, <struct>, or <string>, got a ", obj.Type)
+	if s, ok := sequenceValue(obj); ok {
+		return listToArray(s.Seq()), nil
+	}
+	return nil, Error(ArgumentErrorKey, "to-array expected <array>, <list>, <struct>, <string>, <blob>, <hashtable>, <vector>, <hash-map> or a sequence, got a ", obj.Type)
 }
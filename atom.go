@@ -0,0 +1,135 @@
+package vesper
+
+import (
+	"context"
+	"sync"
+)
+
+// AtomType - the type of Vesper's atom object, a reference that can be shared between goroutines
+var AtomType = defaultVM.Intern("<atom>")
+
+// MutexType - the type of Vesper's mutex object
+var MutexType = defaultVM.Intern("<mutex>")
+
+type atom struct {
+	mutex sync.Mutex
+	value *Object
+}
+
+func (a *atom) String() string {
+	return "#[atom " + Write(a.deref()) + "]"
+}
+
+func (a *atom) deref() *Object {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.value
+}
+
+func (a *atom) reset(val *Object) {
+	a.mutex.Lock()
+	a.value = val
+	a.mutex.Unlock()
+}
+
+// compareAndSet sets the value if the current value is identical to old
+func (a *atom) compareAndSet(old *Object, val *Object) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.value != old {
+		return false
+	}
+	a.value = val
+	return true
+}
+
+// Atom - create a new atom holding the value
+func Atom(val *Object) *Object {
+	return NewObject(AtomType, &atom{value: val})
+}
+
+// mutex is a lock that, unlike sync.Mutex, reports an error rather than crashing
+// when it is unlocked without being locked.
+type mutex struct {
+	name   string
+	locked chan struct{} // holds a value while the mutex is locked
+}
+
+func (m *mutex) String() string {
+	s := "#[mutex"
+	if m.name != "" {
+		s += " " + m.name
+	}
+	if len(m.locked) > 0 {
+		s += " LOCKED"
+	}
+	return s + "]"
+}
+
+// Mutex - create a new mutex with the given name
+func Mutex(name string) *Object {
+	return NewObject(MutexType, &mutex{name: name, locked: make(chan struct{}, 1)})
+}
+
+// VM Primitives
+
+func vesperAtom(argv []*Object) (*Object, error) {
+	return Atom(argv[0]), nil
+}
+
+func vesperAtomP(argv []*Object) (*Object, error) {
+	return toVesperBool(argv[0].Type == AtomType)
+}
+
+func vesperDeref(argv []*Object) (*Object, error) {
+	return argv[0].Value.(*atom).deref(), nil
+}
+
+func vesperReset(argv []*Object) (*Object, error) {
+	argv[0].Value.(*atom).reset(argv[1])
+	return argv[1], nil
+}
+
+// (compare-and-set! a old new) sets the value of the atom to new, if its value is identical to old
+func vesperCompareAndSet(argv []*Object) (*Object, error) {
+	return toVesperBool(argv[0].Value.(*atom).compareAndSet(argv[1], argv[2]))
+}
+
+func vesperMutex(argv []*Object) (*Object, error) {
+	return Mutex(argv[0].text), nil
+}
+
+func vesperMutexP(argv []*Object) (*Object, error) {
+	return toVesperBool(argv[0].Type == MutexType)
+}
+
+func vesperLock(ctx context.Context, argv []*Object) (*Object, error) {
+	select {
+	case argv[0].Value.(*mutex).locked <- struct{}{}:
+		return Null, nil
+	case <-ctx.Done():
+		return nil, interruptError(ctx)
+	}
+}
+
+func vesperUnlock(argv []*Object) (*Object, error) {
+	m := argv[0].Value.(*mutex)
+	select {
+	case <-m.locked:
+		return Null, nil
+	default:
+		return nil, Error(ErrorKey, "unlock of unlocked mutex: ", argv[0])
+	}
+}
+
+func initAtomFunctions(vm *VM) {
+	vm.DefineFunction("atom", vesperAtom, AtomType, AnyType)
+	vm.DefineFunction("atom?", vesperAtomP, BooleanType, AnyType)
+	vm.DefineFunction("deref", vesperDeref, AnyType, AtomType)
+	vm.DefineFunction("reset!", vesperReset, AnyType, AtomType, AnyType)
+	vm.DefineFunction("compare-and-set!", vesperCompareAndSet, BooleanType, AtomType, AnyType, AnyType)
+	vm.DefineFunctionKeyArgs("mutex", vesperMutex, MutexType, []*Object{StringType}, []*Object{EmptyString}, []*Object{vm.Intern("name:")})
+	vm.DefineFunction("mutex?", vesperMutexP, BooleanType, AnyType)
+	vm.DefineContextFunction("lock", vesperLock, NullType, []*Object{MutexType})
+	vm.DefineFunction("unlock", vesperUnlock, NullType, MutexType)
+}
@@ -43,3 +43,13 @@ func arrayToBlob(obj *Object) (*Object, error) {
 	}
 	return Blob(b), nil
 }
+
+// blobToList returns a list of the bytes of the blob, as numbers
+func blobToList(obj *Object) *Object {
+	b := BlobValue(obj)
+	el := make([]*Object, len(b))
+	for i, n := range b {
+		el[i] = Int(int64(n))
+	}
+	return ListFromValues(el)
+}
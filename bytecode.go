@@ -2,6 +2,7 @@ package vesper
 
 import (
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -14,6 +15,14 @@ type Code struct {
 	defaults []*Object
 	keys     []*Object
 	vm       *VM
+	lines    []codePosition // source positions, in order of pc
+	loop     *loopInfo      // the loop that recur refers to, while the code is compiled
+}
+
+// codePosition records the source position of the ops starting at pc
+type codePosition struct {
+	pc  int
+	pos *Position
 }
 
 // IsCode returns true if the object is a code object
@@ -36,6 +45,42 @@ func MakeCode(vm *VM, argc int, defaults []*Object, keys []*Object, name string)
 	}
 }
 
+// markPosition records that the ops emitted next were compiled from source at pos
+func (code *Code) markPosition(pos *Position) {
+	if pos == nil {
+		return
+	}
+	n := len(code.lines)
+	if n > 0 {
+		last := &code.lines[n-1]
+		if last.pos == pos {
+			return
+		}
+		if last.pc == len(code.ops) {
+			last.pos = pos
+			return
+		}
+	}
+	code.lines = append(code.lines, codePosition{len(code.ops), pos})
+}
+
+// currentPosition returns the position most recently marked, or nil
+func (code *Code) currentPosition() *Position {
+	if n := len(code.lines); n > 0 {
+		return code.lines[n-1].pos
+	}
+	return nil
+}
+
+// position returns the source position of the op at pc, or nil if it is not known
+func (code *Code) position(pc int) *Position {
+	i := sort.Search(len(code.lines), func(i int) bool { return code.lines[i].pc > pc })
+	if i == 0 {
+		return nil
+	}
+	return code.lines[i-1].pos
+}
+
 func (code *Code) signature() string {
 	tmp := ""
 	for i := 0; i < code.argc; i++ {
@@ -86,16 +131,17 @@ func (code *Code) decompileInto(buf *strings.Builder, vm *VM, indent string, pre
 		op := code.ops[offset]
 		s := prefix + "(" + opsyms[op].text
 		switch op {
-		case opPop, opReturn, opNone:
+		case opPop, opReturn, opNone, opEndTry, opAdd, opSub, opMul, opDiv,
+			opNumEqual, opNumLess, opNumLessEqual, opNumGreater, opNumGreaterEqual, opDup:
 			buf.WriteString(s + ")")
 			offset++
-		case opLiteral, opDefGlobal, opUse, opGlobal, opUndefGlobal, opDefMacro:
-			buf.WriteString(s + " " + Write(vm.Constants[code.ops[offset+1]]) + ")")
+		case opLiteral, opDefGlobal, opUse, opGlobal, opUndefGlobal, opDefMacro, opModule, opExport, opImport, opJumpTable:
+			buf.WriteString(s + " " + Write(vm.constants.get(code.ops[offset+1])) + ")")
 			offset += 2
-		case opCall, opTailCall, opJumpFalse, opJump, opArray, opStruct:
+		case opCall, opTailCall, opJumpFalse, opJump, opArray, opStruct, opTry:
 			buf.WriteString(s + " " + strconv.Itoa(code.ops[offset+1]) + ")")
 			offset += 2
-		case opLocal, opSetLocal:
+		case opLocal, opSetLocal, opRecur:
 			buf.WriteString(s + " " + strconv.Itoa(code.ops[offset+1]) + " " + strconv.Itoa(code.ops[offset+2]) + ")")
 			offset += 3
 		case opClosure:
@@ -109,7 +155,7 @@ func (code *Code) decompileInto(buf *strings.Builder, vm *VM, indent string, pre
 			if pretty {
 				indent2 = indent + indentAmount
 			}
-			vm.Constants[code.ops[offset+1]].code.decompileInto(buf, vm, indent2, pretty)
+			vm.constants.get(code.ops[offset+1]).code.decompileInto(buf, vm, indent2, pretty)
 			buf.WriteString(")")
 			offset += 2
 		default:
@@ -205,6 +251,16 @@ func (code *Code) loadOps(vm *VM, lst *Object) error {
 				return err
 			}
 			code.emitSetLocal(i, j)
+		case RecurSymbol:
+			depth, err := AsIntValue(Cadr(instr))
+			if err != nil {
+				return err
+			}
+			fresh, err := AsIntValue(Caddr(instr))
+			if err != nil {
+				return err
+			}
+			code.emitRecur(depth, fresh)
 		case GlobalSymbol:
 			sym := Cadr(instr)
 			if IsSymbol(sym) {
@@ -238,16 +294,56 @@ func (code *Code) loadOps(vm *VM, lst *Object) error {
 				return err
 			}
 			code.emitTailCall(argc)
+		case TrySymbol:
+			loc, err := AsIntValue(Cadr(instr))
+			if err != nil {
+				return err
+			}
+			code.emitTry(loc)
+		case EndtrySymbol:
+			code.emitEndTry()
+		case AddSymbol:
+			code.emitNumeric(opAdd)
+		case SubSymbol:
+			code.emitNumeric(opSub)
+		case MulSymbol:
+			code.emitNumeric(opMul)
+		case DivSymbol:
+			code.emitNumeric(opDiv)
+		case NumeqSymbol:
+			code.emitNumeric(opNumEqual)
+		case NumltSymbol:
+			code.emitNumeric(opNumLess)
+		case NumleSymbol:
+			code.emitNumeric(opNumLessEqual)
+		case NumgtSymbol:
+			code.emitNumeric(opNumGreater)
+		case NumgeSymbol:
+			code.emitNumeric(opNumGreaterEqual)
 		case ReturnSymbol:
 			code.emitReturn()
 		case PopSymbol:
 			code.emitPop()
+		case DupSymbol:
+			code.emitDup()
+		case JumptableSymbol:
+			table, err := jumpTableFromArray(Cadr(instr))
+			if err != nil {
+				return err
+			}
+			code.emitJumpTable(vm.putConstant(table))
 		case DefglobalSymbol:
 			code.emitDefGlobal(vm.putConstant(Cadr(instr)))
 		case DefmacroSymbol:
 			code.emitDefMacro(vm.putConstant(Cadr(instr)))
 		case UseSymbol:
 			code.emitUse(vm.putConstant(Cadr(instr)))
+		case ModuleSymbol:
+			code.emitModule(vm.putConstant(Cadr(instr)))
+		case ExportSymbol:
+			code.emitExport(vm.putConstant(Cadr(instr)))
+		case ImportSymbol:
+			code.emitImport(vm.putConstant(Cadr(instr)))
 		default:
 			return Error(SyntaxErrorKey, fmt.Sprintf("Bad instruction: %v", op))
 		}
@@ -275,12 +371,25 @@ func (code *Code) emitTailCall(argc int) {
 func (code *Code) emitPop() {
 	code.ops = append(code.ops, opPop)
 }
+func (code *Code) emitDup() {
+	code.ops = append(code.ops, opDup)
+}
+func (code *Code) emitJumpTable(tableIdx int) int {
+	code.ops = append(code.ops, opJumpTable, tableIdx)
+	return len(code.ops) - 2
+}
 func (code *Code) emitLocal(i int, j int) {
 	code.ops = append(code.ops, opLocal, i, j)
 }
 func (code *Code) emitSetLocal(i int, j int) {
 	code.ops = append(code.ops, opSetLocal, i, j)
 }
+
+// emitRecur returns the location of the operand that says whether the iteration needs a new frame
+func (code *Code) emitRecur(depth int, fresh int) int {
+	code.ops = append(code.ops, opRecur, depth, fresh)
+	return len(code.ops) - 1
+}
 func (code *Code) emitDefGlobal(symIdx int) {
 	code.ops = append(code.ops, opDefGlobal, symIdx)
 }
@@ -301,6 +410,16 @@ func (code *Code) emitJump(offset int) int {
 	code.ops = append(code.ops, opJump, offset)
 	return len(code.ops) - 1
 }
+func (code *Code) emitTry(offset int) int {
+	code.ops = append(code.ops, opTry, offset)
+	return len(code.ops) - 1
+}
+func (code *Code) emitEndTry() {
+	code.ops = append(code.ops, opEndTry)
+}
+func (code *Code) emitNumeric(op int) {
+	code.ops = append(code.ops, op)
+}
 func (code *Code) setJumpLocation(loc int) {
 	code.ops[loc] = len(code.ops) - loc + 1
 }
@@ -313,3 +432,12 @@ func (code *Code) emitStruct(slen int) {
 func (code *Code) emitUse(symIdx int) {
 	code.ops = append(code.ops, opUse, symIdx)
 }
+func (code *Code) emitModule(symIdx int) {
+	code.ops = append(code.ops, opModule, symIdx)
+}
+func (code *Code) emitExport(symIdx int) {
+	code.ops = append(code.ops, opExport, symIdx)
+}
+func (code *Code) emitImport(symIdx int) {
+	code.ops = append(code.ops, opImport, symIdx)
+}
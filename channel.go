@@ -1,7 +1,9 @@
 package vesper
 
 import (
+	"context"
 	"fmt"
+	"reflect"
 	"time"
 )
 
@@ -75,7 +77,7 @@ func vesperClose(argv []*Object) (*Object, error) {
 	return Null, nil
 }
 
-func vesperSend(argv []*Object) (*Object, error) {
+func vesperSend(ctx context.Context, argv []*Object) (*Object, error) {
 	ch := ChannelValue(argv[0])
 	if ch != nil {
 		val := argv[1]
@@ -92,16 +94,22 @@ func vesperSend(argv []*Object) (*Object, error) {
 			case ch <- val:
 				return True, nil
 			case <-time.After(dur):
+			case <-ctx.Done():
+				return nil, interruptError(ctx)
 			}
 		} else {
-			ch <- val
-			return True, nil
+			select {
+			case ch <- val:
+				return True, nil
+			case <-ctx.Done():
+				return nil, interruptError(ctx)
+			}
 		}
 	}
 	return False, nil
 }
 
-func vesperReceive(argv []*Object) (*Object, error) {
+func vesperReceive(ctx context.Context, argv []*Object) (*Object, error) {
 	ch := ChannelValue(argv[0])
 	if ch != nil {
 		timeout := argv[1].fval
@@ -121,20 +129,133 @@ func vesperReceive(argv []*Object) (*Object, error) {
 					return val, nil
 				}
 			case <-time.After(dur):
+			case <-ctx.Done():
+				return nil, interruptError(ctx)
 			}
 		} else {
-			val := <-ch
-			if val != nil {
-				return val, nil
+			select {
+			case val := <-ch:
+				if val != nil {
+					return val, nil
+				}
+			case <-ctx.Done():
+				return nil, interruptError(ctx)
 			}
 		}
 	}
 	return Null, nil
 }
 
+// (select clause ...) waits until one of the clauses can proceed, and performs it. A clause is
+// either a channel to receive from, or a list (channel value) to send the value on. The option
+// default: makes select return at once if no clause is ready, and timeout: secs limits the wait.
+// The result is a list of the index of the clause that fired and the value received (or sent),
+// or (default: null) or (timeout: null). A receive from or a send on a closed channel fires
+// with null.
+func (vm *VM) vesperSelect(ctx context.Context, argv []*Object) (*Object, error) {
+	var cases []reflect.SelectCase
+	var values []*Object
+	var channels []*Object
+	timeout := -1.0
+	poll := false
+	for i := 0; i < len(argv); i++ {
+		clause := argv[i]
+		switch {
+		case clause == vm.Intern("default:"):
+			poll = true
+		case clause == vm.Intern("timeout:"):
+			i++
+			if i == len(argv) || argv[i].Type != NumberType {
+				return nil, Error(ArgumentErrorKey, "select expected a <number> after timeout:")
+			}
+			timeout = argv[i].fval
+		case clause.Type == ChannelType:
+			ch := ChannelValue(clause)
+			if ch == nil {
+				return List(Int(int64(len(cases))), Null), nil
+			}
+			cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ch)})
+			values = append(values, Null)
+			channels = append(channels, clause)
+		case IsList(clause) && ListLength(clause) == 2 && Car(clause).Type == ChannelType:
+			val := Cadr(clause)
+			ch := ChannelValue(Car(clause))
+			if ch == nil {
+				return List(Int(int64(len(cases))), Null), nil
+			}
+			cases = append(cases, reflect.SelectCase{Dir: reflect.SelectSend, Chan: reflect.ValueOf(ch), Send: reflect.ValueOf(val)})
+			values = append(values, val)
+			channels = append(channels, Car(clause))
+		default:
+			return nil, Error(ArgumentErrorKey, "Bad select clause: ", clause)
+		}
+	}
+	n := len(cases)
+	if poll {
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectDefault})
+	} else if timeout >= 0 {
+		timer := time.NewTimer(time.Millisecond * time.Duration(timeout*1000.0))
+		defer timer.Stop()
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(timer.C)})
+	} else if n == 0 {
+		return nil, Error(ArgumentErrorKey, "select expected at least one clause")
+	}
+	interrupt := -1
+	if done := ctx.Done(); done != nil && !poll {
+		interrupt = len(cases)
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(done)})
+	}
+	chosen, recv, ok, closed := selectCases(cases)
+	if closed {
+		// a channel was closed by another goroutine while waiting to send on it
+		for i, ch := range channels {
+			if cases[i].Dir == reflect.SelectSend && ChannelValue(ch) == nil {
+				return List(Int(int64(i)), Null), nil
+			}
+		}
+		return nil, Error(ErrorKey, "select sent on a closed channel")
+	}
+	switch {
+	case chosen == interrupt:
+		return nil, interruptError(ctx)
+	case chosen == n && poll:
+		return List(vm.Intern("default:"), Null), nil
+	case chosen == n:
+		return List(vm.Intern("timeout:"), Null), nil
+	case cases[chosen].Dir == reflect.SelectRecv:
+		val := Null
+		if ok {
+			if v, _ := recv.Interface().(*Object); v != nil {
+				val = v
+			}
+		}
+		return List(Int(int64(chosen)), val), nil
+	default:
+		return List(Int(int64(chosen)), values[chosen]), nil
+	}
+}
+
+// selectCases is reflect.Select, except that it returns closed instead of panicking if one of
+// the cases sends on a closed channel
+func selectCases(cases []reflect.SelectCase) (chosen int, recv reflect.Value, recvOK bool, closed bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			if err, ok := r.(error); !ok || err.Error() != "send on closed channel" {
+				panic(r)
+			}
+			closed = true
+		}
+	}()
+	chosen, recv, recvOK = reflect.Select(cases)
+	return
+}
+
 func initChannelFunctions(vm *VM) {
 	vm.DefineFunctionKeyArgs("channel", vesperChannel, ChannelType, []*Object{StringType, NumberType}, []*Object{EmptyString, Zero}, []*Object{vm.Intern("name:"), vm.Intern("bufsize:")})
-	vm.DefineFunctionOptionalArgs("send", vesperSend, NullType, []*Object{ChannelType, AnyType, NumberType}, MinusOne)
-	vm.DefineFunctionOptionalArgs("recv", vesperReceive, AnyType, []*Object{ChannelType, NumberType}, MinusOne)
+	vm.DefineContextFunction("send", vesperSend, NullType, []*Object{ChannelType, AnyType, NumberType}, MinusOne)
+	vm.DefineContextFunction("recv", vesperReceive, AnyType, []*Object{ChannelType, NumberType}, MinusOne)
 	vm.DefineFunction("close", vesperClose, NullType, AnyType)
+	sel := Primitive("select", nil, ListType, nil, AnyType, []*Object{}, nil)
+	sel.primitive.vmfun = (*VM).vesperSelect
+	vm.definePrimitive("select", sel)
 }
@@ -11,13 +11,14 @@ import (
 
 func main() {
 	var help, version, compile, verbose, debug bool
-	var path string
+	var path, output string
 	flag.BoolVar(&help, "help", false, "Show help")
 	flag.BoolVar(&version, "version", false, "shows the current version")
 	flag.BoolVar(&compile, "compile", false, "compile the file and output code")
 	flag.BoolVar(&verbose, "verbose", false, "verbose mode, print extra information")
 	flag.BoolVar(&debug, "debug", false, "debug mode, print extra information about compilation")
 	flag.StringVar(&path, "path", "", "add directories to vesper load path")
+	flag.StringVar(&output, "o", "", "with -compile, write a compiled .vem module to this file")
 
 	flag.Parse()
 	if help {
@@ -49,11 +50,19 @@ func main() {
 		}
 	}
 	if !interactive {
-		if compile {
+		if compile && output != "" {
+			if len(args) != 1 {
+				vesper.Fatal("*** -o requires exactly one file to compile")
+			}
+			err := vm.CompileModuleFile(args[0], output)
+			if err != nil {
+				vesper.Fatal("*** ", err.Error())
+			}
+		} else if compile {
 			for _, filename := range args {
 				generated, err := vm.CompileFile(filename)
 				if err != nil {
-					vesper.Fatal("*** ", err)
+					vesper.Fatal("*** ", err.Error())
 				}
 				vesper.Println(generated)
 			}
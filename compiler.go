@@ -40,13 +40,17 @@ func (vm *VM) compileSelfEvalLiteral(target *Object, expr *Object, isTail bool,
 }
 
 func (vm *VM) compileSymbol(target *Object, env *Object, expr *Object, isTail bool, ignoreResult bool) error {
-	if vm.GetMacro(expr) != nil {
-		return Error(vm.Intern("macro-error"), "Cannot use macro as a value: ", expr)
-	}
 	if i, j, ok := calculateLocation(expr, env); ok {
 		target.code.emitLocal(i, j)
 	} else {
-		target.code.emitGlobal(vm.putConstant(expr))
+		if vm.resolveMacro(expr) != nil {
+			return Error(vm.Intern("macro-error"), "Cannot use macro as a value: ", expr)
+		}
+		sym, err := vm.resolveGlobal(expr)
+		if err != nil {
+			return err
+		}
+		target.code.emitGlobal(vm.putConstant(sym))
 	}
 	if ignoreResult {
 		target.code.emitPop()
@@ -75,6 +79,13 @@ func (vm *VM) compileDef(target *Object, env *Object, lst *Object, isTail bool,
 	}
 	sym := Cadr(lst)
 	val := Caddr(lst)
+	if IsSymbol(sym) {
+		var err error
+		sym, err = vm.resolveDefinition(sym)
+		if err != nil {
+			return err
+		}
+	}
 	err := vm.compileExpr(target, env, val, false, false, sym.String())
 	if err == nil {
 		target.code.emitDefGlobal(vm.putConstant(sym))
@@ -95,6 +106,10 @@ func (vm *VM) compileUndef(target *Object, lst *Object, isTail bool, ignoreResul
 	if !IsSymbol(sym) {
 		return Error(SyntaxErrorKey, lst)
 	}
+	sym, err := vm.resolveGlobal(sym)
+	if err != nil {
+		return err
+	}
 	target.code.emitUndefGlobal(vm.putConstant(sym))
 	if ignoreResult {
 	} else {
@@ -114,7 +129,11 @@ func (vm *VM) compileMacro(target *Object, env *Object, expr *Object, isTail boo
 	if !IsSymbol(sym) {
 		return Error(SyntaxErrorKey, expr)
 	}
-	err := vm.compileExpr(target, env, Caddr(expr), false, false, sym.String())
+	sym, err := vm.resolveDefinition(sym)
+	if err != nil {
+		return err
+	}
+	err = vm.compileExpr(target, env, Caddr(expr), false, false, sym.String())
 	if err != nil {
 		return err
 	}
@@ -142,6 +161,10 @@ func (vm *VM) compileSet(target *Object, env *Object, lst *Object, isTail bool,
 	if i, j, ok := calculateLocation(sym, env); ok {
 		target.code.emitSetLocal(i, j)
 	} else {
+		sym, err = vm.resolveGlobal(sym)
+		if err != nil {
+			return err
+		}
 		target.code.emitDefGlobal(vm.putConstant(sym)) // fix, should be SetGlobal
 	}
 	if ignoreResult {
@@ -152,7 +175,18 @@ func (vm *VM) compileSet(target *Object, env *Object, lst *Object, isTail bool,
 	return nil
 }
 
-func (vm *VM) compileList(target *Object, env *Object, expr *Object, isTail bool, ignoreResult bool, context string) error {
+func (vm *VM) compileList(target *Object, env *Object, expr *Object, isTail bool, ignoreResult bool, context string) (err error) {
+	if expr.pos != nil {
+		// ops emitted after this list belong to the enclosing one again
+		outer := target.code.currentPosition()
+		target.code.markPosition(expr.pos)
+		defer func() {
+			target.code.markPosition(outer)
+			if err != nil {
+				err = withTrace(err, []StackFrame{{Pos: expr.pos}})
+			}
+		}()
+	}
 	if expr == EmptyList {
 		if !ignoreResult {
 			target.code.emitLiteral(vm.putConstant(expr))
@@ -182,6 +216,39 @@ func (vm *VM) compileList(target *Object, env *Object, expr *Object, isTail bool
 			return vm.compileIfElse(target, env, Cadr(expr), Caddr(expr), Cdddr(expr), isTail, ignoreResult, context)
 		}
 		return Error(SyntaxErrorKey, expr)
+	case vm.Intern("and"):
+		// (and <expr> ...)
+		return vm.compileAnd(target, env, Cdr(lst), isTail, ignoreResult, context)
+	case vm.Intern("or"):
+		// (or <expr> ...)
+		return vm.compileOr(target, env, Cdr(lst), isTail, ignoreResult, context)
+	case vm.Intern("when"):
+		// (when <pred> <expr> ...)
+		if lstlen < 2 {
+			return Error(SyntaxErrorKey, expr)
+		}
+		return vm.compileIfElse(target, env, Cadr(expr), vm.bodyExpr(Cddr(expr)), EmptyList, isTail, ignoreResult, context)
+	case vm.Intern("unless"):
+		// (unless <pred> <expr> ...)
+		if lstlen < 2 {
+			return Error(SyntaxErrorKey, expr)
+		}
+		return vm.compileIfElse(target, env, Cadr(expr), Null, List(vm.bodyExpr(Cddr(expr))), isTail, ignoreResult, context)
+	case vm.Intern("case"):
+		// (case <expr> ((<key> ...) <expr> ...) ... (else <expr> ...))
+		// (case <expr> (<key> <expr> ...) ...)
+		return vm.compileCase(target, env, expr, isTail, ignoreResult, context)
+	case vm.Intern("loop"), vm.Intern("recur"):
+		if _, _, ok := calculateLocation(fn, env); ok {
+			// a local function, such as the one bound by a named let called loop
+			return vm.compileFuncall(target, env, fn, Cdr(lst), isTail, ignoreResult, context)
+		}
+		if fn == vm.Intern("recur") {
+			// (recur <val> ...)
+			return vm.compileRecur(target, env, expr, isTail, context)
+		}
+		// (loop ((<sym> <val>) ...) <expr> ...)
+		return vm.compileLoop(target, env, expr, isTail, ignoreResult, context)
 	case vm.Intern("def"):
 		// (def <name> <val>)
 		return vm.compileDef(target, env, expr, isTail, ignoreResult, lstlen)
@@ -205,16 +272,34 @@ func (vm *VM) compileList(target *Object, env *Object, expr *Object, isTail bool
 		}
 		body := Cddr(lst)
 		args := Cadr(lst)
-		return vm.compileFn(target, env, args, body, isTail, ignoreResult, context)
+		return vm.compileFn(target, env, args, body, isTail, ignoreResult, context, nil)
 	case vm.Intern("set!"):
 		return vm.compileSet(target, env, expr, isTail, ignoreResult, context, lstlen)
 	case vm.Intern("code"):
 		return target.code.loadOps(vm, Cdr(expr))
 	case vm.Intern("use"):
 		return vm.compileUse(target, Cdr(lst))
+	case vm.Intern("module"):
+		// (module <name>)
+		return vm.compileModule(target, expr, isTail, ignoreResult, lstlen)
+	case vm.Intern("export"):
+		// (export <name> ...)
+		return vm.compileExport(target, expr, isTail, ignoreResult)
+	case vm.Intern("import"):
+		// (import <module>)
+		// (import <module> as: <alias>)
+		// (import <module> (<name> ...))
+		return vm.compileImport(target, expr, isTail, ignoreResult)
+	case vm.Intern("try"):
+		// (try <expr> ... (catch <sym> <expr> ...) ...)
+		// (try <expr> ... (catch <key> <sym> <expr> ...) ...)
+		// (try <expr> ... (catch (<key> ...) <sym> <expr> ...) ... (finally <expr> ...))
+		return vm.compileTry(target, env, expr, isTail, ignoreResult, context)
 	default:
-		fn, args := vm.optimizeFuncall(fn, Cdr(lst))
-		return vm.compileFuncall(target, env, fn, args, isTail, ignoreResult, context)
+		if ok, err := vm.optimizeFuncall(target, env, fn, Cdr(lst), isTail, ignoreResult, context); ok || err != nil {
+			return err
+		}
+		return vm.compileFuncall(target, env, fn, Cdr(lst), isTail, ignoreResult, context)
 	}
 }
 
@@ -283,7 +368,9 @@ func (vm *VM) compileExpr(target *Object, env *Object, expr *Object, isTail bool
 	}
 }
 
-func (vm *VM) compileFn(target *Object, env *Object, args *Object, body *Object, isTail bool, ignoreResult bool, context string) error {
+// compileFn compiles a closure. If loop is not nil, recur in the tail position of the body
+// refers to that loop.
+func (vm *VM) compileFn(target *Object, env *Object, args *Object, body *Object, isTail bool, ignoreResult bool, context string, loop *loopInfo) error {
 	argc := 0
 	var syms []*Object
 	var defaults []*Object
@@ -369,10 +456,15 @@ func (vm *VM) compileFn(target *Object, env *Object, args *Object, body *Object,
 			return Error(SyntaxErrorKey, tmp)
 		}
 	}
+	if loop == nil {
+		captureLoops(target.code.loop)
+	}
 	args = ListFromValues(syms)
 	newEnv := Cons(args, env)
 	fnCode := MakeCode(vm, argc, defaults, keys, context)
+	fnCode.code.loop = loop
 	err := vm.compileSequence(fnCode, newEnv, body, true, false, context)
+	fnCode.code.loop = nil
 	if err == nil {
 		if !ignoreResult {
 			target.code.emitClosure(vm.putConstant(fnCode))
@@ -398,23 +490,68 @@ func (vm *VM) compileSequence(target *Object, env *Object, exprs *Object, isTail
 	return Error(SyntaxErrorKey, Cons(vm.Intern("do"), exprs))
 }
 
-func (vm *VM) optimizeFuncall(fn *Object, args *Object) (*Object, *Object) {
-	size := ListLength(args)
-	if size == 2 {
-		switch fn {
-		case vm.Intern("+"):
-			if Equal(One, Car(args)) {
-				return vm.Intern("inc"), Cdr(args)
-			} else if Equal(One, Cadr(args)) {
-				return vm.Intern("inc"), List(Car(args))
-			}
-		case vm.Intern("-"):
-			if Equal(One, Cadr(args)) {
-				return vm.Intern("dec"), List(Car(args))
-			}
+// optimizeFuncall compiles two argument calls to the arithmetic and comparison
+// primitives into a single numeric instruction, and reports whether it did so.
+// Calls where the function name is bound to a local, or where the global is not
+// bound to the builtin primitive when the call is compiled, are left alone. The
+// primitive itself, in the function position of generated code, is also inlined.
+func (vm *VM) optimizeFuncall(target *Object, env *Object, fn *Object, args *Object, isTail bool, ignoreResult bool, context string) (bool, error) {
+	if ListLength(args) != 2 {
+		return false, nil
+	}
+	var name string
+	switch {
+	case IsSymbol(fn):
+		if _, _, ok := calculateLocation(fn, env); ok {
+			return false, nil
+		}
+		sym, err := vm.resolveGlobal(fn)
+		if err != nil {
+			return false, nil
 		}
+		if prim := vm.builtin(sym.text); prim == nil || vm.GetGlobal(sym) != prim {
+			return false, nil
+		}
+		name = sym.text
+	case fn.primitive != nil && vm.builtin(fn.primitive.name) == fn:
+		name = fn.primitive.name
+	default:
+		return false, nil
+	}
+	var op int
+	switch name {
+	case "+":
+		op = opAdd
+	case "-":
+		op = opSub
+	case "*":
+		op = opMul
+	case "/":
+		op = opDiv
+	case "=":
+		op = opNumEqual
+	case "<":
+		op = opNumLess
+	case "<=":
+		op = opNumLessEqual
+	case ">":
+		op = opNumGreater
+	case ">=":
+		op = opNumGreaterEqual
+	default:
+		return false, nil
+	}
+	err := vm.compileArgs(target, env, args, context)
+	if err != nil {
+		return true, err
+	}
+	target.code.emitNumeric(op)
+	if ignoreResult {
+		target.code.emitPop()
+	} else if isTail {
+		target.code.emitReturn()
 	}
-	return fn, args
+	return true, nil
 }
 
 func (vm *VM) compileFuncall(target *Object, env *Object, fn *Object, args *Object, isTail bool, ignoreResult bool, context string) error {
@@ -426,7 +563,12 @@ func (vm *VM) compileFuncall(target *Object, env *Object, fn *Object, args *Obje
 	if err != nil {
 		return err
 	}
-	err = vm.compileExpr(target, env, fn, false, false, context)
+	if loop := vm.innerLoop(target, fn, isTail); loop != nil {
+		// the body of a let in tail position is still in tail position of the loop
+		err = vm.compileFn(target, env, Cadr(fn), Cddr(fn), false, false, context, loop)
+	} else {
+		err = vm.compileExpr(target, env, fn, false, false, context)
+	}
 	if err != nil {
 		return err
 	}
@@ -480,6 +622,275 @@ func (vm *VM) compileIfElse(target *Object, env *Object, predicate *Object, Cons
 	return err
 }
 
+// loopInfo describes the loop that recur refers to, while the code of its body is compiled
+type loopInfo struct {
+	argc  int        // the number of loop variables
+	depth int        // the number of frames between the code being compiled and the loop's frame
+	state *loopState // shared with the lets in the body of the loop
+}
+
+// loopState records what the compiler learns about a loop while compiling its body
+type loopState struct {
+	outer    *loopState  // the loop whose body the loop is in, if any
+	captured bool        // whether a closure created in the body may refer to the loop variables
+	recurs   []recurSite // the recur instructions of the loop
+}
+
+// recurSite is the location of the operand of a recur instruction that says whether the
+// iteration it starts needs a new frame
+type recurSite struct {
+	code *Code
+	pc   int
+}
+
+// innerLoop returns the loop that recur refers to in the body of fn, if fn is a function literal
+// that is called in tail position of a loop, as the body of a let is
+func (vm *VM) innerLoop(target *Object, fn *Object, isTail bool) *loopInfo {
+	loop := target.code.loop
+	if loop == nil || !isTail || !IsList(fn) || Car(fn) != vm.Intern("fn") || ListLength(fn) < 3 {
+		return nil
+	}
+	return &loopInfo{argc: loop.argc, depth: loop.depth + 1, state: loop.state}
+}
+
+// captureLoops records that a closure is created in the body of the loops being compiled
+func captureLoops(loop *loopInfo) {
+	if loop != nil {
+		for s := loop.state; s != nil; s = s.outer {
+			s.captured = true
+		}
+	}
+}
+
+// compileLoop compiles a loop as a function of the loop variables, which is called once. Its
+// first argument is the function itself, bound to a symbol that the body cannot refer to. A
+// recur, in the loop's own code or in the body of a let in tail position, leaves the frames of
+// any lets and jumps back to the start of the loop with the new values, so iterations do not
+// call a function. If no closure is created in the body, the values are stored in the loop's
+// frame. Otherwise a closure may keep the variables, so each iteration gets a new frame, and
+// closures made in different iterations see different variables.
+func (vm *VM) compileLoop(target *Object, env *Object, expr *Object, isTail bool, ignoreResult bool, context string) error {
+	if ListLength(expr) < 3 {
+		return Error(SyntaxErrorKey, expr)
+	}
+	bindings := Cadr(expr)
+	if IsArray(bindings) {
+		bindings, _ = ToList(bindings)
+	}
+	if !IsList(bindings) {
+		return Error(SyntaxErrorKey, expr)
+	}
+	self := &Object{Type: SymbolType, text: "loop"}
+	names := []*Object{self}
+	var values []*Object
+	for ; bindings != EmptyList; bindings = Cdr(bindings) {
+		binding := Car(bindings)
+		if IsArray(binding) {
+			binding, _ = ToList(binding)
+		}
+		if !IsList(binding) || ListLength(binding) != 2 || !IsSymbol(Car(binding)) {
+			return Error(SyntaxErrorKey, "Bad loop binding: ", Car(bindings))
+		}
+		names = append(names, Car(binding))
+		values = append(values, Cadr(binding))
+	}
+	for i := len(values) - 1; i >= 0; i-- {
+		err := vm.compileExpr(target, env, values[i], false, false, context)
+		if err != nil {
+			return err
+		}
+	}
+	loop := &loopInfo{argc: len(values), state: &loopState{}}
+	if outer := target.code.loop; outer != nil {
+		loop.state.outer = outer.state
+	}
+	err := vm.compileFn(target, env, ListFromValues(names), Cddr(expr), false, false, context, loop)
+	if err != nil {
+		return err
+	}
+	if loop.state.captured {
+		for _, site := range loop.state.recurs {
+			site.code.ops[site.pc] = 1
+		}
+	}
+	// the function is both the first argument and the function called
+	target.code.emitDup()
+	if isTail {
+		target.code.emitTailCall(len(names))
+	} else {
+		target.code.emitCall(len(names))
+		if ignoreResult {
+			target.code.emitPop()
+		}
+	}
+	return nil
+}
+
+// compileRecur compiles a recur, which must be in tail position of the body of a loop
+func (vm *VM) compileRecur(target *Object, env *Object, expr *Object, isTail bool, context string) error {
+	loop := target.code.loop
+	if loop == nil || !isTail {
+		return Error(SyntaxErrorKey, "recur is not in tail position of a loop: ", expr)
+	}
+	args := Cdr(expr)
+	if argc := ListLength(args); argc != loop.argc {
+		return Error(SyntaxErrorKey, "recur expected ", loop.argc, " arguments, got ", argc, ": ", expr)
+	}
+	err := vm.compileArgs(target, env, args, context)
+	if err != nil {
+		return err
+	}
+	// whether the iteration needs a new frame is only known once the whole loop is compiled
+	pc := target.code.emitRecur(loop.depth, 0)
+	loop.state.recurs = append(loop.state.recurs, recurSite{code: target.code, pc: pc})
+	return nil
+}
+
+// bodyExpr returns a single expression for the body of a form, which may be empty
+func (vm *VM) bodyExpr(body *Object) *Object {
+	if body == EmptyList {
+		return Null
+	}
+	return Cons(vm.Intern("do"), body)
+}
+
+// compileAnd compiles the expressions so that each one is only evaluated if those before it were
+// not false. The value is false, or that of the last expression.
+func (vm *VM) compileAnd(target *Object, env *Object, exprs *Object, isTail bool, ignoreResult bool, context string) error {
+	if exprs == EmptyList {
+		return vm.compileExpr(target, env, True, isTail, ignoreResult, context)
+	}
+	var falseJumps []int
+	for ; Cdr(exprs) != EmptyList; exprs = Cdr(exprs) {
+		err := vm.compileExpr(target, env, Car(exprs), false, false, context)
+		if err != nil {
+			return err
+		}
+		falseJumps = append(falseJumps, target.code.emitJumpFalse(0))
+	}
+	err := vm.compileExpr(target, env, Car(exprs), isTail, ignoreResult, context)
+	if err != nil {
+		return err
+	}
+	if ignoreResult {
+		// nothing was left on the stack, so the jumps can go straight to the end
+		for _, loc := range falseJumps {
+			target.code.setJumpLocation(loc)
+		}
+		return nil
+	}
+	endJump := 0
+	if !isTail && falseJumps != nil {
+		endJump = target.code.emitJump(0)
+	}
+	for _, loc := range falseJumps {
+		target.code.setJumpLocation(loc)
+	}
+	if falseJumps != nil {
+		target.code.emitLiteral(vm.putConstant(False))
+		if isTail {
+			target.code.emitReturn()
+		} else {
+			target.code.setJumpLocation(endJump)
+		}
+	}
+	return nil
+}
+
+// compileOr compiles the expressions so that each one is only evaluated if those before it were
+// false. The value is that of the first expression that is not false, or false.
+func (vm *VM) compileOr(target *Object, env *Object, exprs *Object, isTail bool, ignoreResult bool, context string) error {
+	if exprs == EmptyList {
+		return vm.compileExpr(target, env, False, isTail, ignoreResult, context)
+	}
+	var endJumps []int
+	for ; Cdr(exprs) != EmptyList; exprs = Cdr(exprs) {
+		err := vm.compileExpr(target, env, Car(exprs), false, false, context)
+		if err != nil {
+			return err
+		}
+		if !ignoreResult {
+			// keep the value to return if it is not false
+			target.code.emitDup()
+		}
+		next := target.code.emitJumpFalse(0)
+		if isTail && !ignoreResult {
+			target.code.emitReturn()
+		} else {
+			endJumps = append(endJumps, target.code.emitJump(0))
+		}
+		target.code.setJumpLocation(next)
+		if !ignoreResult {
+			target.code.emitPop()
+		}
+	}
+	err := vm.compileExpr(target, env, Car(exprs), isTail, ignoreResult, context)
+	if err != nil {
+		return err
+	}
+	for _, loc := range endJumps {
+		target.code.setJumpLocation(loc)
+	}
+	return nil
+}
+
+// compileCase compiles a case form to a jumptable instruction, which jumps straight to the
+// clause whose keys include the value of the expression, or to the else clause
+func (vm *VM) compileCase(target *Object, env *Object, expr *Object, isTail bool, ignoreResult bool, context string) error {
+	if ListLength(expr) < 2 {
+		return Error(SyntaxErrorKey, expr)
+	}
+	err := vm.compileExpr(target, env, Cadr(expr), false, false, context)
+	if err != nil {
+		return err
+	}
+	table := newJumpTable()
+	start := target.code.emitJumpTable(vm.putConstant(NewObject(jumpTableType, table)))
+	elseSym := vm.Intern("else")
+	var endJumps []int
+	var otherwise *Object
+	for clauses := Cddr(expr); clauses != EmptyList; clauses = Cdr(clauses) {
+		clause := Car(clauses)
+		if !IsList(clause) || clause == EmptyList || otherwise != nil {
+			return Error(SyntaxErrorKey, "Bad case clause: ", clause)
+		}
+		if Car(clause) == elseSym {
+			otherwise = clause
+			continue
+		}
+		keys := Car(clause)
+		if !IsList(keys) {
+			keys = List(keys)
+		}
+		offset := len(target.code.ops) - start
+		for ; keys != EmptyList; keys = Cdr(keys) {
+			if !table.add(Car(keys), offset) {
+				return Error(SyntaxErrorKey, "Bad or duplicate case key: ", Car(keys))
+			}
+		}
+		err = vm.compileExpr(target, env, vm.bodyExpr(Cdr(clause)), isTail, ignoreResult, context)
+		if err != nil {
+			return err
+		}
+		if !isTail {
+			endJumps = append(endJumps, target.code.emitJump(0))
+		}
+	}
+	table.otherwise = len(target.code.ops) - start
+	body := Null
+	if otherwise != nil {
+		body = vm.bodyExpr(Cdr(otherwise))
+	}
+	err = vm.compileExpr(target, env, body, isTail, ignoreResult, context)
+	if err != nil {
+		return err
+	}
+	for _, loc := range endJumps {
+		target.code.setJumpLocation(loc)
+	}
+	return nil
+}
+
 func (vm *VM) compileUse(target *Object, rest *Object) error {
 	lstlen := ListLength(rest)
 	if lstlen != 1 {
@@ -494,3 +905,175 @@ func (vm *VM) compileUse(target *Object, rest *Object) error {
 	target.code.emitUse(symIdx)
 	return nil
 }
+
+func (vm *VM) compileModule(target *Object, expr *Object, isTail bool, ignoreResult bool, lstlen int) error {
+	if lstlen != 2 || !IsSymbol(Cadr(expr)) {
+		return Error(SyntaxErrorKey, expr)
+	}
+	target.code.emitModule(vm.putConstant(Cadr(expr)))
+	if ignoreResult {
+		target.code.emitPop()
+	} else if isTail {
+		target.code.emitReturn()
+	}
+	return nil
+}
+
+func (vm *VM) compileExport(target *Object, expr *Object, isTail bool, ignoreResult bool) error {
+	names := Cdr(expr)
+	for tmp := names; tmp != EmptyList; tmp = Cdr(tmp) {
+		if !IsSymbol(Car(tmp)) {
+			return Error(SyntaxErrorKey, expr)
+		}
+	}
+	target.code.emitExport(vm.putConstant(names))
+	if ignoreResult {
+		target.code.emitPop()
+	} else if isTail {
+		target.code.emitReturn()
+	}
+	return nil
+}
+
+func (vm *VM) compileImport(target *Object, expr *Object, isTail bool, ignoreResult bool) error {
+	spec := Cdr(expr)
+	if _, _, _, ok := vm.crackImport(spec); !ok {
+		return Error(SyntaxErrorKey, expr)
+	}
+	target.code.emitImport(vm.putConstant(spec))
+	if ignoreResult {
+		target.code.emitPop()
+	} else if isTail {
+		target.code.emitReturn()
+	}
+	return nil
+}
+
+func (vm *VM) crackTry(expr *Object) (*Object, []*Object, *Object, error) {
+	var body []*Object
+	var catches []*Object
+	var finally *Object
+	catchSym := vm.Intern("catch")
+	finallySym := vm.Intern("finally")
+	for tmp := Cdr(expr); tmp != EmptyList; tmp = Cdr(tmp) {
+		item := Car(tmp)
+		head := Null
+		if IsList(item) && item != EmptyList {
+			head = Car(item)
+		}
+		switch {
+		case finally != nil:
+			return nil, nil, nil, Error(SyntaxErrorKey, "finally must be the last clause of try: ", expr)
+		case head == finallySym:
+			finally = Cdr(item)
+			if finally == EmptyList {
+				finally = List(Null)
+			}
+		case head == catchSym:
+			catches = append(catches, item)
+		case catches != nil:
+			return nil, nil, nil, Error(SyntaxErrorKey, "try body cannot follow a catch clause: ", expr)
+		default:
+			body = append(body, item)
+		}
+	}
+	if body == nil {
+		body = []*Object{Null}
+	}
+	return ListFromValues(body), catches, finally, nil
+}
+
+// crackCatch splits a catch clause into the error keys it handles, the symbol to
+// bind the error to, and the body. An empty key list matches any error.
+func crackCatch(clause *Object) (*Object, *Object, *Object, bool) {
+	keys := EmptyList
+	rest := Cdr(clause)
+	switch a := Car(rest); a.Type {
+	case KeywordType:
+		keys = List(a)
+		rest = Cdr(rest)
+	case ListType:
+		for tmp := a; tmp != EmptyList; tmp = Cdr(tmp) {
+			if !IsKeyword(Car(tmp)) {
+				return nil, nil, nil, false
+			}
+		}
+		keys = a
+		rest = Cdr(rest)
+	}
+	sym := Car(rest)
+	if !IsSymbol(sym) {
+		return nil, nil, nil, false
+	}
+	body := Cdr(rest)
+	if body == EmptyList {
+		body = List(Null)
+	}
+	return keys, sym, body, true
+}
+
+func (vm *VM) compileTry(target *Object, env *Object, expr *Object, isTail bool, ignoreResult bool, context string) error {
+	body, catches, finally, err := vm.crackTry(expr)
+	if err != nil {
+		return err
+	}
+	// The handlers are closures of one argument. The argument is uninterned, so it
+	// cannot capture a variable of the same name referenced by the clauses, and the
+	// primitives they call are literals, so that local bindings cannot replace them.
+	errSym := &Object{Type: SymbolType, text: "err"}
+	throw := List(vm.builtinRef("throw"), errSym)
+	var finallyLoc int
+	if finally != nil {
+		handler, err := Concat(finally, List(throw))
+		if err != nil {
+			return err
+		}
+		err = vm.compileFn(target, env, List(errSym), handler, false, false, context, nil)
+		if err != nil {
+			return err
+		}
+		finallyLoc = target.code.emitTry(0)
+	}
+	if catches != nil {
+		handler := throw
+		for i := len(catches) - 1; i >= 0; i-- {
+			keys, sym, clauseBody, ok := crackCatch(catches[i])
+			if !ok {
+				return Error(SyntaxErrorKey, catches[i])
+			}
+			clause := List(Cons(vm.Intern("fn"), Cons(List(sym), clauseBody)), errSym)
+			test := List(vm.builtinRef("error-matches?"), errSym, List(vm.Intern("quote"), keys))
+			handler = List(vm.Intern("if"), test, clause, handler)
+		}
+		err = vm.compileFn(target, env, List(errSym), List(handler), false, false, context, nil)
+		if err != nil {
+			return err
+		}
+		loc := target.code.emitTry(0)
+		err = vm.compileSequence(target, env, body, false, false, context)
+		if err != nil {
+			return err
+		}
+		target.code.emitEndTry()
+		target.code.setJumpLocation(loc)
+	} else {
+		err = vm.compileSequence(target, env, body, false, false, context)
+		if err != nil {
+			return err
+		}
+	}
+	if finally != nil {
+		target.code.emitEndTry()
+		target.code.setJumpLocation(finallyLoc)
+		err = vm.compileSequence(target, env, finally, false, true, context)
+		if err != nil {
+			return err
+		}
+	}
+	if ignoreResult {
+		target.code.emitPop()
+	} else if isTail {
+		target.code.emitReturn()
+	}
+	return nil
+}
@@ -1,9 +1,10 @@
 package vesper
 
 type continuation struct {
-	ops   []int
-	stack []*Object
-	pc    int
+	ops      []int
+	stack    []*Object
+	pc       int
+	handlers []tryHandler // the try handlers active when it was captured, see saveHandlers
 }
 
 // Continuation creates a continuation object
@@ -20,3 +21,27 @@ func Continuation(frame *frame, ops []int, pc int, stack []*Object) *Object {
 		},
 	}
 }
+
+// saveHandlers returns a copy of the try handlers, for a continuation captured with them
+// active. The stack pointers become distances from the end of the stack, which is where
+// the stack segment of the continuation is restored.
+func saveHandlers(handlers []tryHandler, stackSize int) []tryHandler {
+	saved := make([]tryHandler, len(handlers))
+	for i, h := range handlers {
+		h.sp = stackSize - h.sp
+		saved[i] = h
+	}
+	return saved
+}
+
+// restoreHandlers returns the try handlers saved by saveHandlers, for a stack of the size
+// given, so that invoking a continuation unwinds the handlers of the code it escapes from,
+// and reinstates those of the code it returns to.
+func restoreHandlers(saved []tryHandler, stackSize int) []tryHandler {
+	handlers := make([]tryHandler, len(saved))
+	for i, h := range saved {
+		h.sp = stackSize - h.sp
+		handlers[i] = h
+	}
+	return handlers
+}
@@ -0,0 +1,213 @@
+package vesper
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/big"
+	"reflect"
+)
+
+// Call calls the function with the arguments, and returns its result. The function can be
+// anything that Vesper code can call, such as a closure, a primitive or a keyword.
+func (vm *VM) Call(fun *Object, args ...*Object) (*Object, error) {
+	return vm.CallContext(context.Background(), fun, args...)
+}
+
+// CallContext calls the function with the arguments, stopping with an interrupt: error
+// if the context is cancelled before it returns
+func (vm *VM) CallContext(ctx context.Context, fun *Object, args ...*Object) (*Object, error) {
+	argv := make([]*Object, 0, len(args)+1)
+	argv = append(argv, fun)
+	argv = append(argv, args...)
+	return vm.execute(ctx, callCode(vm, len(args)), argv, false)
+}
+
+// CallGlobal calls the function defined as the named global, with the arguments
+func (vm *VM) CallGlobal(name string, args ...*Object) (*Object, error) {
+	fun := vm.GetGlobal(vm.Intern(name))
+	if fun == nil {
+		return nil, Error(ArgumentErrorKey, "Undefined global: ", name)
+	}
+	return vm.Call(fun, args...)
+}
+
+// callCode returns the code for a function of argc+1 arguments, that calls its first
+// argument with the rest
+func callCode(vm *VM, argc int) *Code {
+	code := MakeCode(vm, argc+1, nil, nil, "").code
+	for i := argc; i > 0; i-- {
+		code.emitLocal(0, i)
+	}
+	code.emitLocal(0, 0)
+	code.emitCall(argc)
+	code.emitReturn()
+	return code
+}
+
+// ToGo converts a Vesper value to the equivalent Go value:
+//
+//  null                 -> nil
+//  <boolean>            -> bool
+//  <number>             -> int64 for integers, *big.Int for those too large for int64, otherwise float64
+//  <string>             -> string
+//  <character>          -> rune
+//  <keyword>, <symbol>  -> string
+//  <blob>               -> []byte
+//  <list>, <array>      -> []interface{}
+//  <struct>             -> map[string]interface{}, with keys converted to strings without a trailing colon
+//
+// An object of a type exposed with DefineGoType is returned as a pointer to its Go struct.
+// Any other value, such as a function or a channel, is returned as the *Object itself.
+func ToGo(obj *Object) interface{} {
+	switch obj.Type {
+	case NullType:
+		return nil
+	case BooleanType:
+		return obj == True
+	case NumberType:
+		switch v := obj.Value.(type) {
+		case fixnum:
+			return obj.ival
+		case *big.Int:
+			return v
+		}
+		return obj.fval
+	case StringType, KeywordType, SymbolType:
+		return obj.text
+	case CharacterType:
+		return rune(obj.fval)
+	case BlobType:
+		return BlobValue(obj)
+	case ListType:
+		values := make([]interface{}, 0, ListLength(obj))
+		for lst := obj; lst != EmptyList; lst = lst.cdr {
+			values = append(values, ToGo(lst.car))
+		}
+		return values
+	case ArrayType:
+		values := make([]interface{}, len(obj.elements))
+		for i, elem := range obj.elements {
+			values[i] = ToGo(elem)
+		}
+		return values
+	case StructType:
+		m := make(map[string]interface{}, len(obj.bindings))
+		for k, v := range obj.bindings {
+			m[unkeywordedString(k)] = ToGo(v)
+		}
+		return m
+	}
+	if g, ok := obj.Value.(*goObject); ok {
+		return g.ptr.Interface()
+	}
+	return obj
+}
+
+// FromGo converts a Go value to the equivalent Vesper value. It reverses ToGo, except that
+// slices become arrays rather than lists, and strings never become keywords or symbols. Maps
+// must have string keys, which become keywords where they are valid keyword names. Values of
+// types exposed with DefineGoType become objects of those types. A *Object is returned unchanged.
+func (vm *VM) FromGo(v interface{}) (*Object, error) {
+	switch v := v.(type) {
+	case nil:
+		return Null, nil
+	case *Object:
+		return v, nil
+	case bool:
+		if v {
+			return True, nil
+		}
+		return False, nil
+	case string:
+		return String(v), nil
+	case []byte:
+		return Blob(v), nil
+	case *big.Int:
+		return BigInt(v), nil
+	case *big.Rat:
+		return Rational(v), nil
+	case []interface{}:
+		elements := make([]*Object, len(v))
+		for i, elem := range v {
+			obj, err := vm.FromGo(elem)
+			if err != nil {
+				return nil, err
+			}
+			elements[i] = obj
+		}
+		return ArrayFromElementsNoCopy(elements), nil
+	case map[string]interface{}:
+		strct := MakeStruct(len(v))
+		for k, elem := range v {
+			obj, err := vm.FromGo(elem)
+			if err != nil {
+				return nil, err
+			}
+			Put(strct, vm.structKey(k), obj)
+		}
+		return strct, nil
+	}
+	return vm.fromGoValue(reflect.ValueOf(v))
+}
+
+// fromGoValue converts the Go values of kinds that FromGo does not handle directly
+func (vm *VM) fromGoValue(rv reflect.Value) (*Object, error) {
+	if obj, ok := vm.wrapGoValue(rv); ok {
+		return obj, nil
+	}
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return Int(rv.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n := rv.Uint()
+		if n > math.MaxInt64 {
+			return BigInt(new(big.Int).SetUint64(n)), nil
+		}
+		return Int(int64(n)), nil
+	case reflect.Float32, reflect.Float64:
+		return Number(rv.Float()), nil
+	case reflect.Bool:
+		return vm.FromGo(rv.Bool())
+	case reflect.String:
+		return String(rv.String()), nil
+	case reflect.Slice, reflect.Array:
+		elements := make([]*Object, rv.Len())
+		for i := range elements {
+			obj, err := vm.FromGo(rv.Index(i).Interface())
+			if err != nil {
+				return nil, err
+			}
+			elements[i] = obj
+		}
+		return ArrayFromElementsNoCopy(elements), nil
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			return nil, Error(ArgumentErrorKey, "Cannot convert a map with non-string keys to a <struct>: ", rv.Type().String())
+		}
+		strct := MakeStruct(rv.Len())
+		iter := rv.MapRange()
+		for iter.Next() {
+			obj, err := vm.FromGo(iter.Value().Interface())
+			if err != nil {
+				return nil, err
+			}
+			Put(strct, vm.structKey(iter.Key().String()), obj)
+		}
+		return strct, nil
+	case reflect.Ptr, reflect.Interface:
+		if rv.IsNil() {
+			return Null, nil
+		}
+		return vm.FromGo(rv.Elem().Interface())
+	}
+	return nil, Error(ArgumentErrorKey, "Cannot convert Go value to Vesper: ", fmt.Sprintf("%T", rv.Interface()))
+}
+
+// structKey returns the keyword for the name, or a string if it is not a valid keyword name
+func (vm *VM) structKey(name string) *Object {
+	if k := name + ":"; IsValidKeywordName(k) {
+		return vm.Intern(k)
+	}
+	return String(name)
+}
@@ -1,6 +1,7 @@
 package vesper
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -16,12 +17,24 @@ type Extension interface {
 // Version - this version of vesper
 const Version = "vesper v0.1"
 
-var defaultVM = &VM{
-	StackSize:    defaultStackSize,
-	Symbols:      defaultSymtab,
-	MacroMap:     copyMacros(nil),
-	ConstantsMap: copyConstantMap(nil),
-	Constants:    copyConstants(nil),
+var defaultVM = newDefaultVM()
+
+func newDefaultVM() *VM {
+	vm := &VM{
+		StackSize:     defaultStackSize,
+		MaxStackSize:  defaultMaxStackSize,
+		MaxFrameDepth: defaultMaxFrameDepth,
+		symbols:       defaultSymtab,
+		globals:       copyTable(nil),
+		macros:        copyTable(nil),
+		signatures:    copyTable(nil),
+		goTypes:       copyTable(nil),
+		primitives:    copyTable(nil),
+		constants:     newConstantPool(nil),
+		modules:       copyModules(nil),
+	}
+	vm.module.Store(newModule(""))
+	return vm
 }
 
 var loadPathSymbol = defaultVM.Intern("*load-path*")
@@ -47,6 +60,26 @@ func (vm *VM) DefineGlobal(name string, obj *Object) {
 func (vm *VM) definePrimitive(name string, prim *Object) {
 	sym := vm.Intern(name)
 	vm.defGlobal(sym, prim)
+	vm.primitives.Store(name, prim)
+}
+
+// builtin returns the primitive function defined with the name, even if the global of that
+// name has since been redefined, or nil if there is none
+func (vm *VM) builtin(name string) *Object {
+	if prim, ok := vm.primitives.Load(name); ok {
+		return prim.(*Object)
+	}
+	return nil
+}
+
+// builtinRef returns an expression that calls the primitive function defined with the name
+// when it is in the function position, regardless of the bindings of the name where the
+// expression is compiled. It is used by the code that the compiler and macros generate.
+func (vm *VM) builtinRef(name string) *Object {
+	if prim := vm.builtin(name); prim != nil {
+		return prim
+	}
+	return vm.Intern(name)
 }
 
 // DefineFunction registers a primitive function to the specified global name
@@ -73,6 +106,31 @@ func (vm *VM) DefineFunctionKeyArgs(name string, fun PrimitiveFunction, result *
 	vm.definePrimitive(name, prim)
 }
 
+// DefineContextFunction registers a primitive function that may block, such as one that waits
+// for I/O, to the specified global name. It is passed the context of the evaluation that calls
+// it, and should return promptly with an error when the context is done.
+func (vm *VM) DefineContextFunction(name string, fun ContextFunction, result *Object, args []*Object, defaults ...*Object) {
+	prim := Primitive(name, nil, result, args, nil, defaults, nil)
+	prim.primitive.ctxfun = fun
+	vm.definePrimitive(name, prim)
+}
+
+// defineMethod registers a primitive function that is called with the VM that calls it, for
+// those that use the tables or limits of the VM
+func (vm *VM) defineMethod(name string, fun vmFunction, result *Object, args []*Object, rest *Object, defaults []*Object, keys []*Object) {
+	prim := Primitive(name, nil, result, args, rest, defaults, keys)
+	prim.primitive.vmfun = fun
+	vm.definePrimitive(name, prim)
+}
+
+// defineMacroMethod registers a primitive macro that is called with the VM that expands it
+func (vm *VM) defineMacroMethod(name string, fun func(vm *VM, argv []*Object) (*Object, error)) {
+	sym := vm.Intern(name)
+	prim := Primitive(name, nil, AnyType, []*Object{AnyType}, nil, nil, nil)
+	prim.primitive.vmfun = method(fun)
+	vm.defMacro(sym, prim)
+}
+
 // DefineMacro registers a primitive macro with the specified name.
 func (vm *VM) DefineMacro(name string, fun PrimitiveFunction) {
 	sym := vm.Intern(name)
@@ -88,12 +146,27 @@ func (vm *VM) GetKeywords() []*Object {
 		vm.Intern("fn"),
 		vm.Intern("if"),
 		vm.Intern("do"),
+		vm.Intern("and"),
+		vm.Intern("or"),
+		vm.Intern("when"),
+		vm.Intern("unless"),
+		vm.Intern("case"),
+		vm.Intern("loop"),
+		vm.Intern("recur"),
+		vm.Intern("while"),
+		vm.Intern("dotimes"),
+		vm.Intern("doseq"),
 		vm.Intern("def"),
 		vm.Intern("defn"),
 		vm.Intern("defmacro"),
+		vm.Intern("define-syntax"),
 		vm.Intern("set!"),
 		vm.Intern("code"),
 		vm.Intern("use"),
+		vm.Intern("module"),
+		vm.Intern("export"),
+		vm.Intern("import"),
+		vm.Intern("try"),
 	}
 	return keywords
 }
@@ -101,66 +174,110 @@ func (vm *VM) GetKeywords() []*Object {
 // Globals - return a slice of all defined global symbols
 func (vm *VM) Globals() []*Object {
 	var syms []*Object
-	for _, sym := range vm.Symbols {
-		if sym.car != nil {
-			syms = append(syms, sym)
-		}
-	}
+	vm.globals.Range(func(k, _ interface{}) bool {
+		syms = append(syms, k.(*Object))
+		return true
+	})
 	return syms
 }
 
 // GetGlobal - return the global value for the specified symbol, or nil if the symbol is not defined.
-func GetGlobal(sym *Object) *Object {
+func (vm *VM) GetGlobal(sym *Object) *Object {
 	if IsSymbol(sym) {
-		return sym.car
+		if val, ok := vm.globals.Load(sym); ok {
+			return val.(*Object)
+		}
 	}
 	return nil
 }
 
 func (vm *VM) defGlobal(sym *Object, val *Object) {
-	sym.car = val
-	delete(vm.MacroMap, sym)
+	vm.globals.Store(sym, val)
+	vm.macros.Delete(sym)
 }
 
 // IsDefined - return true if the there is a global value defined for the symbol
-func IsDefined(sym *Object) bool {
-	return sym.car != nil
+func (vm *VM) IsDefined(sym *Object) bool {
+	_, ok := vm.globals.Load(sym)
+	return ok
 }
 
-func undefGlobal(sym *Object) {
-	sym.car = nil
+func (vm *VM) undefGlobal(sym *Object) {
+	vm.globals.Delete(sym)
 }
 
 // Macros - return a slice of all defined macros
 func (vm *VM) Macros() []*Object {
-	keys := make([]*Object, 0, len(vm.MacroMap))
-	for k := range vm.MacroMap {
-		keys = append(keys, k)
-	}
+	var keys []*Object
+	vm.macros.Range(func(k, _ interface{}) bool {
+		keys = append(keys, k.(*Object))
+		return true
+	})
 	return keys
 }
 
+// Symbols returns a copy of the symbol table, which maps the names of the interned symbols,
+// keywords and types to them. Changes to the copy do not affect the VM.
+//
+// Deprecated: the symbol table is no longer an exported field, so that it can be shared
+// safely between goroutines. Use Intern to look up or create a symbol.
+func (vm *VM) Symbols() map[string]*Object {
+	syms := make(map[string]*Object)
+	vm.symbols.Range(func(k, v interface{}) bool {
+		syms[k.(string)] = v.(*Object)
+		return true
+	})
+	return syms
+}
+
+// MacroMap returns a copy of the macro table. Changes to the copy do not affect the VM.
+//
+// Deprecated: use Macros and GetMacro.
+func (vm *VM) MacroMap() map[*Object]*Macro {
+	macros := make(map[*Object]*Macro)
+	vm.macros.Range(func(k, v interface{}) bool {
+		macros[k.(*Object)] = v.(*Macro)
+		return true
+	})
+	return macros
+}
+
+// Constants returns a copy of the constants referenced by compiled code, in the order of
+// their indexes in the code. Changes to the copy do not affect the VM.
+//
+// Deprecated: the constant pool is no longer an exported field, so that it can be shared
+// safely between goroutines.
+func (vm *VM) Constants() []*Object {
+	return append([]*Object(nil), vm.constants.all()...)
+}
+
+// ConstantsMap returns a copy of the index of each of the constants referenced by compiled
+// code. Changes to the copy do not affect the VM.
+//
+// Deprecated: see Constants.
+func (vm *VM) ConstantsMap() map[*Object]int {
+	index := make(map[*Object]int)
+	for i, c := range vm.Constants() {
+		index[c] = i
+	}
+	return index
+}
+
 // GetMacro - return the macro for the symbol, or nil if not defined
 func (vm *VM) GetMacro(sym *Object) *Macro {
-	mac, ok := vm.MacroMap[sym]
+	mac, ok := vm.macros.Load(sym)
 	if !ok {
 		return nil
 	}
-	return mac
+	return mac.(*Macro)
 }
 
 func (vm *VM) defMacro(sym *Object, val *Object) {
-	vm.MacroMap[sym] = NewMacro(sym, val)
+	vm.macros.Store(sym, NewMacro(sym, val))
 }
 
 func (vm *VM) putConstant(val *Object) int {
-	idx, present := vm.ConstantsMap[val]
-	if !present {
-		idx = len(vm.Constants)
-		vm.Constants = append(vm.Constants, val)
-		vm.ConstantsMap[val] = idx
-	}
-	return idx
+	return vm.constants.put(val)
 }
 
 // Use is a synonym for load
@@ -168,9 +285,9 @@ func (vm *VM) Use(sym *Object) error {
 	return vm.Load(sym.text)
 }
 
-func (vm *VM) importCode(thunk *Object) (*Object, error) {
+func (vm *VM) importCode(ctx context.Context, thunk *Object) (*Object, error) {
 	var args []*Object
-	result, err := vm.Execute(thunk.code, args)
+	result, err := vm.ExecuteContext(ctx, thunk.code, args)
 	if err != nil {
 		return nil, err
 	}
@@ -178,8 +295,8 @@ func (vm *VM) importCode(thunk *Object) (*Object, error) {
 }
 
 // FindModuleByName returns the file filename of a vesper module
-func FindModuleByName(moduleName string) (string, error) {
-	loadPath := GetGlobal(loadPathSymbol)
+func (vm *VM) FindModuleByName(moduleName string) (string, error) {
+	loadPath := vm.GetGlobal(loadPathSymbol)
 	if loadPath == nil {
 		loadPath = String(".")
 	}
@@ -193,11 +310,11 @@ func FindModuleByName(moduleName string) (string, error) {
 		name = name + ".vsp"
 	}
 	for _, dirname := range path {
-		filename := filepath.Join(dirname, lname)
-		if IsFileReadable(filename) {
-			return filename, nil
+		filename := filepath.Join(dirname, name)
+		compiled := filepath.Join(dirname, lname)
+		if IsFileReadable(compiled) && !isNewerFile(filename, compiled) {
+			return compiled, nil
 		}
-		filename = filepath.Join(dirname, name)
 		if IsFileReadable(filename) {
 			return filename, nil
 		}
@@ -207,28 +324,39 @@ func FindModuleByName(moduleName string) (string, error) {
 
 // Load checks for a loadable module and loads it, if it exists
 func (vm *VM) Load(name string) error {
-	file, err := FindModuleFile(name)
+	file, err := vm.FindModuleFile(name)
 	if err != nil {
 		return err
 	}
 	return vm.LoadFile(file)
 }
 
-// LoadFile loads and executes a file returning any error
+// LoadFile loads and executes a file returning any error. Imports and module
+// declarations in the file do not affect the caller.
 func (vm *VM) LoadFile(file string) error {
+	return vm.withModule(newModule(""), func() error {
+		return vm.loadFile(file)
+	})
+}
+
+func (vm *VM) loadFile(file string) error {
 	if vm.Flags.Verbose {
 		println("; loadFile: " + file)
 	} else if vm.Flags.Interactive {
 		println("[loading " + file + "]")
 	}
+	if strings.HasSuffix(file, ".vem") {
+		return vm.loadModuleFile(file)
+	}
 	fileText, err := SlurpFile(file)
 	if err != nil {
 		return err
 	}
-	exprs, err := vm.ReadAll(fileText, nil)
+	exprs, err := vm.readAll(StringValue(fileText), file, nil)
 	if err != nil {
 		return err
 	}
+	vm.declareNames(exprs)
 	for exprs != EmptyList {
 		expr := Car(exprs)
 		_, err = vm.Eval(expr)
@@ -242,6 +370,12 @@ func (vm *VM) LoadFile(file string) error {
 
 // Eval evaluates an expression
 func (vm *VM) Eval(expr *Object) (*Object, error) {
+	return vm.EvalContext(context.Background(), expr)
+}
+
+// EvalContext evaluates the expression, stopping with an interrupt: error if the context is
+// cancelled before it completes.
+func (vm *VM) EvalContext(ctx context.Context, expr *Object) (*Object, error) {
 	if vm.Flags.Debug {
 		println("; eval: ", Write(expr))
 	}
@@ -260,14 +394,14 @@ func (vm *VM) Eval(expr *Object) (*Object, error) {
 		val := strings.Replace(Write(code), "\n", "\n; ", -1)
 		println("; compiled to:\n;  ", val)
 	}
-	return vm.importCode(code)
+	return vm.importCode(ctx, code)
 }
 
 // FindModuleFile finds a readable module file or errors
-func FindModuleFile(name string) (string, error) {
+func (vm *VM) FindModuleFile(name string) (string, error) {
 	i := strings.Index(name, ".")
 	if i < 0 {
-		file, err := FindModuleByName(name)
+		file, err := vm.FindModuleByName(name)
 		if err != nil {
 			return "", err
 		}
@@ -279,34 +413,24 @@ func FindModuleFile(name string) (string, error) {
 	return name, nil
 }
 
-func (vm *VM) compileObject(expr *Object) (string, error) {
-	if vm.Flags.Debug {
-		println("; compile: ", Write(expr))
-	}
-	expanded, err := vm.macroexpandObject(expr)
-	if err != nil {
-		return "", err
-	}
-	if vm.Flags.Debug {
-		println("; expanded to: ", Write(expanded))
-	}
-	thunk, err := vm.Compile(expanded)
+// compileFileThunks reads, expands and compiles each top level form of a file into a thunk.
+// The thunks of the forms that the compiler depends on are executed once compiled, so that the
+// macros and modules they define are available to the forms that follow them. The rest are
+// only compiled.
+func (vm *VM) compileFileThunks(name string) ([]*Object, error) {
+	file, err := vm.FindModuleFile(name)
 	if err != nil {
-		return "", err
-	}
-	if vm.Flags.Debug {
-		println("; compiled to: ", Write(thunk))
+		return nil, err
 	}
-	return thunk.code.decompile(vm, true) + "\n", nil
+	var thunks []*Object
+	err = vm.withModule(newModule(""), func() error {
+		thunks, err = vm.compileFileForms(file)
+		return err
+	})
+	return thunks, err
 }
 
-// CompileFile compiles a file and returns a String object or an error
-// caveats: when you compile a file, you actually run it. This is so we can handle imports and macros correctly.
-func (vm *VM) CompileFile(name string) (*Object, error) {
-	file, err := FindModuleFile(name)
-	if err != nil {
-		return nil, err
-	}
+func (vm *VM) compileFileForms(file string) ([]*Object, error) {
 	if vm.Flags.Verbose {
 		println("; loadFile: " + file)
 	}
@@ -314,29 +438,86 @@ func (vm *VM) CompileFile(name string) (*Object, error) {
 	if err != nil {
 		return nil, err
 	}
-
-	exprs, err := vm.ReadAll(fileText, nil)
+	exprs, err := vm.readAll(StringValue(fileText), file, nil)
 	if err != nil {
 		return nil, err
 	}
-	result := ";\n; code generated from " + file + "\n;\n"
-	var lvm string
+	vm.declareNames(exprs)
+	var thunks []*Object
 	for exprs != EmptyList {
 		expr := Car(exprs)
-		lvm, err = vm.compileObject(expr)
+		if vm.Flags.Debug {
+			println("; compile: ", Write(expr))
+		}
+		expanded, err := vm.macroexpandObject(expr)
+		if err != nil {
+			return nil, err
+		}
+		if vm.Flags.Debug {
+			println("; expanded to: ", Write(expanded))
+		}
+		thunk, err := vm.Compile(expanded)
 		if err != nil {
 			return nil, err
 		}
-		result += lvm
+		if vm.Flags.Debug {
+			println("; compiled to: ", Write(thunk))
+		}
+		if vm.compileTimeForm(expanded) {
+			_, err = vm.importCode(context.Background(), thunk)
+			if err != nil {
+				return nil, err
+			}
+		}
+		thunks = append(thunks, thunk)
 		exprs = Cdr(exprs)
 	}
+	return thunks, nil
+}
+
+// compileTimeForm returns true if the expanded top level form must be run when its file is
+// compiled: macro definitions, module declarations and imports, which change how the forms
+// after them are expanded and compiled, and definitions of functions, which macros may call.
+// Defining a function has no other effect, so compiling a file does not run the program.
+func (vm *VM) compileTimeForm(expr *Object) bool {
+	if !IsList(expr) || expr == EmptyList {
+		return false
+	}
+	switch Car(expr) {
+	case vm.Intern("defmacro"), vm.Intern("module"), vm.Intern("export"), vm.Intern("import"), vm.Intern("use"):
+		return true
+	case vm.Intern("def"):
+		val := Cddr(expr)
+		return val != EmptyList && IsList(Car(val)) && Car(Car(val)) == vm.Intern("fn")
+	case vm.Intern("do"):
+		for body := Cdr(expr); body != EmptyList; body = Cdr(body) {
+			if !vm.compileTimeForm(Car(body)) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// CompileFile compiles a file and returns a String object or an error. The forms of the file
+// that the compiler depends on, such as macro definitions, are run as they are compiled.
+func (vm *VM) CompileFile(name string) (*Object, error) {
+	thunks, err := vm.compileFileThunks(name)
+	if err != nil {
+		return nil, err
+	}
+	result := ";\n; code generated from " + name + "\n;\n"
+	for _, thunk := range thunks {
+		result += thunk.code.decompile(vm, true) + "\n"
+	}
 	return String(result), nil
 }
 
 // AddVesperDirectory adds a directory to the load path
 func (vm *VM) AddVesperDirectory(dirname string) {
 	loadPath := dirname
-	tmp := GetGlobal(loadPathSymbol)
+	tmp := vm.GetGlobal(loadPathSymbol)
 	if tmp != nil {
 		loadPath = dirname + ":" + StringValue(tmp)
 	}
@@ -18,6 +18,12 @@ var (
 	IOErrorKey = defaultVM.Intern("io-error:")
 	// InterruptKey used for interrupts that were captured
 	InterruptKey = defaultVM.Intern("interrupt:")
+	// LimitErrorKey used when code exceeds one of the VM's limits
+	LimitErrorKey = defaultVM.Intern("limit-error:")
+	// StackOverflowKey used when the operand stack or the chain of call frames grows too deep
+	StackOverflowKey = defaultVM.Intern("stack-overflow:")
+	// PermissionErrorKey used when code needs a capability the VM does not have
+	PermissionErrorKey = defaultVM.Intern("permission-error:")
 	// InternalErrorKey used for internal errors
 	InternalErrorKey = defaultVM.Intern("internal-error:")
 )
@@ -63,6 +69,87 @@ func ErrorData(err *Object) *Object {
 	return err.car
 }
 
+// ErrorKeyword returns the keyword identifying the kind of error. Errors created
+// without a leading keyword are reported as error:
+func ErrorKeyword(err *Object) *Object {
+	if data := err.car; data != nil && len(data.elements) > 0 && IsKeyword(data.elements[0]) {
+		return data.elements[0]
+	}
+	return ErrorKey
+}
+
+// ErrorMatches returns true if the error's keyword is one of the keys in the list.
+// An empty list matches any error other than an interrupt or a limit error.
+func ErrorMatches(err *Object, keys *Object) bool {
+	key := ErrorKeyword(err)
+	if keys == EmptyList {
+		return key != InterruptKey && key != LimitErrorKey
+	}
+	for keys != EmptyList {
+		if keys.car == key {
+			return true
+		}
+		keys = keys.cdr
+	}
+	return false
+}
+
+// ErrorTrace returns the stack trace recorded when the error was raised, innermost call first.
+// Errors raised while reading or compiling have a single frame, with the position of the problem.
+func ErrorTrace(err *Object) []StackFrame {
+	trace, _ := err.Value.([]StackFrame)
+	return trace
+}
+
+// ErrorPosition returns the source position the error was raised at, or nil if it is not known
+func ErrorPosition(err *Object) *Position {
+	if trace := ErrorTrace(err); len(trace) > 0 {
+		return trace[0].Pos
+	}
+	return nil
+}
+
+// errorObject converts the error to an error object, if it is not one already
+func errorObject(err error) *Object {
+	if e, ok := err.(*Object); ok && e.Type == ErrorType {
+		return e
+	}
+	return MakeError(ErrorKey, String(err.Error()))
+}
+
+// withTrace records the trace in the error, unless it already has one
+func withTrace(err error, trace []StackFrame) error {
+	if e, ok := err.(*Object); ok && e.Type == ErrorType && e.Value == nil && len(trace) > 0 {
+		e.Value = trace
+	}
+	return err
+}
+
+const (
+	// maxPrintedFrames limits the number of frames of a stack trace included in the error
+	// string, of which the last printedTail are the outermost
+	maxPrintedFrames = 20
+	printedTail      = 5
+)
+
+// errorTraceList returns the stack trace of the error as a list of structs
+func (vm *VM) errorTraceList(err *Object) *Object {
+	var frames []*Object
+	for _, f := range ErrorTrace(err) {
+		fields := []*Object{vm.Intern("name:"), String(f.Name), vm.Intern("pc:"), Int(int64(f.PC))}
+		if f.Pos != nil {
+			fields = append(fields, vm.Intern("file:"), String(f.Pos.File),
+				vm.Intern("line:"), Int(int64(f.Pos.Line)), vm.Intern("column:"), Int(int64(f.Pos.Column)))
+		}
+		if f.Elided > 0 {
+			fields = append(fields, vm.Intern("elided:"), Int(int64(f.Elided)))
+		}
+		s, _ := Struct(fields)
+		frames = append(frames, s)
+	}
+	return ListFromValues(frames)
+}
+
 // Error converts the error to a string
 func (lob *Object) Error() string {
 	if lob.Type == ErrorType {
@@ -70,6 +157,25 @@ func (lob *Object) Error() string {
 		if lob.text != "" {
 			s += " [in " + lob.text + "]"
 		}
+		if pos := ErrorPosition(lob); pos != nil {
+			s = pos.String() + ": " + s
+		}
+		trace := ErrorTrace(lob)
+		if len(trace) > 1 || len(trace) == 1 && trace[0].Name != "" {
+			skipped := 0
+			for i, f := range trace {
+				skipped += f.Elided
+				if len(trace) > maxPrintedFrames && i >= maxPrintedFrames-printedTail && i < len(trace)-printedTail {
+					skipped++
+					continue
+				}
+				if skipped > 0 {
+					s += fmt.Sprintf("\n    ... %d more", skipped)
+					skipped = 0
+				}
+				s += "\n    at " + f.String()
+			}
+		}
 		return s
 	}
 	return lob.String()
@@ -13,6 +13,7 @@ type frame struct {
 	elements  []*Object
 	firstfive [5]*Object
 	pc        int
+	depth     int // the number of frames below this one in the call chain
 }
 
 func (frame *frame) String() string {
@@ -32,6 +33,77 @@ func (frame *frame) String() string {
 	return buf.String()
 }
 
+// StackFrame describes one active call when an error was raised
+type StackFrame struct {
+	Name   string    // the function name, or "" if it is anonymous
+	PC     int       // the offset of the op being executed in the function's code
+	Pos    *Position // where in the function the error was raised, or nil if unknown
+	Elided int       // the number of calls left out of the trace between this one and the last
+}
+
+const (
+	// traceHead and traceTail limit the calls recorded in the stack trace of an error. When
+	// more are active, only the innermost traceHead and the outermost traceTail are recorded.
+	traceHead = 40
+	traceTail = 10
+)
+
+func (sf StackFrame) String() string {
+	name := sf.Name
+	if name == "" {
+		name = "(anonymous)"
+	}
+	if sf.Pos != nil {
+		return name + " (" + sf.Pos.String() + ")"
+	}
+	return name
+}
+
+// stackTrace walks the call chain from the frame executing the op at pc
+func stackTrace(env *frame, pc int) []StackFrame {
+	var trace []StackFrame
+	elided := 0
+	for env != nil {
+		if len(trace) == traceHead {
+			// skip to the outermost calls, which are the frames of depth below traceTail
+			for env.depth >= traceTail && env.previous != nil {
+				if env.code != nil {
+					elided++
+				}
+				pc = env.pc - 1
+				env = env.previous
+			}
+		}
+		if env.code != nil {
+			trace = append(trace, StackFrame{Name: env.code.name, PC: pc, Pos: env.code.position(pc), Elided: elided})
+			elided = 0
+		}
+		// the frame returns to just after the call op in its caller
+		pc = env.pc - 1
+		env = env.previous
+	}
+	return trace
+}
+
+// copy returns a new frame with the same variables, in the same place in the call chain
+func (f *frame) copy() *frame {
+	c := &frame{
+		previous: f.previous,
+		pc:       f.pc,
+		ops:      f.ops,
+		locals:   f.locals,
+		code:     f.code,
+		depth:    f.depth,
+	}
+	if len(f.elements) <= len(c.firstfive) {
+		c.elements = c.firstfive[:len(f.elements)]
+	} else {
+		c.elements = make([]*Object, len(f.elements))
+	}
+	copy(c.elements, f.elements)
+	return c
+}
+
 func (vm *VM) buildFrame(env *frame, pc int, ops []int, fun *Object, argc int, stack []*Object, sp int) (*frame, error) {
 	f := &frame{
 		previous: env,
@@ -40,6 +112,12 @@ func (vm *VM) buildFrame(env *frame, pc int, ops []int, fun *Object, argc int, s
 		locals:   fun.frame,
 		code:     fun.code,
 	}
+	if env != nil {
+		f.depth = env.depth + 1
+		if err := vm.checkStackDepth(f); err != nil {
+			return nil, err
+		}
+	}
 	expectedArgc := fun.code.argc
 	defaults := fun.code.defaults
 	if defaults == nil {
@@ -68,7 +68,7 @@ func functionSignature(f *Object) string {
 		return "(<function>) <any>"
 	}
 	if f == GoFunc {
-		return "(<function> <any>*) <null>"
+		return "(<function> <any>*) <task>"
 	}
 	return "(<invalidfunction>) <invalid>"
 }
@@ -58,29 +58,29 @@ func signatureCombos(argtypes []*Object) []string {
 	}
 }
 
-var cachedSigs = make(map[string][]*Object)
-
+// arglistSignatures returns the signatures that match the argument types, most specific first.
+// They are cached per VM, since the symbols are interned in the VM's symbol table.
 func (vm *VM) arglistSignatures(args []*Object) []*Object {
 	key := arglistSignature(args)
-	sigs, ok := cachedSigs[key]
-	if !ok {
-		var argtypes []*Object
-		for _, arg := range args {
-			argtypes = append(argtypes, arg.Type)
-		}
-		stringSigs := signatureCombos(argtypes)
-		sigs = make([]*Object, 0, len(stringSigs))
-		for _, sig := range stringSigs {
-			sigs = append(sigs, vm.Intern(sig))
-		}
-		cachedSigs[key] = sigs
+	if sigs, ok := vm.signatures.Load(key); ok {
+		return sigs.([]*Object)
+	}
+	var argtypes []*Object
+	for _, arg := range args {
+		argtypes = append(argtypes, arg.Type)
+	}
+	stringSigs := signatureCombos(argtypes)
+	sigs := make([]*Object, 0, len(stringSigs))
+	for _, sig := range stringSigs {
+		sigs = append(sigs, vm.Intern(sig))
 	}
+	vm.signatures.Store(key, sigs)
 	return sigs
 }
 
 func (vm *VM) getfn(sym *Object, args []*Object) (*Object, error) {
 	sigs := vm.arglistSignatures(args)
-	gfs := GetGlobal(GenfnsSymbol)
+	gfs := vm.GetGlobal(GenfnsSymbol)
 	if gfs != nil && gfs.Type == StructType {
 		gf := structGet(gfs, sym)
 		if IsNull(gf) {
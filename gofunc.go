@@ -0,0 +1,413 @@
+package vesper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"reflect"
+	"strings"
+	"unicode"
+)
+
+var (
+	objectType  = reflect.TypeOf((*Object)(nil))
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+)
+
+// A goType describes a Go struct type exposed to Vesper by DefineGoType
+type goType struct {
+	vtype  *Object         // the Vesper type
+	rtype  reflect.Type    // the Go struct type
+	keys   []*Object       // the keyword for each exposed field, in order
+	fields map[*Object]int // the index of the field for each keyword
+}
+
+// goObject is the Value of a Vesper object that holds a Go struct
+type goObject struct {
+	vm  *VM
+	typ *goType
+	ptr reflect.Value // a pointer to the struct
+}
+
+func (g *goObject) String() string {
+	var buf strings.Builder
+	buf.WriteString("#[" + typeNameString(g.typ.vtype.text))
+	for _, k := range g.typ.keys {
+		v, err := g.get(k)
+		if err != nil {
+			continue
+		}
+		buf.WriteString(" " + k.text + " " + Write(v))
+	}
+	buf.WriteString("]")
+	return buf.String()
+}
+
+// get returns the value of the field for the keyword, or null if there is no such field
+func (g *goObject) get(key *Object) (*Object, error) {
+	i, ok := g.typ.fields[key]
+	if !ok {
+		return Null, nil
+	}
+	return g.vm.FromGo(g.ptr.Elem().Field(i).Interface())
+}
+
+// DefineGoType exposes a Go struct type to Vesper as the named type, such as <point>, given
+// a value of the type or a pointer to one. Go functions defined with DefineGoFunc can then
+// take and return values of the type, which Vesper code sees as objects of the named type.
+// Their exported fields can be read by calling a keyword on them, as for a <struct>. The
+// keyword for a field is its name in lower case, with hyphens between words, so that FirstName
+// becomes first-name:. A `vesper:"name"` tag on the field overrides the name, and `vesper:"-"`
+// hides the field.
+func (vm *VM) DefineGoType(name string, sample interface{}) (*Object, error) {
+	t := reflect.TypeOf(sample)
+	if t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil, Error(ArgumentErrorKey, "DefineGoType expected a struct, got ", fmt.Sprintf("%T", sample))
+	}
+	if !IsValidTypeName(name) {
+		return nil, Error(ArgumentErrorKey, "DefineGoType expected a type name such as <point>, got ", name)
+	}
+	gt := &goType{vtype: vm.Intern(name), rtype: t, fields: make(map[*Object]int)}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue // unexported
+		}
+		fname := f.Tag.Get("vesper")
+		if fname == "-" {
+			continue
+		}
+		if fname == "" {
+			fname = hyphenate(f.Name)
+		}
+		key := vm.Intern(fname + ":")
+		gt.keys = append(gt.keys, key)
+		gt.fields[key] = i
+	}
+	vm.goTypes.Store(t, gt)
+	return gt.vtype, nil
+}
+
+// hyphenate converts a Go name such as FirstName or HTTPServer into first-name or http-server
+func hyphenate(name string) string {
+	runes := []rune(name)
+	var buf strings.Builder
+	for i, r := range runes {
+		if unicode.IsUpper(r) && i > 0 {
+			prev := runes[i-1]
+			if !unicode.IsUpper(prev) || (i+1 < len(runes) && unicode.IsLower(runes[i+1])) {
+				buf.WriteRune('-')
+			}
+		}
+		buf.WriteRune(unicode.ToLower(r))
+	}
+	return buf.String()
+}
+
+// lookupGoType returns the exposed type for a struct type or a pointer to one
+func (vm *VM) lookupGoType(t reflect.Type) (*goType, bool) {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if gt, ok := vm.goTypes.Load(t); ok {
+		return gt.(*goType), true
+	}
+	return nil, false
+}
+
+// wrapGoValue returns the Vesper object for a value of an exposed struct type, or a pointer
+// to one. A struct is copied, so that the object does not share it with the caller.
+func (vm *VM) wrapGoValue(rv reflect.Value) (*Object, bool) {
+	gt, ok := vm.lookupGoType(rv.Type())
+	if !ok {
+		return nil, false
+	}
+	ptr := rv
+	if rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return Null, true
+		}
+	} else {
+		ptr = reflect.New(rv.Type())
+		ptr.Elem().Set(rv)
+	}
+	return NewObject(gt.vtype, &goObject{vm: vm, typ: gt, ptr: ptr}), true
+}
+
+// vesperType returns the Vesper type used in the signature of a Go function for the Go type
+func (vm *VM) vesperType(t reflect.Type) (*Object, error) {
+	if t == objectType {
+		return AnyType, nil
+	}
+	if gt, ok := vm.lookupGoType(t); ok {
+		return gt.vtype, nil
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return BooleanType, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		return NumberType, nil
+	case reflect.String:
+		return StringType, nil
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return BlobType, nil
+		}
+		if _, err := vm.vesperType(t.Elem()); err != nil {
+			return nil, err
+		}
+		return AnyType, nil // a list or an array
+	case reflect.Map:
+		if t.Key().Kind() == reflect.String {
+			if _, err := vm.vesperType(t.Elem()); err == nil {
+				return StructType, nil
+			}
+		}
+	case reflect.Interface:
+		return AnyType, nil
+	}
+	return nil, Error(ArgumentErrorKey, "Go type cannot be used by Vesper: ", t.String())
+}
+
+// integerValue returns the value of a number that is an integer, exact or not, or nil if the
+// object is not one
+func integerValue(obj *Object) *big.Int {
+	if obj.Type != NumberType {
+		return nil
+	}
+	if IsInt(obj) {
+		return bigValue(obj)
+	}
+	if IsExact(obj) || math.IsInf(obj.fval, 0) || obj.fval != math.Trunc(obj.fval) {
+		return nil
+	}
+	n, _ := big.NewFloat(obj.fval).Int(nil)
+	return n
+}
+
+// toGoValue converts a Vesper value to a Go value of the given type, returning false
+// if it cannot be converted
+func (vm *VM) toGoValue(obj *Object, t reflect.Type) (reflect.Value, bool) {
+	if t == objectType {
+		return reflect.ValueOf(obj), true
+	}
+	if g, ok := obj.Value.(*goObject); ok {
+		if t == g.ptr.Type() {
+			return g.ptr, true
+		}
+		if t == g.typ.rtype {
+			return g.ptr.Elem(), true
+		}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		if obj.Type == BooleanType {
+			return reflect.ValueOf(obj == True), true
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if n := integerValue(obj); n != nil && n.IsInt64() {
+			v := reflect.New(t).Elem()
+			if !v.OverflowInt(n.Int64()) {
+				v.SetInt(n.Int64())
+				return v, true
+			}
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if n := integerValue(obj); n != nil && n.IsUint64() {
+			v := reflect.New(t).Elem()
+			if !v.OverflowUint(n.Uint64()) {
+				v.SetUint(n.Uint64())
+				return v, true
+			}
+		}
+	case reflect.Float32, reflect.Float64:
+		if obj.Type == NumberType {
+			return reflect.ValueOf(obj.fval).Convert(t), true
+		}
+	case reflect.String:
+		if obj.Type == StringType {
+			return reflect.ValueOf(obj.text).Convert(t), true
+		}
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 && obj.Type == BlobType {
+			return reflect.ValueOf(BlobValue(obj)).Convert(t), true
+		}
+		var elements []*Object
+		switch obj.Type {
+		case ArrayType:
+			elements = obj.elements
+		case ListType:
+			for lst := obj; lst != EmptyList; lst = lst.cdr {
+				elements = append(elements, lst.car)
+			}
+		default:
+			return reflect.Value{}, false
+		}
+		v := reflect.MakeSlice(t, len(elements), len(elements))
+		for i, elem := range elements {
+			ev, ok := vm.toGoValue(elem, t.Elem())
+			if !ok {
+				return ev, false
+			}
+			v.Index(i).Set(ev)
+		}
+		return v, true
+	case reflect.Map:
+		if obj.Type == StructType && t.Key().Kind() == reflect.String {
+			v := reflect.MakeMapWithSize(t, len(obj.bindings))
+			for k, elem := range obj.bindings {
+				ev, ok := vm.toGoValue(elem, t.Elem())
+				if !ok {
+					return ev, false
+				}
+				v.SetMapIndex(reflect.ValueOf(unkeywordedString(k)).Convert(t.Key()), ev)
+			}
+			return v, true
+		}
+	case reflect.Interface:
+		if t.NumMethod() == 0 {
+			if v := ToGo(obj); v != nil {
+				return reflect.ValueOf(v), true
+			}
+			return reflect.Zero(t), true
+		}
+		if g, ok := obj.Value.(*goObject); ok && g.ptr.Type().Implements(t) {
+			return g.ptr, true
+		}
+		if obj.Value != nil && reflect.TypeOf(obj.Value).Implements(t) {
+			return reflect.ValueOf(obj.Value), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// DefineGoFunc registers a Go function as a primitive with the specified global name. The
+// signature of the primitive is derived from the function's type. Go booleans, numbers,
+// strings and byte slices are passed as the corresponding Vesper types, other slices as lists
+// or arrays, maps with string keys as structs, *Object as itself, and types exposed with
+// DefineGoType as objects of those types. A variadic function takes rest arguments. If the
+// first parameter is a context.Context, it is passed the context of the calling evaluation.
+// A trailing error result is raised as a Vesper error if it is not nil, or as an interrupt:
+// if it is the error of the cancelled context. Of the other results, a single one is
+// converted with FromGo and returned, and several are returned as a list. A panic in the
+// function is raised as a Vesper error.
+func (vm *VM) DefineGoFunc(name string, fn interface{}) error {
+	fv := reflect.ValueOf(fn)
+	if fv.Kind() != reflect.Func {
+		return Error(ArgumentErrorKey, "DefineGoFunc expected a function, got ", fmt.Sprintf("%T", fn))
+	}
+	ft := fv.Type()
+	first := 0
+	if ft.NumIn() > 0 && ft.In(0) == contextType {
+		first = 1
+	}
+	var args []*Object
+	var rest *Object
+	var defaults []*Object
+	params := make([]reflect.Type, 0, ft.NumIn())
+	for i := first; i < ft.NumIn(); i++ {
+		t := ft.In(i)
+		if ft.IsVariadic() && i == ft.NumIn()-1 {
+			t = t.Elem()
+		}
+		vt, err := vm.vesperType(t)
+		if err != nil {
+			return err
+		}
+		params = append(params, t)
+		if ft.IsVariadic() && i == ft.NumIn()-1 {
+			rest = vt
+			defaults = []*Object{}
+		} else {
+			args = append(args, vt)
+		}
+	}
+	nout := ft.NumOut()
+	returnsError := nout > 0 && ft.Out(nout-1) == errorType
+	if returnsError {
+		nout--
+	}
+	result := NullType
+	switch nout {
+	case 0:
+	case 1:
+		vt, err := vm.vesperType(ft.Out(0))
+		if err != nil {
+			return err
+		}
+		result = vt
+	default:
+		result = ListType
+	}
+	prim := Primitive(name, nil, result, args, rest, defaults, nil)
+	prim.primitive.vmfun = func(vm *VM, ctx context.Context, argv []*Object) (*Object, error) {
+		in := make([]reflect.Value, 0, len(argv)+first)
+		if first > 0 {
+			in = append(in, reflect.ValueOf(ctx))
+		}
+		for i, arg := range argv {
+			t := params[len(params)-1]
+			if i < len(params) {
+				t = params[i]
+			}
+			v, ok := vm.toGoValue(arg, t)
+			if !ok {
+				if arg.Type == NumberType {
+					// the number is out of range, or not an integer
+					return nil, Error(ArgumentErrorKey, fmt.Sprintf("%s expected a Go %s for argument %d, got %s", name, t.String(), i+1, arg.String()))
+				}
+				return nil, Error(ArgumentErrorKey, fmt.Sprintf("%s expected a Go %s for argument %d, got a %s", name, t.String(), i+1, arg.Type.text))
+			}
+			in = append(in, v)
+		}
+		out, err := callGoFunc(name, fv, in)
+		if err != nil {
+			return nil, err
+		}
+		if returnsError && !out[nout].IsNil() {
+			err := out[nout].Interface().(error)
+			if e, ok := err.(*Object); ok {
+				return nil, e
+			}
+			if ctx.Err() != nil && errors.Is(err, ctx.Err()) {
+				return nil, interruptError(ctx)
+			}
+			return nil, Error(ErrorKey, err.Error())
+		}
+		values := make([]*Object, nout)
+		for i := range values {
+			v, err := vm.FromGo(out[i].Interface())
+			if err != nil {
+				return nil, err
+			}
+			values[i] = v
+		}
+		switch nout {
+		case 0:
+			return Null, nil
+		case 1:
+			return values[0], nil
+		}
+		return ListFromValues(values), nil
+	}
+	vm.definePrimitive(name, prim)
+	return nil
+}
+
+// callGoFunc calls a function registered with DefineGoFunc, raising an error if it panics
+func callGoFunc(name string, fv reflect.Value, in []reflect.Value) (out []reflect.Value, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			out, err = nil, Error(ErrorKey, name, " panicked: ", fmt.Sprint(r))
+		}
+	}()
+	return fv.Call(in), nil
+}
@@ -0,0 +1,359 @@
+package vesper
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"reflect"
+	"sort"
+)
+
+// HashtableType - the type of Vesper's mutable hash table
+var HashtableType = defaultVM.Intern("<hashtable>")
+
+// A hashtable maps keys of any type to values. By default keys are compared with keyEqual, which
+// is equal? except for floats, and hashed consistently with it, so that numbers, lists and arrays
+// can be used as keys. In identity mode keys are compared with identical? instead. Like structs,
+// hash tables are not synchronized.
+type hashtable struct {
+	identity bool
+	count    int
+	buckets  map[uint64][]*hashEntry
+}
+
+type hashEntry struct {
+	key   *Object
+	value *Object
+}
+
+func newHashtable(identity bool) *hashtable {
+	return &hashtable{identity: identity, buckets: make(map[uint64][]*hashEntry)}
+}
+
+func (ht *hashtable) String() string {
+	return fmt.Sprintf("#[hashtable %d entries]", ht.count)
+}
+
+// Equal makes equal? compare hash tables by their contents
+func (ht *hashtable) Equal(other interface{}) bool {
+	o, ok := other.(*hashtable)
+	if !ok || o.identity != ht.identity || o.count != ht.count {
+		return false
+	}
+	for _, bucket := range ht.buckets {
+		for _, e := range bucket {
+			v, ok := o.get(e.key)
+			if !ok || !Equal(e.value, v) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (ht *hashtable) hash(key *Object) uint64 {
+	if ht.identity {
+		return identityHash(key)
+	}
+	return Hash(key)
+}
+
+func (ht *hashtable) same(k1 *Object, k2 *Object) bool {
+	if ht.identity {
+		return k1 == k2
+	}
+	return keyEqual(k1, k2)
+}
+
+func (ht *hashtable) find(key *Object) (uint64, int) {
+	h := ht.hash(key)
+	for i, e := range ht.buckets[h] {
+		if ht.same(e.key, key) {
+			return h, i
+		}
+	}
+	return h, -1
+}
+
+func (ht *hashtable) get(key *Object) (*Object, bool) {
+	h, i := ht.find(key)
+	if i < 0 {
+		return nil, false
+	}
+	return ht.buckets[h][i].value, true
+}
+
+func (ht *hashtable) put(key *Object, val *Object) {
+	h, i := ht.find(key)
+	if i >= 0 {
+		ht.buckets[h][i].value = val
+		return
+	}
+	ht.buckets[h] = append(ht.buckets[h], &hashEntry{key, val})
+	ht.count++
+}
+
+func (ht *hashtable) remove(key *Object) bool {
+	h, i := ht.find(key)
+	if i < 0 {
+		return false
+	}
+	bucket := ht.buckets[h]
+	if len(bucket) == 1 {
+		delete(ht.buckets, h)
+	} else {
+		ht.buckets[h] = append(bucket[:i:i], bucket[i+1:]...)
+	}
+	ht.count--
+	return true
+}
+
+// entries returns a list of the result of calling fun on each entry
+func (ht *hashtable) entries(fun func(e *hashEntry) *Object) *Object {
+	// the buckets are visited in order of their hashes, so that the order is the same each time
+	hashes := make([]uint64, 0, len(ht.buckets))
+	for h := range ht.buckets {
+		hashes = append(hashes, h)
+	}
+	sort.Slice(hashes, func(i, j int) bool { return hashes[i] < hashes[j] })
+	el := make([]*Object, 0, ht.count)
+	for _, h := range hashes {
+		for _, e := range ht.buckets[h] {
+			el = append(el, fun(e))
+		}
+	}
+	return ListFromValues(el)
+}
+
+// keyEqual compares the keys of hash tables and hash maps. It is the same as equal?, except that
+// floats, which equal? compares within a small tolerance, are only equal if they are the same,
+// so that keys that are equal always have the same Hash.
+func keyEqual(o1 *Object, o2 *Object) bool {
+	if o1 == o2 {
+		return true
+	}
+	if o1.Type != o2.Type {
+		return persistentEqual(o1, o2, keyEqual)
+	}
+	switch o1.Type {
+	case NumberType:
+		if IsExact(o1) || IsExact(o2) {
+			return numberEquivalent(o1, o2)
+		}
+		return o1.fval == o2.fval
+	case ListType:
+		for o1 != EmptyList && o2 != EmptyList {
+			if !keyEqual(o1.car, o2.car) {
+				return false
+			}
+			o1, o2 = o1.cdr, o2.cdr
+			if o1.Type != ListType || o2.Type != ListType {
+				return keyEqual(o1, o2)
+			}
+		}
+		return o1 == o2
+	case ArrayType:
+		if len(o1.elements) != len(o2.elements) {
+			return false
+		}
+		for i, elem := range o1.elements {
+			if !keyEqual(elem, o2.elements[i]) {
+				return false
+			}
+		}
+		return true
+	case StructType:
+		if len(o1.bindings) != len(o2.bindings) {
+			return false
+		}
+		for k, v := range o1.bindings {
+			v2, ok := o2.bindings[structKey(o2, k)]
+			if !ok || !keyEqual(v, v2) {
+				return false
+			}
+		}
+		return true
+	}
+	switch v1 := o1.Value.(type) {
+	case *vector:
+		v2, ok := o2.Value.(*vector)
+		if !ok || v1.count != v2.count {
+			return false
+		}
+		for i := 0; i < v1.count; i++ {
+			if !keyEqual(v1.nth(i), v2.nth(i)) {
+				return false
+			}
+		}
+		return true
+	case *hashMap:
+		m2, ok := o2.Value.(*hashMap)
+		if !ok || v1.count != m2.count {
+			return false
+		}
+		equal := true
+		v1.root.each(func(e *hamtEntry) {
+			if equal {
+				v, ok := m2.get(e.key)
+				equal = ok && keyEqual(e.value, v)
+			}
+		})
+		return equal
+	}
+	return Equal(o1, o2)
+}
+
+// Hash returns a hash code for the object that is consistent with keyEqual: objects that are
+// equal have the same hash code. Extension values that implement Hasher provide their own.
+func Hash(obj *Object) uint64 {
+	switch obj.Type {
+	case NullType:
+		return 0
+	case BooleanType, CharacterType:
+		return mixHash(identityHash(obj.Type), uint64(obj.fval))
+	case NumberType:
+		f := obj.fval
+		if f == 0 {
+			f = 0 // so that -0.0 and 0.0 hash the same
+		}
+		return mixHash(identityHash(obj.Type), math.Float64bits(f))
+	case StringType, SymbolType, KeywordType, TypeType:
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(obj.text))
+		return mixHash(identityHash(obj.Type), h.Sum64())
+	case ListType:
+		h := identityHash(obj.Type)
+		for lst := obj; lst != EmptyList; lst = lst.cdr {
+			h = mixHash(h, Hash(lst.car))
+		}
+		return h
+	case ArrayType:
+		h := identityHash(obj.Type)
+		for _, elem := range obj.elements {
+			h = mixHash(h, Hash(elem))
+		}
+		return h
+	case StructType:
+		// the order of the bindings is not defined, so combine them with an addition
+		h := identityHash(obj.Type)
+		for k, v := range obj.bindings {
+			h += mixHash(Hash(k), Hash(v))
+		}
+		return h
+	case VectorType, HashMapType:
+		// the same as the array or struct that they are equal to
+		return obj.Value.(Hasher).Hash()
+	}
+	switch v := obj.Value.(type) {
+	case Hasher:
+		return mixHash(identityHash(obj.Type), v.Hash())
+	case Equaler:
+		return identityHash(obj.Type)
+	}
+	if val := Value(obj); val != obj {
+		return mixHash(identityHash(obj.Type), Hash(val))
+	}
+	return identityHash(obj)
+}
+
+func identityHash(obj *Object) uint64 {
+	return mixHash(0, uint64(reflect.ValueOf(obj).Pointer()))
+}
+
+func mixHash(h uint64, n uint64) uint64 {
+	h ^= n + 0x9e3779b97f4a7c15 + (h << 6) + (h >> 2)
+	return h
+}
+
+func hashtableValue(obj *Object) *hashtable {
+	v, _ := obj.Value.(*hashtable)
+	return v
+}
+
+// Hashtable - create a new, empty hash table. If identity is true, keys are compared with identical?
+// rather than equal?.
+func Hashtable(identity bool) *Object {
+	return NewObject(HashtableType, newHashtable(identity))
+}
+
+func hashtableToList(obj *Object) *Object {
+	return hashtableValue(obj).entries(func(e *hashEntry) *Object {
+		return List(e.key, e.value)
+	})
+}
+
+// VM Primitives
+
+// (hashtable key val ...) returns a new hash table holding the keys and values
+func vesperHashtable(argv []*Object) (*Object, error) {
+	if len(argv)%2 != 0 {
+		return nil, Error(ArgumentErrorKey, "Mismatched key/value in arglist: ", argv[len(argv)-1])
+	}
+	h := Hashtable(false)
+	ht := hashtableValue(h)
+	for i := 0; i < len(argv); i += 2 {
+		ht.put(argv[i], argv[i+1])
+	}
+	return h, nil
+}
+
+func vesperMakeHashtable(argv []*Object) (*Object, error) {
+	return Hashtable(argv[0] == True), nil
+}
+
+func vesperHashtableP(argv []*Object) (*Object, error) {
+	return toVesperBool(argv[0].Type == HashtableType)
+}
+
+func vesperHashtableGet(argv []*Object) (*Object, error) {
+	if v, ok := hashtableValue(argv[0]).get(argv[1]); ok {
+		return v, nil
+	}
+	return argv[2], nil
+}
+
+func vesperHashtableHasP(argv []*Object) (*Object, error) {
+	_, ok := hashtableValue(argv[0]).get(argv[1])
+	return toVesperBool(ok)
+}
+
+func (vm *VM) vesperHashtablePut(argv []*Object) (*Object, error) {
+	table := hashtableValue(argv[0])
+	if _, ok := table.get(argv[1]); !ok {
+		// the table is changed in place, so its size is checked before adding to it
+		if err := vm.checkCollectionSize(table.count + 1); err != nil {
+			return nil, err
+		}
+	}
+	table.put(argv[1], argv[2])
+	return Null, nil
+}
+
+func vesperHashtableRemove(argv []*Object) (*Object, error) {
+	return toVesperBool(hashtableValue(argv[0]).remove(argv[1]))
+}
+
+func vesperHashtableCount(argv []*Object) (*Object, error) {
+	return Int(int64(hashtableValue(argv[0]).count)), nil
+}
+
+func vesperHashtableKeys(argv []*Object) (*Object, error) {
+	return hashtableValue(argv[0]).entries(func(e *hashEntry) *Object { return e.key }), nil
+}
+
+func vesperHashtableValues(argv []*Object) (*Object, error) {
+	return hashtableValue(argv[0]).entries(func(e *hashEntry) *Object { return e.value }), nil
+}
+
+func initHashtableFunctions(vm *VM) {
+	vm.DefineFunctionRestArgs("hashtable", vesperHashtable, HashtableType, AnyType)
+	vm.DefineFunctionKeyArgs("make-hashtable", vesperMakeHashtable, HashtableType, []*Object{BooleanType}, []*Object{False}, []*Object{vm.Intern("identity:")})
+	vm.DefineFunction("hashtable?", vesperHashtableP, BooleanType, AnyType)
+	vm.DefineFunctionOptionalArgs("hashtable-get", vesperHashtableGet, AnyType, []*Object{HashtableType, AnyType, AnyType}, Null)
+	vm.DefineFunction("hashtable-has?", vesperHashtableHasP, BooleanType, HashtableType, AnyType)
+	vm.defineMethod("hashtable-put!", method((*VM).vesperHashtablePut), NullType, []*Object{HashtableType, AnyType, AnyType}, nil, nil, nil)
+	vm.DefineFunction("hashtable-remove!", vesperHashtableRemove, BooleanType, HashtableType, AnyType)
+	vm.DefineFunction("hashtable-count", vesperHashtableCount, NumberType, HashtableType)
+	vm.DefineFunction("hashtable-keys", vesperHashtableKeys, ListType, HashtableType)
+	vm.DefineFunction("hashtable-values", vesperHashtableValues, ListType, HashtableType)
+}
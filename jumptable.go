@@ -0,0 +1,114 @@
+package vesper
+
+import (
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// the type of the constants that hold the jump tables of case forms
+var jumpTableType = defaultVM.Intern("<jump-table>")
+
+// A jumpTable maps the keys of a case form to the offsets of their clauses from the
+// jumptable instruction. Keys that are equal? share an entry, so an integer and a float
+// are different keys, even if they have the same value.
+type jumpTable struct {
+	keys      []*Object // in the order they were added, for writing the table
+	offsets   map[jumpKey]int
+	otherwise int // the offset of the else clause
+}
+
+type jumpKey struct {
+	typ   *Object
+	text  string
+	num   float64
+	exact bool
+	ival  int64
+}
+
+func newJumpTable() *jumpTable {
+	return &jumpTable{offsets: make(map[jumpKey]int)}
+}
+
+// jumpKeyOf returns the key for the object, if it is of a type that can be a case key
+func jumpKeyOf(obj *Object) (jumpKey, bool) {
+	switch obj.Type {
+	case SymbolType, KeywordType, TypeType, StringType:
+		return jumpKey{typ: obj.Type, text: obj.text}, true
+	case BooleanType, NullType:
+		return jumpKey{typ: obj.Type, text: obj.String()}, true
+	case CharacterType:
+		return jumpKey{typ: obj.Type, num: obj.fval}, true
+	case NumberType:
+		switch obj.Value.(type) {
+		case *big.Int, *big.Rat:
+			return jumpKey{}, false
+		case fixnum:
+			return jumpKey{typ: obj.Type, exact: true, ival: obj.ival}, true
+		}
+		return jumpKey{typ: obj.Type, num: obj.fval}, true
+	}
+	return jumpKey{}, false
+}
+
+// add adds the key to the table, returning false if it is not a valid key or is already present
+func (t *jumpTable) add(key *Object, offset int) bool {
+	k, ok := jumpKeyOf(key)
+	if !ok {
+		return false
+	}
+	if _, present := t.offsets[k]; present {
+		return false
+	}
+	t.keys = append(t.keys, key)
+	t.offsets[k] = offset
+	return true
+}
+
+// offset returns the offset of the clause for the value
+func (t *jumpTable) offset(val *Object) int {
+	if k, ok := jumpKeyOf(val); ok {
+		if offset, ok := t.offsets[k]; ok {
+			return offset
+		}
+	}
+	return t.otherwise
+}
+
+// WriteVesper writes the table as an array of alternating keys and offsets, followed by the
+// offset of the else clause, which is how it is given to the jumptable instruction in code
+func (t *jumpTable) WriteVesper() string {
+	var buf strings.Builder
+	buf.WriteString("[")
+	for _, key := range t.keys {
+		k, _ := jumpKeyOf(key)
+		buf.WriteString(Write(key))
+		buf.WriteString(" ")
+		buf.WriteString(strconv.Itoa(t.offsets[k]))
+		buf.WriteString(" ")
+	}
+	buf.WriteString(strconv.Itoa(t.otherwise))
+	buf.WriteString("]")
+	return buf.String()
+}
+
+// jumpTableFromArray makes the constant for a jumptable instruction from its written form
+func jumpTableFromArray(obj *Object) (*Object, error) {
+	if !IsArray(obj) || len(obj.elements)%2 != 1 {
+		return nil, Error(SyntaxErrorKey, "Bad jump table: ", obj)
+	}
+	t := newJumpTable()
+	el := obj.elements
+	for i := 0; i < len(el)-1; i += 2 {
+		offset, err := AsIntValue(el[i+1])
+		if err != nil || !t.add(el[i], offset) {
+			return nil, Error(SyntaxErrorKey, "Bad jump table: ", obj)
+		}
+	}
+	otherwise, err := AsIntValue(el[len(el)-1])
+	if err != nil {
+		return nil, Error(SyntaxErrorKey, "Bad jump table: ", obj)
+	}
+	t.otherwise = otherwise
+	return NewObject(jumpTableType, t), nil
+}
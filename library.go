@@ -0,0 +1,203 @@
+package vesper
+
+import (
+	"context"
+	"math"
+	"sort"
+	"strings"
+)
+
+// The collection functions of the standard library that are written in Go, either for speed or
+// because they call back into Vesper. The rest of the library, such as map, filter and reduce,
+// is defined in lib/vesper.vsp in terms of these.
+
+// Compare returns -1, 0 or 1 as o1 is less than, equal to, or greater than o2. Numbers are
+// compared numerically, and strings, symbols, keywords and characters by their text. Other
+// types, and values of different types, are not ordered.
+func Compare(o1 *Object, o2 *Object) (int, error) {
+	if o1.Type == o2.Type {
+		switch o1.Type {
+		case NumberType:
+			return numberCompare(o1, o2), nil
+		case StringType, SymbolType, KeywordType:
+			return strings.Compare(o1.text, o2.text), nil
+		case CharacterType:
+			if o1.fval < o2.fval {
+				return -1, nil
+			} else if o1.fval > o2.fval {
+				return 1, nil
+			}
+			return 0, nil
+		}
+	}
+	return 0, Error(ArgumentErrorKey, "Cannot compare ", o1.Type, " and ", o2.Type)
+}
+
+// sequenceValues returns the elements of a sequence, and a function to make a collection from
+// elements, which is of the same type for arrays and vectors, and otherwise a list
+func sequenceValues(obj *Object) ([]*Object, func([]*Object) *Object, error) {
+	switch obj.Type {
+	case ArrayType:
+		return obj.elements, ArrayFromElementsNoCopy, nil
+	case VectorType:
+		return vectorValue(obj).elements(), func(el []*Object) *Object { return Vector(el...) }, nil
+	}
+	lst, err := Seq(obj)
+	if err != nil {
+		return nil, nil, err
+	}
+	return listToArray(lst).elements, ListFromValues, nil
+}
+
+// sortValues sorts the elements stably, in their natural order if less is null, and otherwise
+// calling less, which must return true if its first argument sorts before its second
+func (vm *VM) sortValues(ctx context.Context, el []*Object, less *Object) error {
+	var err error
+	var call func(args ...*Object) (*Object, error)
+	if less != Null {
+		call = vm.callback(ctx, less)
+	}
+	sort.SliceStable(el, func(i, j int) bool {
+		if err != nil {
+			return false
+		}
+		if call == nil {
+			var c int
+			c, err = Compare(el[i], el[j])
+			return c < 0
+		}
+		var result *Object
+		result, err = call(el[i], el[j])
+		return err == nil && result != False
+	})
+	return err
+}
+
+func (vm *VM) vesperSort(ctx context.Context, argv []*Object) (*Object, error) {
+	el, build, err := sequenceValues(argv[0])
+	if err != nil {
+		return nil, err
+	}
+	if argv[0].Type == ArrayType {
+		// sort a copy, leaving the array unchanged
+		el = append([]*Object(nil), el...)
+	}
+	if err := vm.sortValues(ctx, el, argv[1]); err != nil {
+		return nil, err
+	}
+	return build(el), nil
+}
+
+func vesperCompare(argv []*Object) (*Object, error) {
+	c, err := Compare(argv[0], argv[1])
+	if err != nil {
+		return nil, err
+	}
+	return Int(int64(c)), nil
+}
+
+// vesperRange returns the list of numbers from start up to, but not including, end, by step.
+// With one argument it counts from 0, and the default step is 1.
+func (vm *VM) vesperRange(argv []*Object) (*Object, error) {
+	start, end, step := Zero, argv[0], One
+	switch len(argv) {
+	case 1:
+	case 2, 3:
+		start, end = argv[0], argv[1]
+		if len(argv) == 3 {
+			step = argv[2]
+		}
+	default:
+		return nil, argcError("range", 1, 3, len(argv))
+	}
+	if numberIsZero(step) {
+		return nil, Error(ArgumentErrorKey, "range step cannot be zero")
+	}
+	count := math.Ceil((end.fval - start.fval) / step.fval)
+	if !(count > 0) {
+		return EmptyList, nil
+	}
+	if count > math.MaxInt32 {
+		return nil, Error(ArgumentErrorKey, "range too large: ", count)
+	}
+	if err := vm.checkCollectionSize(int(count)); err != nil {
+		return nil, err
+	}
+	el := make([]*Object, 0, int(count))
+	increasing := numberCompare(step, Zero) > 0
+	for n := start; len(el) < int(count); n = numberAdd(n, step) {
+		c := numberCompare(n, end)
+		if (increasing && c >= 0) || (!increasing && c <= 0) {
+			break
+		}
+		el = append(el, n)
+	}
+	return ListFromValues(el), nil
+}
+
+// sliceSequence returns the part of a sequence from start to end, which are clamped to its
+// length. Strings, blobs, arrays and vectors give the same type, and other sequences a list.
+func sliceSequence(coll *Object, start int, end int) (*Object, error) {
+	clamp := func(i int, n int) int {
+		if i < 0 {
+			return 0
+		} else if i > n {
+			return n
+		}
+		return i
+	}
+	switch coll.Type {
+	case StringType:
+		runes := []rune(coll.text)
+		end = clamp(end, len(runes))
+		return String(string(runes[clamp(start, end):end])), nil
+	case BlobType:
+		b := BlobValue(coll)
+		end = clamp(end, len(b))
+		return Blob(append([]byte(nil), b[clamp(start, end):end]...)), nil
+	case ArrayType, VectorType:
+		el, build, _ := sequenceValues(coll)
+		end = clamp(end, len(el))
+		return build(append([]*Object(nil), el[clamp(start, end):end]...)), nil
+	}
+	lst, err := Seq(coll)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < start && lst != EmptyList; i++ {
+		lst = lst.cdr
+	}
+	if end >= start+ListLength(lst) {
+		return lst, nil
+	}
+	el := make([]*Object, 0, end-start)
+	for i := start; i < end; i++ {
+		el = append(el, lst.car)
+		lst = lst.cdr
+	}
+	return ListFromValues(el), nil
+}
+
+func vesperTake(argv []*Object) (*Object, error) {
+	n := int(argv[0].fval)
+	if n < 0 {
+		n = 0
+	}
+	return sliceSequence(argv[1], 0, n)
+}
+
+func vesperDrop(argv []*Object) (*Object, error) {
+	n := int(argv[0].fval)
+	if n < 0 {
+		n = 0
+	}
+	return sliceSequence(argv[1], n, math.MaxInt32)
+}
+
+func initLibraryFunctions(vm *VM) {
+	vm.defineMethod("sort", (*VM).vesperSort, AnyType, []*Object{AnyType, AnyType}, nil, []*Object{Null}, nil)
+	vm.DefineFunction("compare", vesperCompare, NumberType, AnyType, AnyType)
+	vm.defineMethod("range", method((*VM).vesperRange), ListType, []*Object{NumberType}, NumberType, []*Object{}, nil)
+	vm.DefineFunction("take", vesperTake, AnyType, NumberType, AnyType)
+	vm.DefineFunction("drop", vesperDrop, AnyType, NumberType, AnyType)
+}
@@ -0,0 +1,195 @@
+package vesper
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// Limits restricts the resources that code run by a VM may use, so that untrusted code can be
+// run safely. A zero field means that there is no limit. Exceeding a limit raises a limit-error:,
+// which is not caught by catch clauses that do not name it explicitly.
+type Limits struct {
+	// MaxInstructions limits the number of instructions executed by the VM, in all goroutines,
+	// since the limits were set. It is checked every 1024 instructions, and when an evaluation
+	// starts.
+	MaxInstructions int64
+	// Timeout limits the wall clock time of each call to Execute or Eval, and of each task started
+	// with go. The evaluation or task is stopped with an interrupt: error, as for a cancelled
+	// context.
+	Timeout time.Duration
+	// MaxStackDepth limits the depth of nested function calls. Unlike the VM's MaxFrameDepth,
+	// exceeding it raises a limit-error: rather than a catchable stack-overflow:.
+	MaxStackDepth int
+	// MaxCollectionSize limits the number of elements in an array, struct, list, string or blob
+	// created by a primitive function. Only the part of a list created by the primitive is
+	// counted, not the list that it was built onto.
+	MaxCollectionSize int
+}
+
+// SetLimits sets the limits for code run by the VM, and resets the count of instructions executed.
+// The limits should be set before the VM runs any code.
+func (vm *VM) SetLimits(limits Limits) {
+	vm.limits = limits
+	atomic.StoreInt64(&vm.executed, 0)
+}
+
+// GetLimits returns the limits set for the VM
+func (vm *VM) GetLimits() Limits {
+	return vm.limits
+}
+
+// limitContext returns the context for an evaluation, with the deadline of the VM's timeout, if any
+func (vm *VM) limitContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if vm.limits.Timeout > 0 {
+		return context.WithTimeout(ctx, vm.limits.Timeout)
+	}
+	return ctx, func() {}
+}
+
+// checkLimits is called by the dispatch loop every cancelCheckInterval instructions
+func (vm *VM) checkLimits(ctx context.Context) error {
+	if max := vm.limits.MaxInstructions; max > 0 {
+		if atomic.AddInt64(&vm.executed, cancelCheckInterval) > max {
+			return Error(LimitErrorKey, "instruction limit exceeded: ", max)
+		}
+	}
+	select {
+	case <-ctx.Done():
+		return interruptError(ctx)
+	default:
+		return nil
+	}
+}
+
+// countInstructions adds the instructions that an evaluation executed since the limits were
+// last checked to the count, when it returns
+func (vm *VM) countInstructions(state *evalState) {
+	if vm.limits.MaxInstructions > 0 && state.ticks > 0 {
+		atomic.AddInt64(&vm.executed, int64(state.ticks))
+	}
+	state.ticks = 0
+}
+
+// checkInstructionCount returns an error if the instruction limit has been exceeded, so that
+// evaluations too short to reach a check of the limits cannot run once it has been
+func (vm *VM) checkInstructionCount() error {
+	if max := vm.limits.MaxInstructions; max > 0 && atomic.LoadInt64(&vm.executed) > max {
+		return Error(LimitErrorKey, "instruction limit exceeded: ", max)
+	}
+	return nil
+}
+
+// interruptError is the error raised when the context of an evaluation is done
+func interruptError(ctx context.Context) error {
+	return Error(InterruptKey, ctx.Err().Error())
+}
+
+// checkStackDepth returns an error if the frame is nested too deeply, either for the VM's
+// limits or for its MaxFrameDepth
+func (vm *VM) checkStackDepth(f *frame) error {
+	if max := vm.limits.MaxStackDepth; max > 0 && f.depth > max {
+		return Error(LimitErrorKey, "stack depth limit exceeded: ", max)
+	}
+	if max := vm.MaxFrameDepth; max > 0 && f.depth > max {
+		return Error(StackOverflowKey, "maximum frame depth exceeded: ", max)
+	}
+	return nil
+}
+
+// checkCollectionSize returns an error if a collection of n elements would exceed the limit
+func (vm *VM) checkCollectionSize(n int) error {
+	if max := vm.limits.MaxCollectionSize; max > 0 && n > max {
+		return Error(LimitErrorKey, "collection size limit exceeded: ", max)
+	}
+	return nil
+}
+
+// checkResultSize checks the size of the collection returned by a primitive
+func (vm *VM) checkResultSize(result *Object, argv []*Object) error {
+	max := vm.limits.MaxCollectionSize
+	n := 0
+	switch result.Type {
+	case ArrayType:
+		n = len(result.elements)
+	case StructType:
+		n = len(result.bindings)
+	case StringType:
+		n = len(result.text)
+	case BlobType:
+		n = len(BlobValue(result))
+	case HashtableType:
+		n = hashtableValue(result).count
+	case VectorType:
+		n = vectorValue(result).count
+	case HashMapType:
+		n = hashMapValue(result).count
+	case ListType:
+		// count the cells up to the first one that was passed in, which has already been checked
+		for lst := result; lst != EmptyList && n <= max && !isArgument(lst, argv); lst = lst.cdr {
+			n++
+		}
+	}
+	return vm.checkCollectionSize(n)
+}
+
+func isArgument(obj *Object, argv []*Object) bool {
+	for _, arg := range argv {
+		if arg == obj {
+			return true
+		}
+	}
+	return false
+}
+
+// Capabilities are the kinds of access to the host system that Vesper code may have
+type Capabilities int
+
+const (
+	// FileCapability allows reading and writing files, and loading code with load, use and import.
+	// Modules that have already been loaded by Go code can still be imported without it.
+	FileCapability Capabilities = 1 << iota
+	// EnvironmentCapability allows reading environment variables
+	EnvironmentCapability
+	// GoroutineCapability allows starting goroutines with go
+	GoroutineCapability
+	// AllCapabilities is every capability, which a new VM has
+	AllCapabilities = FileCapability | EnvironmentCapability | GoroutineCapability
+)
+
+// the globals that are removed when a capability is taken away from a VM
+var capabilityGlobals = []struct {
+	capability Capabilities
+	name       string
+}{
+	{FileCapability, "slurp"},
+	{FileCapability, "spit"},
+	{FileCapability, "load"},
+	{EnvironmentCapability, "getenv"},
+	{GoroutineCapability, "go"},
+}
+
+// Restrict takes the capabilities away from the VM, removing the primitives that need them, so
+// that code run by the VM cannot use them, nor compiled modules refer to them. Go code can still
+// load files into the VM. The restriction cannot be undone, and applies to clones of the VM too.
+func (vm *VM) Restrict(caps Capabilities) {
+	vm.denied |= caps
+	for _, g := range capabilityGlobals {
+		if caps&g.capability != 0 {
+			vm.undefGlobal(vm.Intern(g.name))
+			vm.primitives.Delete(g.name)
+		}
+	}
+}
+
+// HasCapability returns true if the VM has not been restricted from using the capability
+func (vm *VM) HasCapability(c Capabilities) bool {
+	return vm.denied&c == 0
+}
+
+func (vm *VM) requireCapability(c Capabilities, what string) error {
+	if !vm.HasCapability(c) {
+		return Error(PermissionErrorKey, what, " is not permitted")
+	}
+	return nil
+}
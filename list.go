@@ -200,6 +200,17 @@ func ToList(obj *Object) (*Object, error) {
 		return structToList(obj)
 	case StringType:
 		return stringToList(obj), nil
+	case HashtableType:
+		return hashtableToList(obj), nil
+	case VectorType:
+		return ListFromValues(vectorValue(obj).elements()), nil
+	case HashMapType:
+		return hashMapToList(obj), nil
+	case BlobType:
+		return blobToList(obj), nil
+	}
+	if s, ok := sequenceValue(obj); ok {
+		return s.Seq(), nil
 	}
 	return nil, Error(ArgumentErrorKey, "to-list cannot accept ", obj.Type)
 }
@@ -1,6 +1,7 @@
 package vesper
 
 import (
+	"context"
 	"fmt"
 )
 
@@ -34,6 +35,21 @@ func (vm *VM) macroexpandObject(expr *Object) (*Object, error) {
 }
 
 func (vm *VM) macroexpandList(expr *Object) (*Object, error) {
+	expanded, err := vm.expandList(expr)
+	if err != nil {
+		if expr.pos != nil {
+			err = withTrace(err, []StackFrame{{Pos: expr.pos}})
+		}
+		return nil, err
+	}
+	if expanded.pos == nil && IsList(expanded) && expanded != EmptyList {
+		// keep the source position of the original form
+		expanded.pos = expr.pos
+	}
+	return expanded, nil
+}
+
+func (vm *VM) expandList(expr *Object) (*Object, error) {
 	if expr == EmptyList {
 		return expr, nil
 	}
@@ -79,7 +95,7 @@ func (vm *VM) expand(mac *Macro, expr *Object) (*Object, error) {
 			}
 		} else if expander.primitive != nil {
 			args := []*Object{expr}
-			expanded, err := expander.primitive.fun(args)
+			expanded, err := expander.primitive.call(vm, context.Background(), args)
 			if err == nil {
 				return vm.macroexpandObject(expanded)
 			}
@@ -268,6 +284,166 @@ func (vm *VM) expandSetBang(expr *Object) (*Object, error) {
 	return List(Car(expr), Cadr(expr), val), nil
 }
 
+func (vm *VM) expandTry(expr *Object) (*Object, error) {
+	result := []*Object{Car(expr)}
+	for tmp := Cdr(expr); tmp != EmptyList; tmp = Cdr(tmp) {
+		item := Car(tmp)
+		if IsList(item) && item != EmptyList {
+			var err error
+			switch Car(item) {
+			case vm.Intern("catch"):
+				keys, sym, body, ok := crackCatch(item)
+				if !ok {
+					return nil, Error(SyntaxErrorKey, item)
+				}
+				body, err = vm.expandSequence(body)
+				if err == nil {
+					item = Cons(Car(item), Cons(keys, Cons(sym, body)))
+				}
+			case vm.Intern("finally"):
+				var body *Object
+				body, err = vm.expandSequence(Cdr(item))
+				if err == nil {
+					item = Cons(Car(item), body)
+				}
+			default:
+				item, err = vm.macroexpandList(item)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		result = append(result, item)
+	}
+	return ListFromValues(result), nil
+}
+
+// expandCase expands the key expression and the bodies of the clauses of a case form, but
+// not the keys, which are literals
+func (vm *VM) expandCase(expr *Object) (*Object, error) {
+	if ListLength(expr) < 2 {
+		return nil, Error(SyntaxErrorKey, expr)
+	}
+	key, err := vm.macroexpandObject(Cadr(expr))
+	if err != nil {
+		return nil, err
+	}
+	result := []*Object{Car(expr), key}
+	for tmp := Cddr(expr); tmp != EmptyList; tmp = Cdr(tmp) {
+		clause := Car(tmp)
+		if !IsList(clause) || clause == EmptyList {
+			return nil, Error(SyntaxErrorKey, "Bad case clause: ", clause)
+		}
+		body, err := vm.expandSequence(Cdr(clause))
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, Cons(Car(clause), body))
+	}
+	return ListFromValues(result), nil
+}
+
+// expandLoop expands the initial values and the body of a loop form. Anything that does not look
+// like a loop form is expanded as a call, as it may call a local function called loop.
+func (vm *VM) expandLoop(expr *Object) (*Object, error) {
+	if ListLength(expr) < 3 {
+		return vm.expandSequence(expr)
+	}
+	bindings := Cadr(expr)
+	if IsArray(bindings) {
+		bindings, _ = ToList(bindings)
+	}
+	if !IsList(bindings) {
+		return vm.expandSequence(expr)
+	}
+	names, values, ok := vm.crackLetBindings(bindings)
+	if !ok {
+		return vm.expandSequence(expr)
+	}
+	var expanded []*Object
+	for ; names != EmptyList; names, values = Cdr(names), Cdr(values) {
+		expanded = append(expanded, List(Car(names), Car(values)))
+	}
+	body, err := vm.expandSequence(Cddr(expr))
+	if err != nil {
+		return nil, err
+	}
+	return Cons(Car(expr), Cons(ListFromValues(expanded), body)), nil
+}
+
+// (while <test> <expr> ...)
+//  ->
+// (loop () (if <test> (do <expr> ... (recur)) null))
+func (vm *VM) expandWhile(expr *Object) (*Object, error) {
+	if ListLength(expr) < 2 {
+		return nil, Error(SyntaxErrorKey, expr)
+	}
+	body, err := Concat(Cddr(expr), List(List(vm.Intern("recur"))))
+	if err != nil {
+		return nil, err
+	}
+	loop := List(vm.Intern("loop"), EmptyList, List(vm.Intern("if"), Cadr(expr), Cons(vm.Intern("do"), body), Null))
+	return vm.macroexpandList(loop)
+}
+
+// crackIterationSpec returns the variable and the expression of a dotimes or doseq form, which
+// can be written as (<sym> <expr>) or [<sym> <expr>]
+func crackIterationSpec(expr *Object) (*Object, *Object, bool) {
+	if ListLength(expr) < 2 {
+		return nil, nil, false
+	}
+	spec := Cadr(expr)
+	if IsArray(spec) {
+		spec, _ = ToList(spec)
+	}
+	if !IsList(spec) || ListLength(spec) != 2 || !IsSymbol(Car(spec)) {
+		return nil, nil, false
+	}
+	return Car(spec), Cadr(spec), true
+}
+
+// (dotimes (<sym> <count>) <expr> ...)
+//  ->
+// (loop ((n <count>) (<sym> 0)) (if (< <sym> n) (do <expr> ... (recur n (+ <sym> 1))) null))
+// The expansion refers to the primitives themselves rather than their names, so that local
+// bindings of the names in the body's scope do not change the loop.
+func (vm *VM) expandDotimes(expr *Object) (*Object, error) {
+	sym, count, ok := crackIterationSpec(expr)
+	if !ok {
+		return nil, Error(SyntaxErrorKey, expr)
+	}
+	n := Gensym("count__")
+	next := List(vm.Intern("recur"), n, List(vm.builtinRef("+"), sym, One))
+	body, err := Concat(Cddr(expr), List(next))
+	if err != nil {
+		return nil, err
+	}
+	loop := List(vm.Intern("loop"), List(List(n, count), List(sym, Zero)),
+		List(vm.Intern("if"), List(vm.builtinRef("<"), sym, n), Cons(vm.Intern("do"), body), Null))
+	return vm.macroexpandList(loop)
+}
+
+// (doseq (<sym> <coll>) <expr> ...)
+//  ->
+// (loop ((s (seq <coll>)) (<sym> null)) (if (empty? s) null (do (set! <sym> (car s)) <expr> ... (recur (cdr s) null))))
+// As for dotimes, the primitives are referred to directly.
+func (vm *VM) expandDoseq(expr *Object) (*Object, error) {
+	sym, coll, ok := crackIterationSpec(expr)
+	if !ok {
+		return nil, Error(SyntaxErrorKey, expr)
+	}
+	seq := Gensym("seq__")
+	next := List(vm.Intern("recur"), List(vm.builtinRef("cdr"), seq), Null)
+	body, err := Concat(Cddr(expr), List(next))
+	if err != nil {
+		return nil, err
+	}
+	body = Cons(List(vm.Intern("set!"), sym, List(vm.builtinRef("car"), seq)), body)
+	loop := List(vm.Intern("loop"), List(List(seq, List(vm.builtinRef("seq"), coll)), List(sym, Null)),
+		List(vm.Intern("if"), List(vm.builtinRef("empty?"), seq), Null, Cons(vm.Intern("do"), body)))
+	return vm.macroexpandList(loop)
+}
+
 func (vm *VM) expandPrimitive(fn *Object, expr *Object) (*Object, error) {
 	switch fn {
 	case vm.Intern("quote"):
@@ -276,6 +452,20 @@ func (vm *VM) expandPrimitive(fn *Object, expr *Object) (*Object, error) {
 		return vm.expandSequence(expr)
 	case vm.Intern("if"):
 		return vm.expandIf(expr)
+	case vm.Intern("and"), vm.Intern("or"), vm.Intern("when"), vm.Intern("unless"):
+		return vm.expandSequence(expr)
+	case vm.Intern("case"):
+		return vm.expandCase(expr)
+	case vm.Intern("loop"):
+		return vm.expandLoop(expr)
+	case vm.Intern("recur"):
+		return vm.expandSequence(expr)
+	case vm.Intern("while"):
+		return vm.expandWhile(expr)
+	case vm.Intern("dotimes"):
+		return vm.expandDotimes(expr)
+	case vm.Intern("doseq"):
+		return vm.expandDoseq(expr)
 	case vm.Intern("def"):
 		return vm.expandDef(expr)
 	case vm.Intern("undef"):
@@ -284,6 +474,8 @@ func (vm *VM) expandPrimitive(fn *Object, expr *Object) (*Object, error) {
 		return vm.expandDefn(expr)
 	case vm.Intern("defmacro"):
 		return vm.expandDefmacro(expr)
+	case vm.Intern("define-syntax"):
+		return vm.expandDefineSyntax(expr)
 	case vm.Intern("fn"):
 		return vm.expandFn(expr)
 	case vm.Intern("set!"):
@@ -292,8 +484,12 @@ func (vm *VM) expandPrimitive(fn *Object, expr *Object) (*Object, error) {
 		return expr, nil
 	case vm.Intern("use"):
 		return expr, nil
+	case vm.Intern("module"), vm.Intern("export"), vm.Intern("import"):
+		return expr, nil
+	case vm.Intern("try"):
+		return vm.expandTry(expr)
 	default:
-		macro := vm.GetMacro(fn)
+		macro := vm.resolveMacro(fn)
 		if macro != nil {
 			tmp, err := vm.expand(macro, expr)
 			return tmp, err
@@ -443,7 +639,7 @@ func (vm *VM) expandNamedLet(expr *Object) (*Object, error) {
 func (vm *VM) nextCondClause(expr *Object, clauses *Object, count int) (*Object, error) {
 	var result *Object
 	var err error
-	tmpsym := vm.Intern("__tmp__")
+	tmpsym := Gensym("tmp__")
 	ifsym := vm.Intern("if")
 	elsesym := vm.Intern("else")
 	letsym := vm.Intern("let")
@@ -523,10 +719,12 @@ func (vm *VM) expandQuasiquote(expr *Object) (*Object, error) {
 	if ListLength(expr) != 2 {
 		return nil, Error(SyntaxErrorKey, expr)
 	}
-	return vm.expandQQ(Cadr(expr))
+	return vm.expandQQ(Cadr(expr), make(map[*Object]*Object))
 }
 
-func (vm *VM) expandQQ(expr *Object) (*Object, error) {
+// expandQQ expands a quasiquote template. Symbols ending in # are replaced by fresh symbols,
+// the same one for each occurrence within the template.
+func (vm *VM) expandQQ(expr *Object, gensyms map[*Object]*Object) (*Object, error) {
 	switch expr.Type {
 	case ListType:
 		if expr == EmptyList {
@@ -542,19 +740,19 @@ func (vm *VM) expandQQ(expr *Object) (*Object, error) {
 				return nil, Error(MacroErrorKey, "unquote-splicing can only occur in the context of a list ")
 			}
 		}
-		tmp, err := vm.expandQQList(expr)
+		tmp, err := vm.expandQQList(expr, gensyms)
 		if err != nil {
 			return nil, err
 		}
 		return vm.macroexpandObject(tmp)
 	case SymbolType:
-		return List(vm.Intern("quote"), expr), nil
+		return List(vm.Intern("quote"), autoGensym(expr, gensyms)), nil
 	default: // all other objects evaluate to themselves
 		return expr, nil
 	}
 }
 
-func (vm *VM) expandQQList(lst *Object) (*Object, error) {
+func (vm *VM) expandQQList(lst *Object, gensyms map[*Object]*Object) (*Object, error) {
 	var tmp *Object
 	var err error
 	result := List(vm.Intern("concat"))
@@ -581,7 +779,7 @@ func (vm *VM) expandQQList(lst *Object) (*Object, error) {
 				tail.cdr = List(tmp)
 				tail = tail.cdr
 			} else {
-				tmp, err = vm.expandQQList(item)
+				tmp, err = vm.expandQQList(item, gensyms)
 				if err != nil {
 					return nil, err
 				}
@@ -589,6 +787,9 @@ func (vm *VM) expandQQList(lst *Object) (*Object, error) {
 				tail = tail.cdr
 			}
 		} else {
+			if IsSymbol(item) {
+				item = autoGensym(item, gensyms)
+			}
 			tail.cdr = List(List(vm.Intern("quote"), List(item)))
 			tail = tail.cdr
 		}
@@ -0,0 +1,355 @@
+package vesper
+
+import (
+	"strings"
+	"sync"
+)
+
+// A module is a namespace for top level definitions. A file that starts with
+// (module name) has its definitions stored in globals qualified by the module
+// name, i.e. (def parse ...) in module json defines json/parse. Files without
+// a module form define into the unqualified global namespace, as before.
+//
+// Names are resolved when code is compiled, so compiled modules carry their
+// qualified names with them. The names defined at the top level of a module's
+// file are declared before it is compiled, so a module may use a name before
+// defining it, even if that name is also defined as an unqualified global.
+// Definitions shadow imported names, for the code after them.
+type module struct {
+	mutex   sync.RWMutex // guards the fields below, which change as the module is loaded
+	name    string
+	names   map[*Object]bool    // names defined by the module
+	exports map[*Object]bool    // the exported names, or nil if all names are exported
+	aliases map[string]*module  // prefixes that may be used to qualify symbols
+	imports map[*Object]*Object // unqualified names imported from other modules
+}
+
+func newModule(name string) *module {
+	return &module{
+		name:    name,
+		names:   make(map[*Object]bool),
+		aliases: make(map[string]*module),
+		imports: make(map[*Object]*Object),
+	}
+}
+
+func (m *module) copy() *module {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	c := newModule(m.name)
+	for k, v := range m.names {
+		c.names[k] = v
+	}
+	if m.exports != nil {
+		c.exports = make(map[*Object]bool, len(m.exports))
+		for k, v := range m.exports {
+			c.exports[k] = v
+		}
+	}
+	for k, v := range m.aliases {
+		c.aliases[k] = v
+	}
+	for k, v := range m.imports {
+		c.imports[k] = v
+	}
+	return c
+}
+
+func copyModules(src map[string]*module) map[string]*module {
+	m := make(map[string]*module, len(src))
+	for k, v := range src {
+		m[k] = v
+	}
+	return m
+}
+
+// qualify returns the global name of a symbol defined in the module
+func (m *module) qualify(vm *VM, sym *Object) *Object {
+	name := m.moduleName()
+	if name == "" {
+		return sym
+	}
+	return vm.Intern(name + "/" + sym.text)
+}
+
+func (m *module) moduleName() string {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.name
+}
+
+func (m *module) exported(sym *Object) bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.exports == nil || m.exports[sym]
+}
+
+func (m *module) defines(sym *Object) bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.names[sym]
+}
+
+func (m *module) imported(sym *Object) (*Object, bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	q, ok := m.imports[sym]
+	return q, ok
+}
+
+func (m *module) alias(prefix string) (*module, bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	target, ok := m.aliases[prefix]
+	return target, ok
+}
+
+// splitQualified splits a qualified symbol name such as json/parse into its prefix and name
+func splitQualified(s string) (string, string, bool) {
+	i := strings.Index(s, "/")
+	if i <= 0 || i == len(s)-1 {
+		return "", "", false
+	}
+	return s[:i], s[i+1:], true
+}
+
+// resolveGlobal returns the global that a reference to sym refers to, in the current module
+func (vm *VM) resolveGlobal(sym *Object) (*Object, error) {
+	m := vm.currentModule()
+	if q, ok := m.imported(sym); ok {
+		return q, nil
+	}
+	if m.defines(sym) {
+		return m.qualify(vm, sym), nil
+	}
+	if prefix, name, ok := splitQualified(sym.text); ok {
+		if target, ok := m.alias(prefix); ok {
+			s := vm.Intern(name)
+			if !target.exported(s) {
+				return nil, Error(SyntaxErrorKey, "Not exported from module ", prefix, ": ", s)
+			}
+			return target.qualify(vm, s), nil
+		}
+		return sym, nil
+	}
+	if m.moduleName() != "" && !vm.IsDefined(sym) && vm.GetMacro(sym) == nil {
+		// not yet defined, so assume it is a forward reference within the module
+		return m.qualify(vm, sym), nil
+	}
+	return sym, nil
+}
+
+// resolveDefinition returns the global that a top level definition of sym defines, in the current module.
+// The definition shadows any import of the same name, for the code that follows it.
+func (vm *VM) resolveDefinition(sym *Object) (*Object, error) {
+	if _, _, ok := splitQualified(sym.text); ok {
+		return vm.resolveGlobal(sym)
+	}
+	m := vm.currentModule()
+	m.mutex.Lock()
+	delete(m.imports, sym)
+	if m.name != "" {
+		m.names[sym] = true
+	}
+	m.mutex.Unlock()
+	return m.qualify(vm, sym), nil
+}
+
+// declareNames adds the names defined by the top level forms of a file to the current module,
+// before they are compiled, so that references to definitions later in the file resolve to the
+// module even if a global of the same name exists
+func (vm *VM) declareNames(forms *Object) {
+	m := vm.currentModule()
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for ; forms != EmptyList; forms = Cdr(forms) {
+		form := Car(forms)
+		if !IsList(form) || form == EmptyList || Cdr(form) == EmptyList {
+			continue
+		}
+		switch Car(form) {
+		case vm.Intern("def"), vm.Intern("defn"), vm.Intern("defmacro"):
+			if sym := Cadr(form); IsSymbol(sym) {
+				if _, _, ok := splitQualified(sym.text); !ok {
+					m.names[sym] = true
+				}
+			}
+		}
+	}
+}
+
+// resolveMacro returns the macro for the symbol in the current module, or nil if not defined
+func (vm *VM) resolveMacro(sym *Object) *Macro {
+	if !IsSymbol(sym) {
+		return nil
+	}
+	resolved, err := vm.resolveGlobal(sym)
+	if err != nil {
+		return nil
+	}
+	return vm.GetMacro(resolved)
+}
+
+// currentModule returns the module that code is compiled in
+func (vm *VM) currentModule() *module {
+	return vm.module.Load().(*module)
+}
+
+// enterModule makes the named module current, for the rest of the file being loaded
+func (vm *VM) enterModule(name *Object) {
+	vm.modulesMutex.Lock()
+	defer vm.modulesMutex.Unlock()
+	current := vm.currentModule()
+	if m, ok := vm.modules[name.text]; ok && m != current {
+		// keep the names declared for the rest of the file
+		current.mutex.RLock()
+		m.mutex.Lock()
+		for k := range current.names {
+			m.names[k] = true
+		}
+		m.mutex.Unlock()
+		current.mutex.RUnlock()
+		vm.module.Store(m)
+		return
+	}
+	current.mutex.Lock()
+	current.name = name.text
+	current.mutex.Unlock()
+	vm.modules[name.text] = current
+}
+
+// exportNames adds the names to the exports of the current module
+func (vm *VM) exportNames(names *Object) {
+	m := vm.currentModule()
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.exports == nil {
+		m.exports = make(map[*Object]bool)
+	}
+	for ; names != EmptyList; names = Cdr(names) {
+		m.exports[Car(names)] = true
+	}
+}
+
+// withModule runs the function with m as the current module, restoring the current module afterwards
+func (vm *VM) withModule(m *module, fun func() error) error {
+	saved := vm.currentModule()
+	vm.module.Store(m)
+	defer vm.module.Store(saved)
+	return fun()
+}
+
+// LoadModule loads the named module if it has not already been loaded by this VM
+func (vm *VM) LoadModule(name string) error {
+	_, err := vm.loadModule(name)
+	return err
+}
+
+func (vm *VM) loadModule(name string) (*module, error) {
+	vm.modulesMutex.Lock()
+	if m, ok := vm.modules[name]; ok {
+		vm.modulesMutex.Unlock()
+		return m, nil
+	}
+	file, err := vm.FindModuleFile(name)
+	if err != nil {
+		vm.modulesMutex.Unlock()
+		return nil, err
+	}
+	m := newModule("")
+	// register before loading, so that circular imports do not load the file again
+	vm.modules[name] = m
+	vm.modulesMutex.Unlock()
+	err = vm.withModule(m, func() error {
+		err := vm.loadFile(file)
+		m = vm.currentModule()
+		return err
+	})
+	vm.modulesMutex.Lock()
+	defer vm.modulesMutex.Unlock()
+	if err != nil {
+		delete(vm.modules, name)
+		return nil, err
+	}
+	vm.modules[name] = m
+	return m, nil
+}
+
+// crackImport parses an import spec: (name), (name as: alias), (name (sym ...)) or (name as: alias (sym ...))
+func (vm *VM) crackImport(spec *Object) (*Object, *Object, *Object, bool) {
+	name := Car(spec)
+	if !IsSymbol(name) {
+		return nil, nil, nil, false
+	}
+	alias := name
+	only := EmptyList
+	for tmp := Cdr(spec); tmp != EmptyList; tmp = Cdr(tmp) {
+		item := Car(tmp)
+		switch {
+		case item == vm.Intern("as:"):
+			tmp = Cdr(tmp)
+			if tmp == EmptyList || !IsSymbol(Car(tmp)) {
+				return nil, nil, nil, false
+			}
+			alias = Car(tmp)
+		case IsList(item):
+			for lst := item; lst != EmptyList; lst = Cdr(lst) {
+				if !IsSymbol(Car(lst)) {
+					return nil, nil, nil, false
+				}
+			}
+			only = item
+		default:
+			return nil, nil, nil, false
+		}
+	}
+	return name, alias, only, true
+}
+
+// importModule loads a module once, and makes its names available to the current module
+func (vm *VM) importModule(spec *Object) error {
+	name, alias, only, ok := vm.crackImport(spec)
+	if !ok {
+		return Error(SyntaxErrorKey, Cons(vm.Intern("import"), spec))
+	}
+	if !vm.HasCapability(FileCapability) && !vm.isModuleLoaded(name.text) {
+		return vm.requireCapability(FileCapability, "importing "+name.text)
+	}
+	m, err := vm.loadModule(name.text)
+	if err != nil {
+		return err
+	}
+	current := vm.currentModule()
+	current.mutex.Lock()
+	current.aliases[alias.text] = m
+	current.mutex.Unlock()
+	for ; only != EmptyList; only = Cdr(only) {
+		sym := Car(only)
+		if !m.exported(sym) {
+			return Error(ArgumentErrorKey, "Not exported from module ", name, ": ", sym)
+		}
+		q := m.qualify(vm, sym)
+		current.mutex.Lock()
+		current.imports[sym] = q
+		current.mutex.Unlock()
+	}
+	return nil
+}
+
+func (vm *VM) isModuleLoaded(name string) bool {
+	vm.modulesMutex.Lock()
+	defer vm.modulesMutex.Unlock()
+	_, ok := vm.modules[name]
+	return ok
+}
+
+// Modules - return the names of the modules loaded by the VM
+func (vm *VM) Modules() []string {
+	vm.modulesMutex.Lock()
+	defer vm.modulesMutex.Unlock()
+	names := make([]string, 0, len(vm.modules))
+	for k := range vm.modules {
+		names = append(names, k)
+	}
+	return names
+}
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
+	"math/big"
 	"os"
 	"os/user"
 	"path/filepath"
@@ -15,9 +17,34 @@ import (
 const defaultIndentSize = "    "
 
 type dataReader struct {
-	vm  *VM
-	in  *bufio.Reader
-	pos int
+	vm      *VM
+	in      *bufio.Reader
+	pos     int
+	file    string
+	line    int
+	col     int
+	lastCol int  // the column before the last character read, for ungetChar
+	last    rune // the last character read
+}
+
+// Position is a location in a source file. Lines and columns start at 1.
+type Position struct {
+	File   string
+	Line   int
+	Column int
+}
+
+func (p *Position) String() string {
+	s := strconv.Itoa(p.Line) + ":" + strconv.Itoa(p.Column)
+	if p.File != "" {
+		return p.File + ":" + s
+	}
+	return s
+}
+
+// SourcePosition returns the position a list was read from, or nil if it is not known
+func SourcePosition(obj *Object) *Position {
+	return obj.pos
 }
 
 // IsDirectoryReadable - return true of the directory is readable
@@ -36,6 +63,19 @@ func IsFileReadable(path string) bool {
 	return false
 }
 
+// isNewerFile returns true if both files exist and the first was modified after the second
+func isNewerFile(path string, other string) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	otherInfo, err := os.Stat(other)
+	if err != nil {
+		return false
+	}
+	return info.ModTime().After(otherInfo.ModTime())
+}
+
 // ExpandFilePath returns the absolute path of a file or directory
 func ExpandFilePath(path string) string {
 	expanded, err := ExpandPath(path)
@@ -79,7 +119,7 @@ func SlurpFile(path string) (*Object, error) {
 	path = ExpandFilePath(path)
 	b, err := ioutil.ReadFile(path)
 	if err != nil {
-		return EmptyString, err
+		return EmptyString, Error(IOErrorKey, err.Error())
 	}
 	return String(string(b)), nil
 }
@@ -87,7 +127,11 @@ func SlurpFile(path string) (*Object, error) {
 // SpitFile - write the string to the file.
 func SpitFile(path string, data string) error {
 	path = ExpandFilePath(path)
-	return ioutil.WriteFile(path, []byte(data), 0644)
+	err := ioutil.WriteFile(path, []byte(data), 0644)
+	if err != nil {
+		return Error(IOErrorKey, err.Error())
+	}
+	return nil
 }
 
 // Read - only reads the first item in the input, along with how many characters it read
@@ -97,13 +141,13 @@ func (vm *VM) Read(input *Object, keys *Object) (*Object, error) {
 		return nil, Error(ArgumentErrorKey, "read invalid input: ", input)
 	}
 	r := strings.NewReader(input.text)
-	reader := vm.newDataReader(r)
+	reader := vm.newDataReader(r, "")
 	obj, err := reader.readData(keys)
 	if err != nil {
 		if err == io.EOF {
 			return Null, nil
 		}
-		return nil, err
+		return nil, reader.positionError(err)
 	}
 	return obj, nil
 }
@@ -113,7 +157,12 @@ func (vm *VM) ReadAll(input *Object, keys *Object) (*Object, error) {
 	if !IsString(input) {
 		return nil, Error(ArgumentErrorKey, "read-all invalid input: ", input)
 	}
-	reader := vm.newDataReader(strings.NewReader(input.text))
+	return vm.readAll(input.text, "", keys)
+}
+
+// readAll reads all items in the text, recording the file in the positions of the lists read
+func (vm *VM) readAll(text string, file string, keys *Object) (*Object, error) {
+	reader := vm.newDataReader(strings.NewReader(text), file)
 	lst := EmptyList
 	tail := EmptyList
 	val, err := reader.readData(keys)
@@ -128,14 +177,14 @@ func (vm *VM) ReadAll(input *Object, keys *Object) (*Object, error) {
 		val, err = reader.readData(keys)
 	}
 	if err != io.EOF {
-		return nil, err
+		return nil, reader.positionError(err)
 	}
 	return lst, nil
 }
 
-func (vm *VM) newDataReader(in io.Reader) *dataReader {
+func (vm *VM) newDataReader(in io.Reader, file string) *dataReader {
 	br := bufio.NewReader(in)
-	return &dataReader{vm, br, 0}
+	return &dataReader{vm: vm, in: br, file: file, line: 1}
 }
 
 func (dr *dataReader) getChar() (rune, error) {
@@ -144,17 +193,39 @@ func (dr *dataReader) getChar() (rune, error) {
 		return 0, e
 	}
 	dr.pos++
+	dr.last = r
+	dr.lastCol = dr.col
+	if r == '\n' {
+		dr.line++
+		dr.col = 0
+	} else {
+		dr.col++
+	}
 	return r, nil
 }
 
 func (dr *dataReader) ungetChar() error {
 	e := dr.in.UnreadRune()
-	if e != nil {
+	if e == nil {
 		dr.pos--
+		if dr.last == '\n' {
+			dr.line--
+		}
+		dr.col = dr.lastCol
 	}
 	return e
 }
 
+// position returns the position of the last character read
+func (dr *dataReader) position() *Position {
+	return &Position{File: dr.file, Line: dr.line, Column: dr.col}
+}
+
+// positionError records the current position in a syntax error
+func (dr *dataReader) positionError(err error) error {
+	return withTrace(err, []StackFrame{{Pos: dr.position()}})
+}
+
 func (dr *dataReader) readData(keys *Object) (*Object, error) {
 	c, e := dr.getChar()
 	for e == nil {
@@ -204,7 +275,12 @@ func (dr *dataReader) readData(keys *Object) (*Object, error) {
 		case '#':
 			return dr.decodeReaderMacro(keys)
 		case '(':
-			return dr.decodeList(keys)
+			pos := dr.position()
+			lst, err := dr.decodeList(keys)
+			if err == nil && lst != EmptyList {
+				lst.pos = pos
+			}
+			return lst, err
 		case '[':
 			return dr.decodeArray(keys)
 		case '{':
@@ -348,7 +424,7 @@ func (dr *dataReader) decodeStruct(keys *Object) (*Object, error) {
 			return nil, Error(SyntaxErrorKey, "Unexpected ':' in struct")
 		}
 		if c == '}' {
-			return Struct(items)
+			return structOrHashMap(items)
 		}
 		err = dr.ungetChar()
 		if err != nil {
@@ -448,12 +524,11 @@ func (dr *dataReader) decodeAtom(firstChar rune) (*Object, error) {
 			return False, nil
 		}
 	}
-	f, err := strconv.ParseFloat(s, 64)
-	if err == nil {
+	if n, ok := parseNumber(s); ok {
 		if keyword {
 			return nil, Error(SyntaxErrorKey, "Keyword cannot have a name that looks like a number: ", s, ":")
 		}
-		return Number(f), nil
+		return n, nil
 	}
 	if keyword {
 		s += ":"
@@ -686,9 +761,26 @@ func writeToString(obj *Object, json bool, indentSize string) (string, error) {
 	return strdn, nil
 }
 
+// writeJSONNumber writes a number as JSON, which has no ratios, infinities or NaN. Ratios are
+// written as the nearest float.
+func writeJSONNumber(n *Object) (string, error) {
+	if math.IsNaN(n.fval) || math.IsInf(n.fval, 0) {
+		return "", Error(ArgumentErrorKey, "Data cannot be described in JSON: ", n)
+	}
+	if _, ok := n.Value.(*big.Rat); ok {
+		return numberToString(Number(n.fval)), nil
+	}
+	return n.String(), nil
+}
+
 func writeData(obj *Object, json bool, indent string, indentSize string) (string, error) {
 	switch obj.Type {
-	case BooleanType, NullType, NumberType:
+	case BooleanType, NullType:
+		return obj.String(), nil
+	case NumberType:
+		if json {
+			return writeJSONNumber(obj)
+		}
 		return obj.String(), nil
 	case ListType:
 		if json {
@@ -708,6 +800,8 @@ func writeData(obj *Object, json bool, indent string, indentSize string) (string
 		return writeArray(obj, json, indent, indentSize)
 	case StructType:
 		return writeStruct(obj, json, indent, indentSize)
+	case VectorType, HashMapType:
+		return writePersistent(obj, json, indent, indentSize)
 	case CharacterType:
 		c := rune(obj.fval)
 		switch c {
@@ -736,11 +830,21 @@ func writeData(obj *Object, json bool, indent string, indentSize string) (string
 			return fmt.Sprintf("#\\x%04X", c), nil
 		}
 	default:
+		if obj == nil {
+			return "", Error(ArgumentErrorKey, "Data cannot be nil")
+		}
 		if json {
+			if m, ok := obj.Value.(JSONMarshaler); ok {
+				b, err := m.MarshalJSON()
+				if err != nil {
+					return "", Error(ArgumentErrorKey, "Data cannot be described in JSON: ", obj, ": ", err.Error())
+				}
+				return string(b), nil
+			}
 			return "", Error(ArgumentErrorKey, "Data cannot be described in JSON: ", obj)
 		}
-		if obj == nil {
-			return "", Error(ArgumentErrorKey, "Data cannot be nil")
+		if w, ok := obj.Value.(Writer); ok {
+			return w.WriteVesper(), nil
 		}
 		return obj.String(), nil
 	}
@@ -825,9 +929,17 @@ func writeArray(a *Object, json bool, indent string, indentSize string) (string,
 }
 
 func writeStruct(strct *Object, json bool, indent string, indentSize string) (string, error) {
+	keyvals := make([]*Object, 0, len(strct.bindings)*2)
+	for _, k := range sortedKeys(strct) {
+		keyvals = append(keyvals, k, strct.bindings[k])
+	}
+	return writeKeyValues(keyvals, json, indent, indentSize)
+}
+
+// writeKeyValues writes the alternating keys and values in the notation of a struct
+func writeKeyValues(keyvals []*Object, json bool, indent string, indentSize string) (string, error) {
 	var buf strings.Builder
 	buf.WriteString("{")
-	size := len(strct.bindings)
 	delim := ""
 	sep := " "
 	if json {
@@ -835,7 +947,7 @@ func writeStruct(strct *Object, json bool, indent string, indentSize string) (st
 		sep = ": "
 	}
 	nextIndent := ""
-	if size > 0 {
+	if len(keyvals) > 0 {
 		if indentSize != "" {
 			nextIndent = indent + indentSize
 			delim = delim + "\n" + nextIndent
@@ -844,20 +956,17 @@ func writeStruct(strct *Object, json bool, indent string, indentSize string) (st
 			delim = delim + " "
 		}
 	}
-	first := true
-	for k, v := range strct.bindings {
-		if first {
-			first = false
-		} else {
+	for i := 0; i < len(keyvals); i += 2 {
+		if i > 0 {
 			buf.WriteString(delim)
 		}
-		s, err := writeData(k, json, nextIndent, indentSize)
+		s, err := writeData(keyvals[i], json, nextIndent, indentSize)
 		if err != nil {
 			return "", err
 		}
 		buf.WriteString(s)
 		buf.WriteString(sep)
-		s, err = writeData(v, json, nextIndent, indentSize)
+		s, err = writeData(keyvals[i+1], json, nextIndent, indentSize)
 		if err != nil {
 			return "", err
 		}
@@ -2,22 +2,63 @@ package vesper
 
 import (
 	"math"
+	"math/big"
 	"math/rand"
 	"strconv"
+	"strings"
 )
 
 const epsilon = 0.000000001
 
 // Zero is the Vesper 0 value
-var Zero = Number(0)
+var Zero = Int(0)
 
 // One is the Vesper 1 value
-var One = Number(1)
+var One = Int(1)
 
 // MinusOne is the Vesper -1 value
-var MinusOne = Number(-1)
+var MinusOne = Int(-1)
 
-// Number - create a Number object for the given value
+// A <number> is one of four representations, distinguished by its Value field:
+//   nil       - a float64, held in fval
+//   fixnum    - an exact integer, held in ival
+//   *big.Int  - an exact integer too large for an int64
+//   *big.Rat  - an exact, non-integer ratio
+// The fval field of the exact representations always holds the nearest float64,
+// so code that only needs an approximate value can continue to read it directly.
+type fixnum struct{}
+
+// Number kinds, in order of contagion: the result of an operation has the
+// kind of its highest-ranked argument.
+const (
+	fixnumKind = iota
+	bignumKind
+	ratioKind
+	floatKind
+)
+
+func numberKind(n *Object) int {
+	switch n.Value.(type) {
+	case fixnum:
+		return fixnumKind
+	case *big.Int:
+		return bignumKind
+	case *big.Rat:
+		return ratioKind
+	}
+	return floatKind
+}
+
+func contagion(n1 *Object, n2 *Object) int {
+	k1 := numberKind(n1)
+	k2 := numberKind(n2)
+	if k1 > k2 {
+		return k1
+	}
+	return k2
+}
+
+// Number - create a floating point Number object for the given value
 func Number(f float64) *Object {
 	return &Object{
 		Type: NumberType,
@@ -25,9 +66,113 @@ func Number(f float64) *Object {
 	}
 }
 
-// Int converts an integer to a vector Number
+// Int - create an exact integer Number object for the given value
 func Int(n int64) *Object {
-	return Number(float64(n))
+	return &Object{
+		Type:  NumberType,
+		fval:  float64(n),
+		ival:  n,
+		Value: fixnum{},
+	}
+}
+
+// BigInt - create an exact integer Number object for the given value.
+// The value is not copied, and is converted to a fixnum if it is small enough.
+func BigInt(n *big.Int) *Object {
+	if n.IsInt64() {
+		return Int(n.Int64())
+	}
+	f, _ := new(big.Float).SetInt(n).Float64()
+	return &Object{
+		Type:  NumberType,
+		fval:  f,
+		Value: n,
+	}
+}
+
+// Rational - create an exact Number object for the given ratio.
+// The value is not copied, and is converted to an integer if its denominator is 1.
+func Rational(r *big.Rat) *Object {
+	if r.IsInt() {
+		return BigInt(new(big.Int).Set(r.Num()))
+	}
+	f, _ := r.Float64()
+	return &Object{
+		Type:  NumberType,
+		fval:  f,
+		Value: r,
+	}
+}
+
+// IsExact returns true if the object is an exact number, i.e. an integer or a ratio
+func IsExact(obj *Object) bool {
+	return obj.Type == NumberType && obj.Value != nil
+}
+
+// IsRatio returns true if the object is an exact, non-integer number
+func IsRatio(obj *Object) bool {
+	if obj.Type == NumberType {
+		_, ok := obj.Value.(*big.Rat)
+		return ok
+	}
+	return false
+}
+
+func bigValue(n *Object) *big.Int {
+	if b, ok := n.Value.(*big.Int); ok {
+		return b
+	}
+	return big.NewInt(n.ival)
+}
+
+func ratValue(n *Object) *big.Rat {
+	switch v := n.Value.(type) {
+	case *big.Rat:
+		return v
+	case *big.Int:
+		return new(big.Rat).SetInt(v)
+	}
+	return new(big.Rat).SetInt64(n.ival)
+}
+
+func numberToString(n *Object) string {
+	switch v := n.Value.(type) {
+	case fixnum:
+		return strconv.FormatInt(n.ival, 10)
+	case *big.Int:
+		return v.String()
+	case *big.Rat:
+		return v.RatString()
+	}
+	s := strconv.FormatFloat(n.fval, 'f', -1, 64)
+	if strings.IndexAny(s, ".NI") < 0 {
+		// keep integral floats distinguishable from exact integers
+		s += ".0"
+	}
+	return s
+}
+
+// parseNumber parses integer, ratio and floating point syntax, returning false
+// if the string is not a number.
+func parseNumber(s string) (*Object, bool) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return Int(n), true
+	}
+	if b, ok := new(big.Int).SetString(s, 10); ok {
+		return BigInt(b), true
+	}
+	if i := strings.IndexByte(s, '/'); i > 0 {
+		num, ok1 := new(big.Int).SetString(s[:i], 10)
+		den, ok2 := new(big.Int).SetString(s[i+1:], 10)
+		if ok1 && ok2 && den.Sign() > 0 {
+			return Rational(new(big.Rat).SetFrac(num, den)), true
+		}
+		return nil, false
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return Number(f), true
+	}
+	return nil, false
 }
 
 // Round - return the closest integer value to the float value
@@ -38,19 +183,29 @@ func Round(f float64) float64 {
 	return math.Ceil(f - 0.5)
 }
 
+func floatToInt(f float64) (*Object, error) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil, Error(ArgumentErrorKey, "cannot convert to an integer: ", Number(f))
+	}
+	if f >= math.MinInt64 && f < math.MaxInt64 {
+		return Int(int64(f)), nil
+	}
+	b, _ := big.NewFloat(f).Int(nil)
+	return BigInt(b), nil
+}
+
 // ToNumber - convert object to a number, if possible
 func ToNumber(o *Object) (*Object, error) {
 	switch o.Type {
 	case NumberType:
 		return o, nil
 	case CharacterType:
-		return Number(o.fval), nil
+		return Int(int64(o.fval)), nil
 	case BooleanType:
-		return Number(o.fval), nil
+		return Int(int64(o.fval)), nil
 	case StringType:
-		f, err := strconv.ParseFloat(o.text, 64)
-		if err == nil {
-			return Number(f), nil
+		if n, ok := parseNumber(o.text); ok {
+			return n, nil
 		}
 	}
 	return nil, Error(ArgumentErrorKey, "cannot convert to an number: ", o)
@@ -60,35 +215,64 @@ func ToNumber(o *Object) (*Object, error) {
 func ToInt(o *Object) (*Object, error) {
 	switch o.Type {
 	case NumberType:
-		return Number(Round(o.fval)), nil
+		switch v := o.Value.(type) {
+		case fixnum, *big.Int:
+			return o, nil
+		case *big.Rat:
+			half := big.NewRat(1, 2)
+			if v.Sign() < 0 {
+				return numberCeiling(Rational(new(big.Rat).Sub(v, half))), nil
+			}
+			return numberFloor(Rational(new(big.Rat).Add(v, half))), nil
+		}
+		return floatToInt(Round(o.fval))
 	case CharacterType:
-		return Number(o.fval), nil
+		return Int(int64(o.fval)), nil
 	case BooleanType:
-		return Number(o.fval), nil
+		return Int(int64(o.fval)), nil
 	case StringType:
 		n, err := strconv.ParseInt(o.text, 10, 64)
 		if err == nil {
-			return Number(float64(n)), nil
+			return Int(n), nil
+		}
+		if b, ok := new(big.Int).SetString(o.text, 10); ok {
+			return BigInt(b), nil
 		}
 	}
 	return nil, Error(ArgumentErrorKey, "cannot convert to an integer: ", o)
 }
 
-// IsInt returns true if the object is an integer
+// ToExact - convert the number to an exact number. Floats are converted exactly.
+func ToExact(o *Object) (*Object, error) {
+	if IsExact(o) {
+		return o, nil
+	}
+	if math.IsNaN(o.fval) || math.IsInf(o.fval, 0) {
+		return nil, Error(ArgumentErrorKey, "cannot convert to an exact number: ", o)
+	}
+	return Rational(new(big.Rat).SetFloat64(o.fval)), nil
+}
+
+// ToInexact - convert the number to a float
+func ToInexact(o *Object) *Object {
+	if o.Value == nil {
+		return o
+	}
+	return Number(o.fval)
+}
+
+// IsInt returns true if the object is an exact integer
 func IsInt(obj *Object) bool {
 	if obj.Type == NumberType {
-		f := obj.fval
-		return math.Trunc(f) == f
+		k := numberKind(obj)
+		return k == fixnumKind || k == bignumKind
 	}
 	return false
 }
 
 // IsFloat returns true if the object is a float
 func IsFloat(obj *Object) bool {
-	if obj.Type == NumberType {
-		return !IsInt(obj)
-	}
-	return false
+	return obj.Type == NumberType && obj.Value == nil
 }
 
 // AsFloat64Value returns the floating point value of the object
@@ -102,7 +286,7 @@ func AsFloat64Value(obj *Object) (float64, error) {
 // AsInt64Value returns the int64 value of the object
 func AsInt64Value(obj *Object) (int64, error) {
 	if obj.Type == NumberType {
-		return int64(obj.fval), nil
+		return Int64Value(obj), nil
 	}
 	return 0, Error(ArgumentErrorKey, "Expected a <number>, got a ", obj.Type)
 }
@@ -110,7 +294,7 @@ func AsInt64Value(obj *Object) (int64, error) {
 // AsIntValue returns the int value of the object
 func AsIntValue(obj *Object) (int, error) {
 	if obj.Type == NumberType {
-		return int(obj.fval), nil
+		return IntValue(obj), nil
 	}
 	return 0, Error(ArgumentErrorKey, "Expected a <number>, got a ", obj.Type)
 }
@@ -123,11 +307,240 @@ func AsByteValue(obj *Object) (byte, error) {
 	return 0, Error(ArgumentErrorKey, "Expected a <number>, got a ", obj.Type)
 }
 
+// AsBigIntValue returns the value of an exact integer as a big.Int
+func AsBigIntValue(obj *Object) (*big.Int, error) {
+	if IsInt(obj) {
+		return new(big.Int).Set(bigValue(obj)), nil
+	}
+	return nil, Error(ArgumentErrorKey, "Expected an exact integer, got ", obj)
+}
+
 // NumberEqual returns true if the object is equal to the argument, within epsilon
 func NumberEqual(f1 float64, f2 float64) bool {
 	return f1 == f2 || math.Abs(f1-f2) < epsilon
 }
 
+// numberCompare returns -1, 0 or 1. It is exact if both numbers are exact.
+func numberCompare(n1 *Object, n2 *Object) int {
+	switch contagion(n1, n2) {
+	case fixnumKind:
+		if n1.ival < n2.ival {
+			return -1
+		} else if n1.ival > n2.ival {
+			return 1
+		}
+		return 0
+	case bignumKind:
+		return bigValue(n1).Cmp(bigValue(n2))
+	case ratioKind:
+		return ratValue(n1).Cmp(ratValue(n2))
+	}
+	if NumberEqual(n1.fval, n2.fval) {
+		return 0
+	} else if n1.fval < n2.fval {
+		return -1
+	}
+	return 1
+}
+
+// numberEquivalent is the equality used by equal?, which requires the same exactness
+func numberEquivalent(n1 *Object, n2 *Object) bool {
+	if IsExact(n1) != IsExact(n2) {
+		return false
+	}
+	return numberCompare(n1, n2) == 0
+}
+
+func numberAdd(n1 *Object, n2 *Object) *Object {
+	switch contagion(n1, n2) {
+	case fixnumKind:
+		x, y := n1.ival, n2.ival
+		s := x + y
+		if (x >= 0) != (y >= 0) || (s >= 0) == (x >= 0) {
+			return Int(s)
+		}
+		return BigInt(new(big.Int).Add(big.NewInt(x), big.NewInt(y)))
+	case bignumKind:
+		return BigInt(new(big.Int).Add(bigValue(n1), bigValue(n2)))
+	case ratioKind:
+		return Rational(new(big.Rat).Add(ratValue(n1), ratValue(n2)))
+	}
+	return Number(n1.fval + n2.fval)
+}
+
+func numberSub(n1 *Object, n2 *Object) *Object {
+	switch contagion(n1, n2) {
+	case fixnumKind:
+		x, y := n1.ival, n2.ival
+		s := x - y
+		if (x >= 0) == (y >= 0) || (s >= 0) == (x >= 0) {
+			return Int(s)
+		}
+		return BigInt(new(big.Int).Sub(big.NewInt(x), big.NewInt(y)))
+	case bignumKind:
+		return BigInt(new(big.Int).Sub(bigValue(n1), bigValue(n2)))
+	case ratioKind:
+		return Rational(new(big.Rat).Sub(ratValue(n1), ratValue(n2)))
+	}
+	return Number(n1.fval - n2.fval)
+}
+
+func numberMul(n1 *Object, n2 *Object) *Object {
+	switch contagion(n1, n2) {
+	case fixnumKind:
+		x, y := n1.ival, n2.ival
+		p := x * y
+		if x == 0 || (p/x == y && !(x == -1 && y == math.MinInt64)) {
+			return Int(p)
+		}
+		return BigInt(new(big.Int).Mul(big.NewInt(x), big.NewInt(y)))
+	case bignumKind:
+		return BigInt(new(big.Int).Mul(bigValue(n1), bigValue(n2)))
+	case ratioKind:
+		return Rational(new(big.Rat).Mul(ratValue(n1), ratValue(n2)))
+	}
+	return Number(n1.fval * n2.fval)
+}
+
+func numberDiv(n1 *Object, n2 *Object) (*Object, error) {
+	kind := contagion(n1, n2)
+	if kind == floatKind {
+		return Number(n1.fval / n2.fval), nil
+	}
+	if numberIsZero(n2) {
+		return nil, Error(ArgumentErrorKey, "/: divide by zero")
+	}
+	if kind == fixnumKind {
+		x, y := n1.ival, n2.ival
+		if x%y == 0 && !(x == math.MinInt64 && y == -1) {
+			return Int(x / y), nil
+		}
+	}
+	return Rational(new(big.Rat).Quo(ratValue(n1), ratValue(n2))), nil
+}
+
+func numberQuotient(n1 *Object, n2 *Object) (*Object, error) {
+	if numberIsZero(n2) {
+		return nil, Error(ArgumentErrorKey, "quotient: divide by zero")
+	}
+	if IsInt(n1) && IsInt(n2) {
+		if numberKind(n1) == fixnumKind && numberKind(n2) == fixnumKind && !(n1.ival == math.MinInt64 && n2.ival == -1) {
+			return Int(n1.ival / n2.ival), nil
+		}
+		return BigInt(new(big.Int).Quo(bigValue(n1), bigValue(n2))), nil
+	}
+	return Number(math.Trunc(n1.fval / n2.fval)), nil
+}
+
+func numberRemainder(n1 *Object, n2 *Object) (*Object, error) {
+	if numberIsZero(n2) {
+		return nil, Error(ArgumentErrorKey, "remainder: divide by zero")
+	}
+	if IsInt(n1) && IsInt(n2) {
+		if numberKind(n1) == fixnumKind && numberKind(n2) == fixnumKind {
+			if n2.ival == -1 {
+				return Zero, nil
+			}
+			return Int(n1.ival % n2.ival), nil
+		}
+		return BigInt(new(big.Int).Rem(bigValue(n1), bigValue(n2))), nil
+	}
+	return Number(math.Mod(n1.fval, n2.fval)), nil
+}
+
+func numberIsZero(n *Object) bool {
+	switch numberKind(n) {
+	case fixnumKind:
+		return n.ival == 0
+	case floatKind:
+		return NumberEqual(n.fval, 0.0)
+	}
+	return false // bignums and ratios are never zero
+}
+
+func numberNegate(n *Object) *Object {
+	return numberSub(Zero, n)
+}
+
+func numberAbs(n *Object) *Object {
+	if numberKind(n) == floatKind {
+		return Number(math.Abs(n.fval))
+	}
+	if numberCompare(n, Zero) < 0 {
+		return numberNegate(n)
+	}
+	return n
+}
+
+func numberFloor(n *Object) *Object {
+	switch v := n.Value.(type) {
+	case fixnum, *big.Int:
+		return n
+	case *big.Rat:
+		// big.Rat denominators are positive, so Euclidean division floors
+		return BigInt(new(big.Int).Div(v.Num(), v.Denom()))
+	}
+	return Number(math.Floor(n.fval))
+}
+
+func numberCeiling(n *Object) *Object {
+	if IsRatio(n) {
+		return numberNegate(numberFloor(numberNegate(n)))
+	}
+	if IsExact(n) {
+		return n
+	}
+	return Number(math.Ceil(n.fval))
+}
+
+// maxExactPowBits is the largest exact result, in bits, that numberPow will compute
+const maxExactPowBits = 1 << 24
+
+// numberPow raises n to the power e. The result is exact if n is exact and e is an integer.
+func numberPow(n *Object, e *Object) (*Object, error) {
+	if !IsExact(n) || numberKind(e) != fixnumKind {
+		return Number(math.Pow(n.fval, e.fval)), nil
+	}
+	exp := e.ival
+	if exp < 0 {
+		if numberIsZero(n) {
+			return nil, Error(ArgumentErrorKey, "pow: divide by zero")
+		}
+		if exp == math.MinInt64 {
+			return Number(math.Pow(n.fval, e.fval)), nil
+		}
+		p, err := numberPow(n, Int(-exp))
+		if err != nil {
+			return nil, err
+		}
+		return numberDiv(One, p)
+	}
+	r := ratValue(n)
+	num, den := r.Num(), r.Denom()
+	if bits := num.BitLen() + den.BitLen(); bits > 2 && exp > maxExactPowBits/int64(bits) {
+		return nil, Error(ArgumentErrorKey, "pow: exact result too large")
+	}
+	x := new(big.Int).Exp(num, big.NewInt(exp), nil)
+	if den.Cmp(big.NewInt(1)) == 0 {
+		return BigInt(x), nil
+	}
+	return Rational(new(big.Rat).SetFrac(x, new(big.Int).Exp(den, big.NewInt(exp), nil))), nil
+}
+
+// numberSqrt returns the square root of n, which is exact if n is the square of an exact number
+func numberSqrt(n *Object) *Object {
+	if IsExact(n) && numberCompare(n, Zero) >= 0 {
+		r := ratValue(n)
+		num := new(big.Int).Sqrt(r.Num())
+		den := new(big.Int).Sqrt(r.Denom())
+		root := new(big.Rat).SetFrac(num, den)
+		if new(big.Rat).Mul(root, root).Cmp(r) == 0 {
+			return Rational(root)
+		}
+	}
+	return Number(math.Sqrt(n.fval))
+}
+
 var randomGenerator = rand.New(rand.NewSource(1))
 
 // RandomSeed seeds the random number generator with the given seed value
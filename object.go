@@ -2,7 +2,6 @@ package vesper
 
 import (
 	"fmt"
-	"strconv"
 )
 
 // Object represents all objects in Vesper
@@ -17,7 +16,9 @@ type Object struct {
 	bindings     map[*Object]*Object // non-nil for struct
 	elements     []*Object           // non-nil for array
 	fval         float64             // number
+	ival         int64               // exact integer number
 	text         string              // string, symbol, keyword, type
+	pos          *Position           // non-nil for lists read from source
 	Value        interface{}         // the rest of the data for more complex things
 }
 
@@ -25,6 +26,51 @@ type stringable interface {
 	String() string
 }
 
+// The following interfaces may be implemented by the Value of an extension object, created
+// with NewObject, so that the standard library can work with it like the built-in types.
+
+// Writer is implemented by values that control how write shows them. Those that do not
+// also implement String are shown the same way by print and to-string.
+type Writer interface {
+	WriteVesper() string
+}
+
+// Equaler is implemented by values that are compared by equal?, rather than by identity.
+// Equal is only called with the Value of an object of the same type.
+type Equaler interface {
+	Equal(other interface{}) bool
+}
+
+// Hasher is implemented by values that can be used as struct keys. Keys that are Equal must
+// have the same Hash.
+type Hasher interface {
+	Equaler
+	Hash() uint64
+}
+
+// JSONMarshaler is implemented by values that can be described in JSON, by the json function.
+// It is the same as json.Marshaler.
+type JSONMarshaler interface {
+	MarshalJSON() ([]byte, error)
+}
+
+// Sequence is implemented by values that are collections, so that the sequence functions
+// (first, rest, nth, count, empty?, seq and conj), and everything built on them, work with
+// them. Seq returns the elements as a list. Conj returns a new collection with the value
+// added, leaving the original unchanged.
+type Sequence interface {
+	Count() int
+	Seq() *Object
+	Conj(val *Object) (*Object, error)
+}
+
+// Indexed is implemented by sequences that can return an element by its index without
+// walking their Seq. Nth is only called with an index from 0 up to Count.
+type Indexed interface {
+	Sequence
+	Nth(i int) *Object
+}
+
 var (
 	// TypeType is the metatype, the type of all types
 	TypeType *Object // bootstrapped in initSymbolTable => Intern("<type>")
@@ -65,11 +111,14 @@ func RuneValue(obj *Object) rune {
 
 // IntValue - return native int value of the object
 func IntValue(obj *Object) int {
-	return int(obj.fval)
+	return int(Int64Value(obj))
 }
 
 // Int64Value - return native int64 value of the object
 func Int64Value(obj *Object) int64 {
+	if _, ok := obj.Value.(fixnum); ok {
+		return obj.ival
+	}
 	return int64(obj.fval)
 }
 
@@ -113,7 +162,7 @@ func (lob *Object) String() string {
 	case CharacterType:
 		return string([]rune{rune(lob.fval)})
 	case NumberType:
-		return strconv.FormatFloat(lob.fval, 'f', -1, 64)
+		return numberToString(lob)
 	case BlobType:
 		return fmt.Sprintf("#[blob %d bytes]", len(BlobValue(lob)))
 	case StringType, SymbolType, KeywordType, TypeType:
@@ -137,6 +186,9 @@ func (lob *Object) String() string {
 			if s, ok := lob.Value.(stringable); ok {
 				return s.String()
 			}
+			if w, ok := lob.Value.(Writer); ok {
+				return w.WriteVesper()
+			}
 			return "#[" + typeNameString(lob.Type.text) + "]"
 		}
 		return "#" + lob.Type.text + Write(lob.car)
@@ -190,13 +242,13 @@ func Equal(o1 *Object, o2 *Object) bool {
 		return true
 	}
 	if o1.Type != o2.Type {
-		return false
+		return persistentEqual(o1, o2, Equal)
 	}
 	switch o1.Type {
 	case BooleanType, CharacterType:
 		return int(o1.fval) == int(o2.fval)
 	case NumberType:
-		return NumberEqual(o1.fval, o2.fval)
+		return numberEquivalent(o1, o2)
 	case StringType:
 		return o1.text == o2.text
 	case ListType:
@@ -210,6 +262,9 @@ func Equal(o1 *Object, o2 *Object) bool {
 	case NullType:
 		return true // singleton
 	default:
+		if e, ok := o1.Value.(Equaler); ok && o2.Value != nil {
+			return e.Equal(o2.Value)
+		}
 		o1a := Value(o1)
 		if o1a != o1 {
 			o2a := Value(o2)
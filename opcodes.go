@@ -19,6 +19,23 @@ const (
 	opArray
 	opStruct
 	opUndefGlobal
+	opTry
+	opEndTry
+	opAdd
+	opSub
+	opMul
+	opDiv
+	opNumEqual
+	opNumLess
+	opNumLessEqual
+	opNumGreater
+	opNumGreaterEqual
+	opModule
+	opExport
+	opImport
+	opDup
+	opJumpTable
+	opRecur
 	opCount
 )
 
@@ -59,6 +76,40 @@ var (
 	StructSymbol = defaultVM.Intern("struct")
 	// UndefineSymbol represents an undefine operation
 	UndefineSymbol = defaultVM.Intern("undefine")
+	// TrySymbol represents the installation of an error handler
+	TrySymbol = defaultVM.Intern("try")
+	// EndtrySymbol represents the removal of the innermost error handler
+	EndtrySymbol = defaultVM.Intern("endtry")
+	// AddSymbol represents the addition of two numbers
+	AddSymbol = defaultVM.Intern("add")
+	// SubSymbol represents the subtraction of two numbers
+	SubSymbol = defaultVM.Intern("sub")
+	// MulSymbol represents the multiplication of two numbers
+	MulSymbol = defaultVM.Intern("mul")
+	// DivSymbol represents the division of two numbers
+	DivSymbol = defaultVM.Intern("div")
+	// NumeqSymbol represents a numeric equality test
+	NumeqSymbol = defaultVM.Intern("numeq")
+	// NumltSymbol represents a numeric less than test
+	NumltSymbol = defaultVM.Intern("numlt")
+	// NumleSymbol represents a numeric less than or equal test
+	NumleSymbol = defaultVM.Intern("numle")
+	// NumgtSymbol represents a numeric greater than test
+	NumgtSymbol = defaultVM.Intern("numgt")
+	// NumgeSymbol represents a numeric greater than or equal test
+	NumgeSymbol = defaultVM.Intern("numge")
+	// ModuleSymbol represents the declaration of the current module
+	ModuleSymbol = defaultVM.Intern("module")
+	// ExportSymbol represents the export of names from the current module
+	ExportSymbol = defaultVM.Intern("export")
+	// ImportSymbol represents the import of a module
+	ImportSymbol = defaultVM.Intern("import")
+	// DupSymbol represents the duplication of the value on top of the stack
+	DupSymbol = defaultVM.Intern("dup")
+	// JumptableSymbol represents a jump to the clause of a case form that matches a value
+	JumptableSymbol = defaultVM.Intern("jumptable")
+	// RecurSymbol represents a jump back to the start of a loop with new values for its variables
+	RecurSymbol = defaultVM.Intern("recur")
 	// FuncSymbol represents a function definition
 	FuncSymbol = defaultVM.Intern("func")
 )
@@ -67,24 +118,41 @@ var opsyms = initOpsyms()
 
 func initOpsyms() []*Object {
 	syms := []*Object{
-		opNone:        NoneSymbol,
-		opLiteral:     LiteralSymbol,
-		opLocal:       LocalSymbol,
-		opJumpFalse:   JumpfalseSymbol,
-		opJump:        JumpSymbol,
-		opTailCall:    TailcallSymbol,
-		opCall:        CallSymbol,
-		opReturn:      ReturnSymbol,
-		opClosure:     ClosureSymbol,
-		opPop:         PopSymbol,
-		opGlobal:      GlobalSymbol,
-		opDefGlobal:   DefglobalSymbol,
-		opSetLocal:    SetlocalSymbol,
-		opUse:         UseSymbol,
-		opDefMacro:    DefmacroSymbol,
-		opArray:       ArraySymbol,
-		opStruct:      StructSymbol,
-		opUndefGlobal: UndefineSymbol,
+		opNone:            NoneSymbol,
+		opLiteral:         LiteralSymbol,
+		opLocal:           LocalSymbol,
+		opJumpFalse:       JumpfalseSymbol,
+		opJump:            JumpSymbol,
+		opTailCall:        TailcallSymbol,
+		opCall:            CallSymbol,
+		opReturn:          ReturnSymbol,
+		opClosure:         ClosureSymbol,
+		opPop:             PopSymbol,
+		opGlobal:          GlobalSymbol,
+		opDefGlobal:       DefglobalSymbol,
+		opSetLocal:        SetlocalSymbol,
+		opUse:             UseSymbol,
+		opDefMacro:        DefmacroSymbol,
+		opArray:           ArraySymbol,
+		opStruct:          StructSymbol,
+		opUndefGlobal:     UndefineSymbol,
+		opTry:             TrySymbol,
+		opEndTry:          EndtrySymbol,
+		opAdd:             AddSymbol,
+		opSub:             SubSymbol,
+		opMul:             MulSymbol,
+		opDiv:             DivSymbol,
+		opNumEqual:        NumeqSymbol,
+		opNumLess:         NumltSymbol,
+		opNumLessEqual:    NumleSymbol,
+		opNumGreater:      NumgtSymbol,
+		opNumGreaterEqual: NumgeSymbol,
+		opModule:          ModuleSymbol,
+		opExport:          ExportSymbol,
+		opImport:          ImportSymbol,
+		opDup:             DupSymbol,
+		opJumpTable:       JumptableSymbol,
+		opRecur:           RecurSymbol,
 	}
 	return syms
 }
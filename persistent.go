@@ -0,0 +1,802 @@
+package vesper
+
+import (
+	"math/bits"
+	"strings"
+)
+
+// VectorType - the type of Vesper's persistent vector
+var VectorType = defaultVM.Intern("<vector>")
+
+// HashMapType - the type of Vesper's persistent hash map
+var HashMapType = defaultVM.Intern("<hash-map>")
+
+// Vectors and hash maps are immutable. Operations that "modify" them return a new version that
+// shares most of its structure with the original, so that updates are cheap and the old version
+// is unchanged. Because they are never mutated, they can be shared freely between goroutines.
+//
+// They are written in the notation of arrays and structs, and are equal to the array or struct
+// with the same contents, so that what is written reads back as an equal value. Reading the
+// notation of a struct with keys that cannot be struct keys, such as numbers, gives a hash map.
+
+const (
+	trieBits  = 5
+	trieWidth = 1 << trieBits
+	trieMask  = trieWidth - 1
+)
+
+// A vector is a trie of 32-way nodes holding the elements, with the last (up to) 32 elements
+// kept in a separate tail, so that appending is usually just a copy of the tail.
+type vector struct {
+	count int
+	shift uint
+	root  *vectorNode
+	tail  []*Object
+}
+
+// A vectorNode has either child nodes, or elements if it is a leaf
+type vectorNode struct {
+	nodes    []*vectorNode
+	elements []*Object
+}
+
+var emptyVector = &vector{shift: trieBits, root: &vectorNode{}}
+
+func (v *vector) String() string {
+	var buf strings.Builder
+	buf.WriteString("[")
+	for i := 0; i < v.count; i++ {
+		if i > 0 {
+			buf.WriteString(" ")
+		}
+		buf.WriteString(v.nth(i).String())
+	}
+	buf.WriteString("]")
+	return buf.String()
+}
+
+// Equal makes equal? compare vectors by their elements
+func (v *vector) Equal(other interface{}) bool {
+	o, ok := other.(*vector)
+	if !ok || o.count != v.count {
+		return false
+	}
+	for i := 0; i < v.count; i++ {
+		if !Equal(v.nth(i), o.nth(i)) {
+			return false
+		}
+	}
+	return true
+}
+
+// Hash makes vectors usable as keys. It is the same as the Hash of an array of the elements.
+func (v *vector) Hash() uint64 {
+	h := identityHash(ArrayType)
+	for i := 0; i < v.count; i++ {
+		h = mixHash(h, Hash(v.nth(i)))
+	}
+	return h
+}
+
+// Count, Nth, Seq and Conj make vectors sequences
+func (v *vector) Count() int {
+	return v.count
+}
+
+func (v *vector) Nth(i int) *Object {
+	return v.nth(i)
+}
+
+func (v *vector) Seq() *Object {
+	return ListFromValues(v.elements())
+}
+
+func (v *vector) Conj(val *Object) (*Object, error) {
+	return NewObject(VectorType, v.conj(val)), nil
+}
+
+// tailOffset is the index of the first element in the tail
+func (v *vector) tailOffset() int {
+	if v.count < trieWidth {
+		return 0
+	}
+	return ((v.count - 1) >> trieBits) << trieBits
+}
+
+// leaf returns the elements of the leaf holding the ith element
+func (v *vector) leaf(i int) []*Object {
+	if i >= v.tailOffset() {
+		return v.tail
+	}
+	node := v.root
+	for level := v.shift; level > 0; level -= trieBits {
+		node = node.nodes[(i>>level)&trieMask]
+	}
+	return node.elements
+}
+
+func (v *vector) nth(i int) *Object {
+	return v.leaf(i)[i&trieMask]
+}
+
+func (v *vector) elements() []*Object {
+	elements := make([]*Object, 0, v.count)
+	for i := 0; i < v.count; i += trieWidth {
+		elements = append(elements, v.leaf(i)...)
+	}
+	return elements
+}
+
+// conj returns a new vector with the value appended
+func (v *vector) conj(val *Object) *vector {
+	if v.count-v.tailOffset() < trieWidth {
+		tail := make([]*Object, len(v.tail)+1)
+		copy(tail, v.tail)
+		tail[len(v.tail)] = val
+		return &vector{count: v.count + 1, shift: v.shift, root: v.root, tail: tail}
+	}
+	// the tail is full, so push it into the trie
+	tailNode := &vectorNode{elements: v.tail}
+	shift := v.shift
+	var root *vectorNode
+	if (v.count >> trieBits) > (1 << v.shift) {
+		// the trie is full too, so add a level
+		root = &vectorNode{nodes: []*vectorNode{v.root, newVectorPath(v.shift, tailNode)}}
+		shift += trieBits
+	} else {
+		root = v.pushTail(v.shift, v.root, tailNode)
+	}
+	return &vector{count: v.count + 1, shift: shift, root: root, tail: []*Object{val}}
+}
+
+func (v *vector) pushTail(level uint, parent *vectorNode, tailNode *vectorNode) *vectorNode {
+	i := ((v.count - 1) >> level) & trieMask
+	node := &vectorNode{nodes: append([]*vectorNode(nil), parent.nodes...)}
+	var child *vectorNode
+	if level == trieBits {
+		child = tailNode
+	} else if i < len(parent.nodes) {
+		child = v.pushTail(level-trieBits, parent.nodes[i], tailNode)
+	} else {
+		child = newVectorPath(level-trieBits, tailNode)
+	}
+	if i < len(node.nodes) {
+		node.nodes[i] = child
+	} else {
+		node.nodes = append(node.nodes, child)
+	}
+	return node
+}
+
+func newVectorPath(level uint, node *vectorNode) *vectorNode {
+	if level == 0 {
+		return node
+	}
+	return &vectorNode{nodes: []*vectorNode{newVectorPath(level-trieBits, node)}}
+}
+
+// assoc returns a new vector with the ith element replaced. The index must be in range.
+func (v *vector) assoc(i int, val *Object) *vector {
+	if i >= v.tailOffset() {
+		tail := append([]*Object(nil), v.tail...)
+		tail[i&trieMask] = val
+		return &vector{count: v.count, shift: v.shift, root: v.root, tail: tail}
+	}
+	return &vector{count: v.count, shift: v.shift, root: assocVectorNode(v.shift, v.root, i, val), tail: v.tail}
+}
+
+func assocVectorNode(level uint, node *vectorNode, i int, val *Object) *vectorNode {
+	if level == 0 {
+		elements := append([]*Object(nil), node.elements...)
+		elements[i&trieMask] = val
+		return &vectorNode{elements: elements}
+	}
+	nodes := append([]*vectorNode(nil), node.nodes...)
+	j := (i >> level) & trieMask
+	nodes[j] = assocVectorNode(level-trieBits, nodes[j], i, val)
+	return &vectorNode{nodes: nodes}
+}
+
+func vectorValue(obj *Object) *vector {
+	v, _ := obj.Value.(*vector)
+	return v
+}
+
+// Vector - create a new <vector> object holding the elements
+func Vector(elements ...*Object) *Object {
+	v := emptyVector
+	for _, elem := range elements {
+		v = v.conj(elem)
+	}
+	return NewObject(VectorType, v)
+}
+
+// A hashMap is a hash array mapped trie: each node uses 5 bits of the key's hash to pick a
+// slot, and a bitmap records which of its 32 slots are present, so that only those are stored.
+// Keys are compared and hashed as they are by hash tables, with keyEqual and Hash.
+type hashMap struct {
+	count int
+	root  *hamtNode
+}
+
+// A hamtNode holds the entries for its present slots, in order. When all the bits of the hash
+// have been used, a node is a collision node, whose entries all have the same hash.
+type hamtNode struct {
+	bitmap  uint32
+	entries []hamtEntry
+}
+
+// A hamtEntry is either a key and its value, or a child node
+type hamtEntry struct {
+	hash  uint64
+	key   *Object
+	value *Object
+	node  *hamtNode
+}
+
+var emptyHashMap = &hashMap{root: &hamtNode{}}
+
+func (m *hashMap) String() string {
+	var buf strings.Builder
+	buf.WriteString("{")
+	first := true
+	m.root.each(func(e *hamtEntry) {
+		if !first {
+			buf.WriteString(" ")
+		}
+		first = false
+		buf.WriteString(e.key.String())
+		buf.WriteString(" ")
+		buf.WriteString(e.value.String())
+	})
+	buf.WriteString("}")
+	return buf.String()
+}
+
+// Equal makes equal? compare hash maps by their contents
+func (m *hashMap) Equal(other interface{}) bool {
+	o, ok := other.(*hashMap)
+	if !ok || o.count != m.count {
+		return false
+	}
+	equal := true
+	m.root.each(func(e *hamtEntry) {
+		if equal {
+			v, ok := o.get(e.key)
+			equal = ok && Equal(e.value, v)
+		}
+	})
+	return equal
+}
+
+// Hash makes hash maps usable as keys. It is the same as the Hash of a struct of the entries.
+func (m *hashMap) Hash() uint64 {
+	// the order of the entries depends on the hashes of the keys, so combine them with an addition
+	h := identityHash(StructType)
+	m.root.each(func(e *hamtEntry) {
+		h += mixHash(e.hash, Hash(e.value))
+	})
+	return h
+}
+
+// Count, Seq and Conj make hash maps sequences of (key value) lists. The values they conj
+// are key/value pairs.
+func (m *hashMap) Count() int {
+	return m.count
+}
+
+func (m *hashMap) Seq() *Object {
+	return m.entries(func(e *hamtEntry) *Object {
+		return List(e.key, e.value)
+	})
+}
+
+func (m *hashMap) Conj(val *Object) (*Object, error) {
+	pair, err := ToArray(val)
+	if err != nil || len(pair.elements) != 2 {
+		return nil, Error(ArgumentErrorKey, "conj expected a key/value pair for a <hash-map>, got ", val)
+	}
+	return NewObject(HashMapType, m.assoc(pair.elements[0], pair.elements[1])), nil
+}
+
+func (m *hashMap) get(key *Object) (*Object, bool) {
+	return m.root.get(Hash(key), 0, key)
+}
+
+// assoc returns a new hash map with the key bound to the value
+func (m *hashMap) assoc(key *Object, val *Object) *hashMap {
+	root, added := m.root.assoc(Hash(key), 0, key, val)
+	count := m.count
+	if added {
+		count++
+	}
+	return &hashMap{count: count, root: root}
+}
+
+// dissoc returns a new hash map without the key, or the same one if it does not have the key
+func (m *hashMap) dissoc(key *Object) *hashMap {
+	root, removed := m.root.dissoc(Hash(key), 0, key)
+	if !removed {
+		return m
+	}
+	return &hashMap{count: m.count - 1, root: root}
+}
+
+func (m *hashMap) entries(fun func(e *hamtEntry) *Object) *Object {
+	result := EmptyList
+	m.root.each(func(e *hamtEntry) {
+		result = Cons(fun(e), result)
+	})
+	return result
+}
+
+// slot returns the bit for the hash at this level of the trie, and the index of its entry
+func (n *hamtNode) slot(h uint64, shift uint) (uint32, int) {
+	bit := uint32(1) << ((h >> shift) & trieMask)
+	return bit, bits.OnesCount32(n.bitmap & (bit - 1))
+}
+
+func (n *hamtNode) get(h uint64, shift uint, key *Object) (*Object, bool) {
+	if shift >= 64 {
+		for _, e := range n.entries {
+			if keyEqual(e.key, key) {
+				return e.value, true
+			}
+		}
+		return nil, false
+	}
+	bit, i := n.slot(h, shift)
+	if n.bitmap&bit == 0 {
+		return nil, false
+	}
+	e := &n.entries[i]
+	if e.node != nil {
+		return e.node.get(h, shift+trieBits, key)
+	}
+	if keyEqual(e.key, key) {
+		return e.value, true
+	}
+	return nil, false
+}
+
+func (n *hamtNode) copy() *hamtNode {
+	return &hamtNode{bitmap: n.bitmap, entries: append([]hamtEntry(nil), n.entries...)}
+}
+
+// assoc returns a new node with the key bound to the value, and whether the key was added
+func (n *hamtNode) assoc(h uint64, shift uint, key *Object, val *Object) (*hamtNode, bool) {
+	if shift >= 64 {
+		c := n.copy()
+		for i := range c.entries {
+			if keyEqual(c.entries[i].key, key) {
+				c.entries[i].value = val
+				return c, false
+			}
+		}
+		c.entries = append(c.entries, hamtEntry{hash: h, key: key, value: val})
+		return c, true
+	}
+	bit, i := n.slot(h, shift)
+	if n.bitmap&bit == 0 {
+		entries := make([]hamtEntry, len(n.entries)+1)
+		copy(entries, n.entries[:i])
+		entries[i] = hamtEntry{hash: h, key: key, value: val}
+		copy(entries[i+1:], n.entries[i:])
+		return &hamtNode{bitmap: n.bitmap | bit, entries: entries}, true
+	}
+	c := n.copy()
+	e := &c.entries[i]
+	if e.node != nil {
+		node, added := e.node.assoc(h, shift+trieBits, key, val)
+		e.node = node
+		return c, added
+	}
+	if keyEqual(e.key, key) {
+		e.value = val
+		return c, false
+	}
+	// two keys share this slot, so move them both into a new child node
+	node, _ := (&hamtNode{}).assoc(e.hash, shift+trieBits, e.key, e.value)
+	node, _ = node.assoc(h, shift+trieBits, key, val)
+	*e = hamtEntry{node: node}
+	return c, true
+}
+
+// dissoc returns a new node without the key, and whether the key was removed
+func (n *hamtNode) dissoc(h uint64, shift uint, key *Object) (*hamtNode, bool) {
+	if shift >= 64 {
+		for i, e := range n.entries {
+			if keyEqual(e.key, key) {
+				return n.without(0, i), true
+			}
+		}
+		return n, false
+	}
+	bit, i := n.slot(h, shift)
+	if n.bitmap&bit == 0 {
+		return n, false
+	}
+	e := &n.entries[i]
+	if e.node == nil {
+		if !keyEqual(e.key, key) {
+			return n, false
+		}
+		return n.without(bit, i), true
+	}
+	node, removed := e.node.dissoc(h, shift+trieBits, key)
+	if !removed {
+		return n, false
+	}
+	if len(node.entries) == 0 {
+		return n.without(bit, i), true
+	}
+	c := n.copy()
+	if len(node.entries) == 1 && node.entries[0].node == nil {
+		// a single key can move back up into this node
+		c.entries[i] = node.entries[0]
+	} else {
+		c.entries[i].node = node
+	}
+	return c, true
+}
+
+// without returns a copy of the node without the ith entry, whose slot is the bit
+func (n *hamtNode) without(bit uint32, i int) *hamtNode {
+	entries := make([]hamtEntry, 0, len(n.entries)-1)
+	entries = append(entries, n.entries[:i]...)
+	entries = append(entries, n.entries[i+1:]...)
+	return &hamtNode{bitmap: n.bitmap &^ bit, entries: entries}
+}
+
+func (n *hamtNode) each(fun func(e *hamtEntry)) {
+	for i := range n.entries {
+		e := &n.entries[i]
+		if e.node != nil {
+			e.node.each(fun)
+		} else {
+			fun(e)
+		}
+	}
+}
+
+func hashMapValue(obj *Object) *hashMap {
+	m, _ := obj.Value.(*hashMap)
+	return m
+}
+
+// HashMap - create a new <hash-map> object from alternating keys and values
+func HashMap(keyvals ...*Object) (*Object, error) {
+	if len(keyvals)%2 != 0 {
+		return nil, Error(ArgumentErrorKey, "Mismatched key/value in arglist: ", keyvals[len(keyvals)-1])
+	}
+	m := emptyHashMap
+	for i := 0; i < len(keyvals); i += 2 {
+		m = m.assoc(keyvals[i], keyvals[i+1])
+	}
+	return NewObject(HashMapType, m), nil
+}
+
+func hashMapToList(obj *Object) *Object {
+	return hashMapValue(obj).Seq()
+}
+
+// ToVector - convert the object to a <vector>, if possible
+func ToVector(obj *Object) (*Object, error) {
+	if obj.Type == VectorType {
+		return obj, nil
+	}
+	a, err := ToArray(obj)
+	if err != nil {
+		return nil, Error(ArgumentErrorKey, "to-vector cannot accept ", obj.Type)
+	}
+	return Vector(a.elements...), nil
+}
+
+// ToHashMap - convert the object to a <hash-map>, if possible. Structs and hash tables keep
+// their keys, and sequences are taken to hold alternating keys and values.
+func ToHashMap(obj *Object) (*Object, error) {
+	switch obj.Type {
+	case HashMapType:
+		return obj, nil
+	case StructType:
+		m := emptyHashMap
+		for k, v := range obj.bindings {
+			m = m.assoc(k, v)
+		}
+		return NewObject(HashMapType, m), nil
+	case HashtableType:
+		m := emptyHashMap
+		hashtableValue(obj).entries(func(e *hashEntry) *Object {
+			m = m.assoc(e.key, e.value)
+			return Null
+		})
+		return NewObject(HashMapType, m), nil
+	case ListType, ArrayType, VectorType:
+		a, _ := ToArray(obj)
+		return HashMap(a.elements...)
+	}
+	return nil, Error(ArgumentErrorKey, "to-hash-map cannot accept ", obj.Type)
+}
+
+// writePersistent writes a vector or hash map in the notation of an array or struct, which
+// reads back as an array or struct that is equal to it. A hash map whose keys cannot be struct
+// keys reads back as a hash map.
+func writePersistent(obj *Object, json bool, indent string, indentSize string) (string, error) {
+	if v := vectorValue(obj); v != nil {
+		return writeArray(ArrayFromElementsNoCopy(v.elements()), json, indent, indentSize)
+	}
+	m := hashMapValue(obj)
+	keyvals := make([]*Object, 0, m.count*2)
+	valid := true
+	m.root.each(func(e *hamtEntry) {
+		keyvals = append(keyvals, e.key, e.value)
+		valid = valid && IsValidStructKey(e.key)
+	})
+	if json && !valid {
+		return "", Error(ArgumentErrorKey, "Data cannot be described in JSON: ", obj)
+	}
+	return writeKeyValues(keyvals, json, indent, indentSize)
+}
+
+// persistentEqual compares a vector with an array, or a hash map with a struct, by their
+// contents, using eq to compare the elements. Any other values of different types are unequal.
+func persistentEqual(o1 *Object, o2 *Object, eq func(*Object, *Object) bool) bool {
+	if o1.Type == ArrayType || o1.Type == StructType {
+		o1, o2 = o2, o1
+	}
+	switch {
+	case o1.Type == VectorType && o2.Type == ArrayType:
+		v := vectorValue(o1)
+		if v.count != len(o2.elements) {
+			return false
+		}
+		for i, elem := range o2.elements {
+			if !eq(v.nth(i), elem) {
+				return false
+			}
+		}
+		return true
+	case o1.Type == HashMapType && o2.Type == StructType:
+		m := hashMapValue(o1)
+		if m.count != len(o2.bindings) {
+			return false
+		}
+		for k, v := range o2.bindings {
+			val, ok := m.get(k)
+			if !ok || !eq(val, v) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// structOrHashMap makes the keys and values read in the notation of a struct into a struct, or
+// into a hash map if some key cannot be a struct key
+func structOrHashMap(keyvals []*Object) (*Object, error) {
+	for i := 0; i < len(keyvals); i += 2 {
+		if !IsValidStructKey(keyvals[i]) {
+			return HashMap(keyvals...)
+		}
+	}
+	return Struct(keyvals)
+}
+
+// getElement returns the element of the collection for the key, which is an index for
+// sequences. It returns false if there is no such element.
+func getElement(coll *Object, key *Object) (*Object, bool) {
+	switch coll.Type {
+	case HashMapType:
+		return hashMapValue(coll).get(key)
+	case StructType:
+		if IsValidStructKey(key) {
+			v, ok := coll.bindings[structKey(coll, key)]
+			return v, ok
+		}
+	case HashtableType:
+		return hashtableValue(coll).get(key)
+	case VectorType:
+		if i, ok := elementIndex(key, vectorValue(coll).count); ok {
+			return vectorValue(coll).nth(i), true
+		}
+	case ArrayType:
+		if i, ok := elementIndex(key, len(coll.elements)); ok {
+			return coll.elements[i], true
+		}
+	case ListType:
+		if i, ok := elementIndex(key, ListLength(coll)); ok {
+			lst := coll
+			for ; i > 0; i-- {
+				lst = lst.cdr
+			}
+			return lst.car, true
+		}
+	default:
+		if g, ok := coll.Value.(*goObject); ok {
+			if v, err := g.get(key); err == nil {
+				return v, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// elementIndex returns the key as an index into a sequence of n elements, if it is one
+func elementIndex(key *Object, n int) (int, bool) {
+	if !IsNumber(key) || key.fval != float64(int(key.fval)) {
+		return 0, false
+	}
+	i := int(key.fval)
+	return i, i >= 0 && i < n
+}
+
+func assoc(coll *Object, key *Object, val *Object) (*Object, error) {
+	switch coll.Type {
+	case NullType:
+		return NewObject(HashMapType, emptyHashMap.assoc(key, val)), nil
+	case HashMapType:
+		return NewObject(HashMapType, hashMapValue(coll).assoc(key, val)), nil
+	case VectorType:
+		v := vectorValue(coll)
+		if IsNumber(key) && int(key.fval) == v.count {
+			return NewObject(VectorType, v.conj(val)), nil
+		}
+		i, ok := elementIndex(key, v.count)
+		if !ok {
+			return nil, Error(ArgumentErrorKey, "Vector index out of range: ", key)
+		}
+		return NewObject(VectorType, v.assoc(i, val)), nil
+	case StructType:
+		if !IsValidStructKey(key) {
+			return nil, Error(ArgumentErrorKey, "Bad struct key: ", key)
+		}
+		strct := copyStruct(coll, 1)
+		Put(strct, key, val)
+		return strct, nil
+	case ArrayType:
+		i, ok := elementIndex(key, len(coll.elements))
+		if !ok {
+			return nil, Error(ArgumentErrorKey, "Array index out of range")
+		}
+		a := CopyArray(coll)
+		a.elements[i] = val
+		return a, nil
+	}
+	return nil, Error(ArgumentErrorKey, "assoc expected a <hash-map>, <vector>, <struct> or <array>, got a ", coll.Type)
+}
+
+// VM Primitives
+
+func vesperVector(argv []*Object) (*Object, error) {
+	return Vector(argv...), nil
+}
+
+func vesperVectorP(argv []*Object) (*Object, error) {
+	return toVesperBool(argv[0].Type == VectorType)
+}
+
+func vesperToVector(argv []*Object) (*Object, error) {
+	return ToVector(argv[0])
+}
+
+func vesperVectorLength(argv []*Object) (*Object, error) {
+	return Int(int64(vectorValue(argv[0]).count)), nil
+}
+
+func vesperVectorRef(argv []*Object) (*Object, error) {
+	v := vectorValue(argv[0])
+	i, ok := elementIndex(argv[1], v.count)
+	if !ok {
+		return nil, Error(ArgumentErrorKey, "Vector index out of range")
+	}
+	return v.nth(i), nil
+}
+
+func vesperHashMap(argv []*Object) (*Object, error) {
+	return HashMap(argv...)
+}
+
+func vesperHashMapP(argv []*Object) (*Object, error) {
+	return toVesperBool(argv[0].Type == HashMapType)
+}
+
+func vesperToHashMap(argv []*Object) (*Object, error) {
+	return ToHashMap(argv[0])
+}
+
+func vesperHashMapCount(argv []*Object) (*Object, error) {
+	return Int(int64(hashMapValue(argv[0]).count)), nil
+}
+
+func vesperHashMapHasP(argv []*Object) (*Object, error) {
+	_, ok := hashMapValue(argv[0]).get(argv[1])
+	return toVesperBool(ok)
+}
+
+func vesperHashMapKeys(argv []*Object) (*Object, error) {
+	return hashMapValue(argv[0]).entries(func(e *hamtEntry) *Object { return e.key }), nil
+}
+
+func vesperHashMapValues(argv []*Object) (*Object, error) {
+	return hashMapValue(argv[0]).entries(func(e *hamtEntry) *Object { return e.value }), nil
+}
+
+// (assoc coll key val ...) returns a new version of the collection with the keys bound to the values
+func vesperAssoc(argv []*Object) (*Object, error) {
+	if len(argv) < 3 || len(argv)%2 != 1 {
+		return nil, Error(ArgumentErrorKey, "assoc expected a collection and key/value pairs")
+	}
+	coll := argv[0]
+	for i := 1; i < len(argv); i += 2 {
+		var err error
+		coll, err = assoc(coll, argv[i], argv[i+1])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return coll, nil
+}
+
+// (dissoc coll key ...) returns a new version of the hash map or struct without the keys
+func vesperDissoc(argv []*Object) (*Object, error) {
+	if len(argv) < 1 {
+		return nil, Error(ArgumentErrorKey, "dissoc expected at least 1 argument, got none")
+	}
+	coll := argv[0]
+	switch coll.Type {
+	case NullType:
+		return Null, nil
+	case HashMapType:
+		m := hashMapValue(coll)
+		for _, key := range argv[1:] {
+			m = m.dissoc(key)
+		}
+		if m == hashMapValue(coll) {
+			return coll, nil
+		}
+		return NewObject(HashMapType, m), nil
+	case StructType:
+		strct := copyStruct(coll, 0)
+		for _, key := range argv[1:] {
+			Unput(strct, key)
+		}
+		return strct, nil
+	}
+	return nil, Error(ArgumentErrorKey, "dissoc expected a <hash-map> or <struct>, got a ", coll.Type)
+}
+
+// (get-in coll keys default) returns the value found by following the keys into nested collections
+func vesperGetIn(argv []*Object) (*Object, error) {
+	keys, err := ToArray(argv[1])
+	if err != nil {
+		return nil, err
+	}
+	coll := argv[0]
+	for _, key := range keys.elements {
+		v, ok := getElement(coll, key)
+		if !ok {
+			return argv[2], nil
+		}
+		coll = v
+	}
+	return coll, nil
+}
+
+func initPersistentFunctions(vm *VM) {
+	vm.DefineFunctionRestArgs("vector", vesperVector, VectorType, AnyType)
+	vm.DefineFunction("vector?", vesperVectorP, BooleanType, AnyType)
+	vm.DefineFunction("to-vector", vesperToVector, VectorType, AnyType)
+	vm.DefineFunction("vector-length", vesperVectorLength, NumberType, VectorType)
+	vm.DefineFunction("vector-ref", vesperVectorRef, AnyType, VectorType, NumberType)
+	vm.DefineFunctionRestArgs("hash-map", vesperHashMap, HashMapType, AnyType)
+	vm.DefineFunction("hash-map?", vesperHashMapP, BooleanType, AnyType)
+	vm.DefineFunction("to-hash-map", vesperToHashMap, HashMapType, AnyType)
+	vm.DefineFunction("hash-map-count", vesperHashMapCount, NumberType, HashMapType)
+	vm.DefineFunction("hash-map-has?", vesperHashMapHasP, BooleanType, HashMapType, AnyType)
+	vm.DefineFunction("hash-map-keys", vesperHashMapKeys, ListType, HashMapType)
+	vm.DefineFunction("hash-map-values", vesperHashMapValues, ListType, HashMapType)
+	vm.DefineFunctionRestArgs("assoc", vesperAssoc, AnyType, AnyType)
+	vm.DefineFunctionRestArgs("dissoc", vesperDissoc, AnyType, AnyType)
+	vm.DefineFunctionOptionalArgs("get-in", vesperGetIn, AnyType, []*Object{AnyType, AnyType, AnyType}, Null)
+}
@@ -2,25 +2,55 @@ package vesper
 
 // the primitive functions for the languages
 import (
+	"context"
 	"fmt"
 	"math"
 	"os"
+	"strings"
 	"time"
 )
 
 // PrimitiveFunction is the native go function signature for all Vesper primitive functions
 type PrimitiveFunction func(argv []*Object) (*Object, error)
 
+// ContextFunction is the signature of primitive functions that need the context of the evaluation
+// that calls them, so that they can stop blocking when it is cancelled
+type ContextFunction func(ctx context.Context, argv []*Object) (*Object, error)
+
+// vmFunction is the signature of the primitive functions that use the tables or limits of the VM
+// that calls them. They are passed that VM, rather than closing over the one that defined them,
+// since a VM made by CloneVM shares its primitives with the original.
+type vmFunction func(vm *VM, ctx context.Context, argv []*Object) (*Object, error)
+
+// method adapts a primitive function written as a method of the VM to a vmFunction
+func method(m func(vm *VM, argv []*Object) (*Object, error)) vmFunction {
+	return func(vm *VM, _ context.Context, argv []*Object) (*Object, error) {
+		return m(vm, argv)
+	}
+}
+
 // Primitive - a primitive function, written in Go, callable by VM
 type primitive struct { // <function>
 	name      string
 	fun       PrimitiveFunction
 	signature string
-	argc      int       // -1 means the primitive itself checks the args (legacy mode)
-	args      []*Object // if set, the length must be for total args (both required and optional). The type (or <any>) for each
-	rest      *Object   // if set, then any number of this type can follow the normal args. Mutually incompatible with defaults/keys
-	defaults  []*Object // if set, then that many optional args beyond argc have these default values
-	keys      []*Object // if set, then it must match the size of defaults, and these are the keys
+	argc      int             // -1 means the primitive itself checks the args (legacy mode)
+	args      []*Object       // if set, the length must be for total args (both required and optional). The type (or <any>) for each
+	rest      *Object         // if set, then any number of this type can follow the normal args. Mutually incompatible with defaults/keys
+	defaults  []*Object       // if set, then that many optional args beyond argc have these default values
+	keys      []*Object       // if set, then it must match the size of defaults, and these are the keys
+	ctxfun    ContextFunction // if set, then it is called instead of fun
+	vmfun     vmFunction      // if set, then it is called with the calling VM instead of fun
+}
+
+func (prim *primitive) call(vm *VM, ctx context.Context, argv []*Object) (*Object, error) {
+	if prim.vmfun != nil {
+		return prim.vmfun(vm, ctx, argv)
+	}
+	if prim.ctxfun != nil {
+		return prim.ctxfun(ctx, argv)
+	}
+	return prim.fun(argv)
 }
 
 // Primitive creates a primitive function
@@ -53,16 +83,17 @@ func Primitive(name string, fun PrimitiveFunction, result *Object, args []*Objec
 		}
 	}
 	signature := functionSignatureFromTypes(result, args, rest)
-	prim := &primitive{name, fun, signature, argc, args, rest, defaults, keys}
+	prim := &primitive{name, fun, signature, argc, args, rest, defaults, keys, nil, nil}
 	return &Object{Type: FunctionType, primitive: prim}
 }
 
 // InitPrimitives defines the global functions/variables/macros for the top level environment
 func (vm *VM) InitPrimitives() {
-	vm.DefineMacro("let", vm.vesperLet)
-	vm.DefineMacro("letrec", vm.vesperLetrec)
-	vm.DefineMacro("cond", vm.vesperCond)
-	vm.DefineMacro("quasiquote", vm.vesperQuasiquote)
+	vm.defineMacroMethod("let", (*VM).vesperLet)
+	vm.defineMacroMethod("letrec", (*VM).vesperLetrec)
+	vm.defineMacroMethod("cond", (*VM).vesperCond)
+	vm.defineMacroMethod("quasiquote", (*VM).vesperQuasiquote)
+	vm.defineMacroMethod("syntax-rules", (*VM).vesperSyntaxRules)
 
 	vm.DefineGlobal("null", Null)
 	vm.DefineGlobal("true", True)
@@ -72,26 +103,28 @@ func (vm *VM) InitPrimitives() {
 	vm.DefineGlobal("callcc", CallCC)
 	vm.DefineGlobal("go", GoFunc)
 
-	vm.DefineFunction("globals", vm.vesperGlobals, ArrayType)
-	vm.DefineFunction("version", vm.vesperVersion, StringType)
+	vm.defineMethod("globals", method((*VM).vesperGlobals), ArrayType, nil, nil, nil, nil)
+	vm.defineMethod("version", method((*VM).vesperVersion), StringType, nil, nil, nil, nil)
 	vm.DefineFunction("boolean?", vesperBooleanP, BooleanType, AnyType)
 	vm.DefineFunction("not", vesperNot, BooleanType, AnyType)
 	vm.DefineFunction("equal?", vesperEqualP, BooleanType, AnyType, AnyType)
 	vm.DefineFunction("identical?", vesperIdenticalP, BooleanType, AnyType, AnyType)
 	vm.DefineFunction("null?", vesperNullP, BooleanType, AnyType)
-	vm.DefineFunction("def?", vesperDefinedP, BooleanType, SymbolType)
+	vm.defineMethod("def?", method((*VM).vesperDefinedP), BooleanType, []*Object{SymbolType}, nil, nil, nil)
 
 	vm.DefineFunction("type", vesperType, TypeType, AnyType)
 	vm.DefineFunction("value", vesperValue, AnyType, AnyType)
 	vm.DefineFunction("instance", vesperInstance, AnyType, TypeType, AnyType)
 
 	vm.DefineFunction("type?", vesperTypeP, BooleanType, AnyType)
-	vm.DefineFunction("type-name", vm.vesperTypeName, SymbolType, TypeType)
+	vm.defineMethod("type-name", method((*VM).vesperTypeName), SymbolType, []*Object{TypeType}, nil, nil, nil)
 	vm.DefineFunction("keyword?", vesperKeywordP, BooleanType, AnyType)
-	vm.DefineFunction("keyword-name", vm.vesperKeywordName, SymbolType, KeywordType)
-	vm.DefineFunction("to-keyword", vm.vesperToKeyword, KeywordType, AnyType)
+	vm.defineMethod("keyword-name", method((*VM).vesperKeywordName), SymbolType, []*Object{KeywordType}, nil, nil, nil)
+	vm.defineMethod("to-keyword", method((*VM).vesperToKeyword), KeywordType, []*Object{AnyType}, nil, nil, nil)
 	vm.DefineFunction("symbol?", vesperSymbolP, BooleanType, AnyType)
-	vm.DefineFunctionRestArgs("symbol", vm.vesperSymbol, SymbolType, AnyType, AnyType)
+	vm.defineMethod("symbol", method((*VM).vesperSymbol), SymbolType, []*Object{AnyType}, AnyType, []*Object{}, nil)
+	vm.DefineFunctionOptionalArgs("gensym", vesperGensym, SymbolType, []*Object{StringType}, String("G__"))
+	vm.defineMethod("make-syntax-rules", method((*VM).vesperMakeSyntaxRules), FunctionType, []*Object{ListType, ListType}, nil, nil, nil)
 
 	vm.DefineFunctionRestArgs("string?", vesperStringP, BooleanType, AnyType)
 	vm.DefineFunctionRestArgs("string", vesperString, StringType, AnyType)
@@ -102,36 +135,54 @@ func (vm *VM) InitPrimitives() {
 	vm.DefineFunction("character?", vesperCharacterP, BooleanType, AnyType)
 	vm.DefineFunction("to-character", vesperToCharacter, CharacterType, AnyType)
 	vm.DefineFunction("substring", vesperSubstring, StringType, StringType, NumberType, NumberType)
+	vm.DefineFunction("string-ref", vesperStringRef, CharacterType, StringType, NumberType)
+	vm.DefineFunction("string-upcase", vesperStringUpcase, StringType, StringType)
+	vm.DefineFunction("string-downcase", vesperStringDowncase, StringType, StringType)
+	vm.DefineFunction("string-trim", vesperStringTrim, StringType, StringType)
+	vm.DefineFunction("string-index", vesperStringIndex, NumberType, StringType, StringType)
+	vm.DefineFunction("string-contains?", vesperStringContainsP, BooleanType, StringType, StringType)
+	vm.DefineFunction("string-starts-with?", vesperStringStartsWithP, BooleanType, StringType, StringType)
+	vm.DefineFunction("string-ends-with?", vesperStringEndsWithP, BooleanType, StringType, StringType)
+	vm.DefineFunction("string-replace", vesperStringReplace, StringType, StringType, StringType, StringType)
 
 	vm.DefineFunction("blob?", vesperBlobP, BooleanType, AnyType)
 	vm.DefineFunction("to-blob", vesperToBlob, BlobType, AnyType)
-	vm.DefineFunction("make-blob", vesperMakeBlob, BlobType, NumberType)
+	vm.defineMethod("make-blob", method((*VM).vesperMakeBlob), BlobType, []*Object{NumberType}, nil, nil, nil)
 	vm.DefineFunction("blob-length", vesperBlobLength, NumberType, BlobType)
 	vm.DefineFunction("blob-ref", vesperBlobRef, NumberType, BlobType, NumberType)
 
 	vm.DefineFunction("number?", vesperNumberP, BooleanType, AnyType)
 	vm.DefineFunction("int?", vesperIntP, BooleanType, AnyType)
 	vm.DefineFunction("float?", vesperFloatP, BooleanType, AnyType)
+	vm.DefineFunction("exact?", vesperExactP, BooleanType, AnyType)
+	vm.DefineFunction("ratio?", vesperRatioP, BooleanType, AnyType)
+	vm.DefineFunction("rational?", vesperRationalP, BooleanType, AnyType)
 	vm.DefineFunction("to-number", vesperToNumber, NumberType, AnyType)
 	vm.DefineFunction("int", vesperInt, NumberType, AnyType)
+	vm.DefineFunction("exact", vesperExact, NumberType, NumberType)
+	vm.DefineFunction("inexact", vesperInexact, NumberType, NumberType)
 	vm.DefineFunction("floor", vesperFloor, NumberType, NumberType)
 	vm.DefineFunction("ceiling", vesperCeiling, NumberType, NumberType)
 	vm.DefineFunction("inc", vesperInc, NumberType, NumberType)
 	vm.DefineFunction("dec", vesperDec, NumberType, NumberType)
-	vm.DefineFunction("+", vesperAdd, NumberType, NumberType, NumberType)
-	vm.DefineFunction("-", vesperSub, NumberType, NumberType, NumberType)
-	vm.DefineFunction("*", vesperMul, NumberType, NumberType, NumberType)
-	vm.DefineFunction("/", vesperDiv, NumberType, NumberType, NumberType)
+	vm.DefineFunctionRestArgs("+", vesperAdd, NumberType, NumberType)
+	vm.DefineFunctionRestArgs("-", vesperSub, NumberType, NumberType, NumberType)
+	vm.DefineFunctionRestArgs("*", vesperMul, NumberType, NumberType)
+	vm.DefineFunctionRestArgs("/", vesperDiv, NumberType, NumberType, NumberType)
 	vm.DefineFunction("quotient", vesperQuotient, NumberType, NumberType, NumberType)
 	vm.DefineFunction("remainder", vesperRemainder, NumberType, NumberType, NumberType)
 	vm.DefineFunction("modulo", vesperRemainder, NumberType, NumberType, NumberType)
-	vm.DefineFunction("=", vesperNumEqual, BooleanType, NumberType, NumberType)
-	vm.DefineFunction("<=", vesperNumLessEqual, BooleanType, NumberType, NumberType)
-	vm.DefineFunction(">=", vesperNumGreaterEqual, BooleanType, NumberType, NumberType)
-	vm.DefineFunction(">", vesperNumGreater, BooleanType, NumberType, NumberType)
-	vm.DefineFunction("<", vesperNumLess, BooleanType, NumberType, NumberType)
+	vm.DefineFunctionRestArgs("=", vesperNumEqual, BooleanType, NumberType, NumberType)
+	vm.DefineFunctionRestArgs("<=", vesperNumLessEqual, BooleanType, NumberType, NumberType)
+	vm.DefineFunctionRestArgs(">=", vesperNumGreaterEqual, BooleanType, NumberType, NumberType)
+	vm.DefineFunctionRestArgs(">", vesperNumGreater, BooleanType, NumberType, NumberType)
+	vm.DefineFunctionRestArgs("<", vesperNumLess, BooleanType, NumberType, NumberType)
 	vm.DefineFunction("zero?", vesperZeroP, BooleanType, NumberType)
+	vm.DefineFunctionRestArgs("min", vesperMin, NumberType, NumberType, NumberType)
+	vm.DefineFunctionRestArgs("max", vesperMax, NumberType, NumberType, NumberType)
 	vm.DefineFunction("abs", vesperAbs, NumberType, NumberType)
+	vm.DefineFunction("sqrt", vesperSqrt, NumberType, NumberType)
+	vm.DefineFunction("pow", vesperPow, NumberType, NumberType, NumberType)
 	vm.DefineFunction("exp", vesperExp, NumberType, NumberType)
 	vm.DefineFunction("log", vesperLog, NumberType, NumberType)
 	vm.DefineFunction("sin", vesperSin, NumberType, NumberType)
@@ -145,7 +196,6 @@ func (vm *VM) InitPrimitives() {
 	vm.DefineFunction("seal!", vesperSeal, AnyType, AnyType)
 
 	vm.DefineFunction("list?", vesperListP, BooleanType, AnyType)
-	vm.DefineFunction("empty?", vesperEmptyP, BooleanType, ListType)
 	vm.DefineFunction("to-list", vesperToList, ListType, AnyType)
 	vm.DefineFunction("cons", vesperCons, ListType, AnyType, ListType)
 	vm.DefineFunction("car", vesperCar, AnyType, ListType)
@@ -161,7 +211,7 @@ func (vm *VM) InitPrimitives() {
 	vm.DefineFunction("array?", vesperArrayP, BooleanType, AnyType)
 	vm.DefineFunction("to-array", vesperToArray, ArrayType, AnyType)
 	vm.DefineFunctionRestArgs("array", vesperArray, ArrayType, AnyType)
-	vm.DefineFunctionOptionalArgs("make-array", vesperMakeArray, ArrayType, []*Object{NumberType, AnyType}, Null)
+	vm.defineMethod("make-array", method((*VM).vesperMakeArray), ArrayType, []*Object{NumberType, AnyType}, nil, []*Object{Null}, nil)
 	vm.DefineFunction("array-length", vesperArrayLength, NumberType, ArrayType)
 	vm.DefineFunction("array-ref", vesperArrayRef, AnyType, ArrayType, NumberType)
 	vm.DefineFunction("array-set!", vesperArraySetBang, NullType, ArrayType, NumberType, AnyType)
@@ -169,10 +219,10 @@ func (vm *VM) InitPrimitives() {
 	vm.DefineFunction("struct?", vesperStructP, BooleanType, AnyType)
 	vm.DefineFunction("to-struct", vesperToStruct, StructType, AnyType)
 	vm.DefineFunctionRestArgs("struct", vesperStruct, StructType, AnyType)
-	vm.DefineFunction("make-struct", vesperMakeStruct, StructType, NumberType)
+	vm.defineMethod("make-struct", method((*VM).vesperMakeStruct), StructType, []*Object{NumberType}, nil, nil, nil)
 	vm.DefineFunction("struct-length", vesperStructLength, NumberType, StructType)
-	vm.DefineFunction("has?", vesperHasP, BooleanType, StructType, AnyType)
-	vm.DefineFunction("get", vesperGet, AnyType, StructType, AnyType)
+	vm.DefineFunction("has?", vesperHasP, BooleanType, AnyType, AnyType)
+	vm.DefineFunction("get", vesperGet, AnyType, AnyType, AnyType)
 	vm.DefineFunction("put!", vesperPutBang, NullType, StructType, AnyType, AnyType)
 	vm.DefineFunction("unput!", vesperUnputBang, NullType, StructType, AnyType)
 	vm.DefineFunction("keys", vesperKeys, ListType, AnyType)
@@ -180,31 +230,35 @@ func (vm *VM) InitPrimitives() {
 
 	vm.DefineFunction("function?", vesperFunctionP, BooleanType, AnyType)
 	vm.DefineFunction("function-signature", vesperFunctionSignature, StringType, FunctionType)
-	vm.DefineFunctionRestArgs("validate-keyword-arg-list", vm.vesperValidateKeywordArgList, ListType, KeywordType, ListType)
+	vm.defineMethod("validate-keyword-arg-list", method((*VM).vesperValidateKeywordArgList), ListType, []*Object{ListType}, KeywordType, []*Object{}, nil)
 	vm.DefineFunction("slurp", vesperSlurp, StringType, StringType)
-	vm.DefineFunctionKeyArgs("read", vm.vesperRead, AnyType, []*Object{StringType, TypeType}, []*Object{AnyType}, []*Object{vm.Intern("keys:")})
-	vm.DefineFunctionKeyArgs("read-all", vm.vesperReadAll, AnyType, []*Object{StringType, TypeType}, []*Object{AnyType}, []*Object{vm.Intern("keys:")})
+	vm.defineMethod("read", method((*VM).vesperRead), AnyType, []*Object{StringType, TypeType}, nil, []*Object{AnyType}, []*Object{vm.Intern("keys:")})
+	vm.defineMethod("read-all", method((*VM).vesperReadAll), AnyType, []*Object{StringType, TypeType}, nil, []*Object{AnyType}, []*Object{vm.Intern("keys:")})
 	vm.DefineFunction("spit", vesperSpit, NullType, StringType, StringType)
 	vm.DefineFunctionKeyArgs("write", vesperWrite, NullType, []*Object{AnyType, StringType}, []*Object{EmptyString}, []*Object{vm.Intern("indent:")})
 	vm.DefineFunctionKeyArgs("write-all", vesperWriteAll, NullType, []*Object{AnyType, StringType}, []*Object{EmptyString}, []*Object{vm.Intern("indent:")})
 	vm.DefineFunctionRestArgs("print", vesperPrint, NullType, AnyType)
 	vm.DefineFunctionRestArgs("println", vesperPrintln, NullType, AnyType)
-	vm.DefineFunction("macroexpand", vm.vesperMacroexpand, AnyType, AnyType)
-	vm.DefineFunction("compile", vm.vesperCompile, CodeType, AnyType)
+	vm.defineMethod("macroexpand", method((*VM).vesperMacroexpand), AnyType, []*Object{AnyType}, nil, nil, nil)
+	vm.defineMethod("compile", method((*VM).vesperCompile), CodeType, []*Object{AnyType}, nil, nil, nil)
 
 	vm.DefineFunctionRestArgs("make-error", vesperMakeError, ErrorType, AnyType)
 	vm.DefineFunction("error?", vesperErrorP, BooleanType, AnyType)
 	vm.DefineFunction("error-data", vesperErrorData, AnyType, ErrorType)
+	vm.DefineFunction("error-key", vesperErrorKey, KeywordType, ErrorType)
+	vm.defineMethod("error-trace", method((*VM).vesperErrorTrace), ListType, []*Object{ErrorType}, nil, nil, nil)
+	vm.DefineFunction("error-matches?", vesperErrorMatchesP, BooleanType, ErrorType, ListType)
+	vm.DefineFunctionRestArgs("throw", vesperThrow, NullType, AnyType, AnyType)
 	vm.DefineFunction("uncaught-error", vesperUncaughtError, NullType, ErrorType)
 
 	vm.DefineFunctionKeyArgs("json", vesperJSON, StringType, []*Object{AnyType, StringType}, []*Object{EmptyString}, []*Object{vm.Intern("indent:")})
 
-	vm.DefineFunctionRestArgs("getfn", vm.vesperGetFn, FunctionType, AnyType, SymbolType)
-	vm.DefineFunction("method-signature", vm.vesperMethodSignature, TypeType, ListType)
+	vm.defineMethod("getfn", method((*VM).vesperGetFn), FunctionType, []*Object{SymbolType}, AnyType, []*Object{}, nil)
+	vm.defineMethod("method-signature", method((*VM).vesperMethodSignature), TypeType, []*Object{ListType}, nil, nil, nil)
 
 	vm.DefineFunction("now", vesperNow, NumberType)
 	vm.DefineFunction("since", vesperSince, NumberType, NumberType)
-	vm.DefineFunction("sleep", vesperSleep, NumberType, NumberType)
+	vm.DefineContextFunction("sleep", vesperSleep, NumberType, []*Object{NumberType})
 
 	vm.DefineFunction("set-random-seed!", vesperSetRandomSeedBang, NullType, NumberType)
 	vm.DefineFunctionRestArgs("random", vesperRandom, NumberType, NumberType)
@@ -212,9 +266,15 @@ func (vm *VM) InitPrimitives() {
 	vm.DefineFunction("timestamp", vesperTimestamp, StringType)
 
 	vm.DefineFunction("getenv", vesperGetenv, StringType, StringType)
-	vm.DefineFunction("load", vm.vesperLoad, StringType, AnyType)
+	vm.defineMethod("load", method((*VM).vesperLoad), StringType, []*Object{AnyType}, nil, nil, nil)
 
 	initChannelFunctions(vm)
+	initTaskFunctions(vm)
+	initAtomFunctions(vm)
+	initHashtableFunctions(vm)
+	initPersistentFunctions(vm)
+	initSequenceFunctions(vm)
+	initLibraryFunctions(vm)
 
 	err := vm.Load("vesper")
 	if err != nil {
@@ -259,8 +319,8 @@ func (vm *VM) vesperVersion(_ []*Object) (*Object, error) {
 	return String(s), nil
 }
 
-func vesperDefinedP(argv []*Object) (*Object, error) {
-	return toVesperBool(IsDefined(argv[0]))
+func (vm *VM) vesperDefinedP(argv []*Object) (*Object, error) {
+	return toVesperBool(vm.IsDefined(argv[0]))
 }
 
 func vesperSlurp(argv []*Object) (*Object, error) {
@@ -330,8 +390,12 @@ func vesperStruct(argv []*Object) (*Object, error) {
 	return Struct(argv)
 }
 
-func vesperMakeStruct(argv []*Object) (*Object, error) {
-	return MakeStruct(int(argv[0].fval)), nil
+func (vm *VM) vesperMakeStruct(argv []*Object) (*Object, error) {
+	size := int(argv[0].fval)
+	if err := vm.checkCollectionSize(size); err != nil {
+		return nil, err
+	}
+	return MakeStruct(size), nil
 }
 
 func vesperToStruct(argv []*Object) (*Object, error) {
@@ -347,23 +411,33 @@ func vesperEqualP(argv []*Object) (*Object, error) {
 }
 
 func vesperNumEqual(argv []*Object) (*Object, error) {
-	return toVesperBool(NumberEqual(argv[0].fval, argv[1].fval))
+	return numberChain(argv, func(c int) bool { return c == 0 })
 }
 
 func vesperNumLess(argv []*Object) (*Object, error) {
-	return toVesperBool(argv[0].fval < argv[1].fval)
+	return numberChain(argv, func(c int) bool { return c < 0 })
 }
 
 func vesperNumLessEqual(argv []*Object) (*Object, error) {
-	return toVesperBool(argv[0].fval <= argv[1].fval)
+	return numberChain(argv, func(c int) bool { return c <= 0 })
 }
 
 func vesperNumGreater(argv []*Object) (*Object, error) {
-	return toVesperBool(argv[0].fval > argv[1].fval)
+	return numberChain(argv, func(c int) bool { return c > 0 })
 }
 
 func vesperNumGreaterEqual(argv []*Object) (*Object, error) {
-	return toVesperBool(argv[0].fval >= argv[1].fval)
+	return numberChain(argv, func(c int) bool { return c >= 0 })
+}
+
+// numberChain compares each adjacent pair of arguments, and is true if the test holds for all of them
+func numberChain(argv []*Object, test func(int) bool) (*Object, error) {
+	for i := 1; i < len(argv); i++ {
+		if !test(numberCompare(argv[i-1], argv[i])) {
+			return False, nil
+		}
+	}
+	return True, nil
 }
 
 func vesperWrite(argv []*Object) (*Object, error) {
@@ -386,6 +460,28 @@ func vesperErrorData(argv []*Object) (*Object, error) {
 	return ErrorData(argv[0]), nil
 }
 
+func vesperErrorKey(argv []*Object) (*Object, error) {
+	return ErrorKeyword(argv[0]), nil
+}
+
+func (vm *VM) vesperErrorTrace(argv []*Object) (*Object, error) {
+	return vm.errorTraceList(argv[0]), nil
+}
+
+func vesperErrorMatchesP(argv []*Object) (*Object, error) {
+	return toVesperBool(ErrorMatches(argv[0], argv[1]))
+}
+
+func vesperThrow(argv []*Object) (*Object, error) {
+	if IsError(argv[0]) && len(argv) == 1 {
+		return nil, argv[0]
+	}
+	if IsKeyword(argv[0]) {
+		return nil, MakeError(argv...)
+	}
+	return nil, Error(ArgumentErrorKey, "throw expected an <error> or a <keyword>, got a ", argv[0].Type)
+}
+
 func vesperUncaughtError(argv []*Object) (*Object, error) {
 	return nil, argv[0]
 }
@@ -443,7 +539,7 @@ func vesperList(argv []*Object) (*Object, error) {
 }
 
 func vesperListLength(argv []*Object) (*Object, error) {
-	return Number(float64(ListLength(argv[0]))), nil
+	return Int(int64(ListLength(argv[0]))), nil
 }
 
 func vesperNumberP(argv []*Object) (*Object, error) {
@@ -466,58 +562,122 @@ func vesperInt(argv []*Object) (*Object, error) {
 	return ToInt(argv[0])
 }
 
+func vesperExactP(argv []*Object) (*Object, error) {
+	return toVesperBool(IsExact(argv[0]))
+}
+
+func vesperRatioP(argv []*Object) (*Object, error) {
+	return toVesperBool(IsRatio(argv[0]))
+}
+
+func vesperRationalP(argv []*Object) (*Object, error) {
+	return toVesperBool(IsExact(argv[0]))
+}
+
+func vesperExact(argv []*Object) (*Object, error) {
+	return ToExact(argv[0])
+}
+
+func vesperInexact(argv []*Object) (*Object, error) {
+	return ToInexact(argv[0]), nil
+}
+
 func vesperFloor(argv []*Object) (*Object, error) {
-	return Number(math.Floor(argv[0].fval)), nil
+	return numberFloor(argv[0]), nil
 }
 
 func vesperCeiling(argv []*Object) (*Object, error) {
-	return Number(math.Ceil(argv[0].fval)), nil
+	return numberCeiling(argv[0]), nil
 }
 
 func vesperInc(argv []*Object) (*Object, error) {
-	return Number(argv[0].fval + 1), nil
+	return numberAdd(argv[0], One), nil
 }
 
 func vesperDec(argv []*Object) (*Object, error) {
-	return Number(argv[0].fval - 1), nil
+	return numberSub(argv[0], One), nil
 }
 
 func vesperAdd(argv []*Object) (*Object, error) {
-	return Number(argv[0].fval + argv[1].fval), nil
+	sum := Zero
+	for _, n := range argv {
+		sum = numberAdd(sum, n)
+	}
+	return sum, nil
 }
 
 func vesperSub(argv []*Object) (*Object, error) {
-	return Number(argv[0].fval - argv[1].fval), nil
+	if len(argv) == 1 {
+		return numberNegate(argv[0]), nil
+	}
+	diff := argv[0]
+	for _, n := range argv[1:] {
+		diff = numberSub(diff, n)
+	}
+	return diff, nil
 }
 
 func vesperMul(argv []*Object) (*Object, error) {
-	return Number(argv[0].fval * argv[1].fval), nil
+	product := One
+	for _, n := range argv {
+		product = numberMul(product, n)
+	}
+	return product, nil
 }
 
 func vesperDiv(argv []*Object) (*Object, error) {
-	return Number(argv[0].fval / argv[1].fval), nil
+	if len(argv) == 1 {
+		return numberDiv(One, argv[0])
+	}
+	quotient := argv[0]
+	for _, n := range argv[1:] {
+		var err error
+		quotient, err = numberDiv(quotient, n)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return quotient, nil
 }
 
 func vesperQuotient(argv []*Object) (*Object, error) {
-	denom := int64(argv[1].fval)
-	if denom == 0 {
-		return nil, Error(ArgumentErrorKey, "quotient: divide by zero")
-	}
-	n := int64(argv[0].fval) / denom
-	return Number(float64(n)), nil
+	return numberQuotient(argv[0], argv[1])
 }
 
 func vesperRemainder(argv []*Object) (*Object, error) {
-	denom := int64(argv[1].fval)
-	if denom == 0 {
-		return nil, Error(ArgumentErrorKey, "remainder: divide by zero")
-	}
-	n := int64(argv[0].fval) % denom
-	return Number(float64(n)), nil
+	return numberRemainder(argv[0], argv[1])
 }
 
 func vesperAbs(argv []*Object) (*Object, error) {
-	return Number(math.Abs(argv[0].fval)), nil
+	return numberAbs(argv[0]), nil
+}
+
+func vesperMin(argv []*Object) (*Object, error) {
+	min := argv[0]
+	for _, n := range argv[1:] {
+		if numberCompare(n, min) < 0 {
+			min = n
+		}
+	}
+	return min, nil
+}
+
+func vesperMax(argv []*Object) (*Object, error) {
+	max := argv[0]
+	for _, n := range argv[1:] {
+		if numberCompare(n, max) > 0 {
+			max = n
+		}
+	}
+	return max, nil
+}
+
+func vesperSqrt(argv []*Object) (*Object, error) {
+	return numberSqrt(argv[0]), nil
+}
+
+func vesperPow(argv []*Object) (*Object, error) {
+	return numberPow(argv[0], argv[1])
 }
 
 func vesperExp(argv []*Object) (*Object, error) {
@@ -564,8 +724,11 @@ func vesperToArray(argv []*Object) (*Object, error) {
 	return ToArray(argv[0])
 }
 
-func vesperMakeArray(argv []*Object) (*Object, error) {
+func (vm *VM) vesperMakeArray(argv []*Object) (*Object, error) {
 	vlen := int(argv[0].fval)
+	if err := vm.checkCollectionSize(vlen); err != nil {
+		return nil, err
+	}
 	init := argv[1]
 	return MakeArray(vlen, init), nil
 }
@@ -575,7 +738,7 @@ func vesperArrayP(argv []*Object) (*Object, error) {
 }
 
 func vesperArrayLength(argv []*Object) (*Object, error) {
-	return Number(float64(len(argv[0].elements))), nil
+	return Int(int64(len(argv[0].elements))), nil
 }
 
 func vesperArrayRef(argv []*Object) (*Object, error) {
@@ -602,7 +765,7 @@ func vesperArraySetBang(argv []*Object) (*Object, error) {
 }
 
 func vesperZeroP(argv []*Object) (*Object, error) {
-	return toVesperBool(NumberEqual(argv[0].fval, 0.0))
+	return toVesperBool(numberIsZero(argv[0]))
 }
 
 func vesperNot(argv []*Object) (*Object, error) {
@@ -677,6 +840,59 @@ func vesperSubstring(argv []*Object) (*Object, error) {
 	return String(s[start:end]), nil
 }
 
+func vesperStringRef(argv []*Object) (*Object, error) {
+	s := argv[0].text
+	idx := int(argv[1].fval)
+	if idx >= 0 {
+		for _, r := range s {
+			if idx == 0 {
+				return Character(r), nil
+			}
+			idx--
+		}
+	}
+	return nil, Error(ArgumentErrorKey, "string-ref index out of range: ", argv[1])
+}
+
+func vesperStringUpcase(argv []*Object) (*Object, error) {
+	return String(strings.ToUpper(argv[0].text)), nil
+}
+
+func vesperStringDowncase(argv []*Object) (*Object, error) {
+	return String(strings.ToLower(argv[0].text)), nil
+}
+
+func vesperStringTrim(argv []*Object) (*Object, error) {
+	return String(strings.TrimSpace(argv[0].text)), nil
+}
+
+// vesperStringIndex returns the index in characters of the first occurrence of the substring,
+// or -1 if there is none
+func vesperStringIndex(argv []*Object) (*Object, error) {
+	s := argv[0].text
+	i := strings.Index(s, argv[1].text)
+	if i < 0 {
+		return MinusOne, nil
+	}
+	return Int(int64(StringLength(s[:i]))), nil
+}
+
+func vesperStringContainsP(argv []*Object) (*Object, error) {
+	return toVesperBool(strings.Contains(argv[0].text, argv[1].text))
+}
+
+func vesperStringStartsWithP(argv []*Object) (*Object, error) {
+	return toVesperBool(strings.HasPrefix(argv[0].text, argv[1].text))
+}
+
+func vesperStringEndsWithP(argv []*Object) (*Object, error) {
+	return toVesperBool(strings.HasSuffix(argv[0].text, argv[1].text))
+}
+
+func vesperStringReplace(argv []*Object) (*Object, error) {
+	return String(strings.ReplaceAll(argv[0].text, argv[1].text, argv[2].text)), nil
+}
+
 func vesperFunctionP(argv []*Object) (*Object, error) {
 	return toVesperBool(IsFunction(argv[0]))
 }
@@ -689,10 +905,6 @@ func vesperListP(argv []*Object) (*Object, error) {
 	return toVesperBool(IsList(argv[0]))
 }
 
-func vesperEmptyP(argv []*Object) (*Object, error) {
-	return toVesperBool(argv[0] == EmptyList)
-}
-
 func vesperString(argv []*Object) (*Object, error) {
 	s := ""
 	for _, ss := range argv {
@@ -702,7 +914,7 @@ func vesperString(argv []*Object) (*Object, error) {
 }
 
 func vesperStringLength(argv []*Object) (*Object, error) {
-	return Number(float64(StringLength(argv[0].text))), nil
+	return Int(int64(StringLength(argv[0].text))), nil
 }
 
 func vesperCar(argv []*Object) (*Object, error) {
@@ -756,11 +968,11 @@ func vesperStructP(argv []*Object) (*Object, error) {
 }
 
 func vesperGet(argv []*Object) (*Object, error) {
-	return structGet(argv[0], argv[1]), nil
+	return Get(argv[0], argv[1])
 }
 
 func vesperStructLength(argv []*Object) (*Object, error) {
-	return Number(float64(StructLength(argv[0]))), nil
+	return Int(int64(StructLength(argv[0]))), nil
 }
 
 func vesperHasP(argv []*Object) (*Object, error) {
@@ -882,13 +1094,16 @@ func vesperToBlob(argv []*Object) (*Object, error) {
 	return ToBlob(argv[0])
 }
 
-func vesperMakeBlob(argv []*Object) (*Object, error) {
+func (vm *VM) vesperMakeBlob(argv []*Object) (*Object, error) {
 	size := int(argv[0].fval)
+	if err := vm.checkCollectionSize(size); err != nil {
+		return nil, err
+	}
 	return MakeBlob(size), nil
 }
 
 func vesperBlobLength(argv []*Object) (*Object, error) {
-	return Number(float64(len(BlobValue(argv[0])))), nil
+	return Int(int64(len(BlobValue(argv[0])))), nil
 }
 
 func vesperBlobRef(argv []*Object) (*Object, error) {
@@ -897,7 +1112,7 @@ func vesperBlobRef(argv []*Object) (*Object, error) {
 	if idx < 0 || idx >= len(el) {
 		return nil, Error(ArgumentErrorKey, "Blob index out of range")
 	}
-	return Number(float64(el[idx])), nil
+	return Int(int64(el[idx])), nil
 }
 
 func vesperNow(_ []*Object) (*Object, error) {
@@ -910,8 +1125,10 @@ func vesperSince(argv []*Object) (*Object, error) {
 	return Number(dur), nil
 }
 
-func vesperSleep(argv []*Object) (*Object, error) {
-	Sleep(argv[0].fval)
+func vesperSleep(ctx context.Context, argv []*Object) (*Object, error) {
+	if err := SleepContext(ctx, argv[0].fval); err != nil {
+		return nil, interruptError(ctx)
+	}
 	return Number(Now()), nil
 }
 
@@ -1,6 +1,7 @@
 package vesper
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"os"
@@ -19,14 +20,19 @@ const (
 )
 
 type replHandler struct {
-	rl   *readline.Instance
-	vm   *VM
-	line string
-	cmds []string
+	rl         *readline.Instance
+	vm         *VM
+	line       string
+	cmds       []string
+	interrupts chan os.Signal
 }
 
 func (repl *replHandler) Eval(expr string) (string, bool, error) {
-	interrupted = false
+	// discard any interrupt that arrived while no expression was being evaluated
+	select {
+	case <-repl.interrupts:
+	default:
+	}
 	repl.cmds = append(repl.cmds, expr)
 	whole := strings.Trim(strings.Join(repl.cmds, " "), " ")
 
@@ -53,7 +59,16 @@ func (repl *replHandler) Eval(expr string) (string, bool, error) {
 		return "", false, err
 	}
 
-	val, err := repl.vm.Eval(lexpr)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-repl.interrupts:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	val, err := repl.vm.EvalContext(ctx, lexpr)
 	if err != nil {
 		return "", false, err
 	}
@@ -81,7 +96,7 @@ func (repl *replHandler) Prompt(more bool) string {
 	if more {
 		promptType = "*prompt-cont*"
 	}
-	prompt := GetGlobal(repl.vm.Intern(promptType))
+	prompt := repl.vm.GetGlobal(repl.vm.Intern(promptType))
 	if prompt != nil {
 		return prompt.String()
 	}
@@ -95,11 +110,12 @@ func (repl *replHandler) Prompt(more bool) string {
 func REPL(vm *VM) error {
 	var err error
 
-	interrupts = make(chan os.Signal, 1)
+	interrupts := make(chan os.Signal, 1)
 	signal.Notify(interrupts, os.Interrupt)
 	defer signal.Stop(interrupts)
 	repl := replHandler{
-		vm: vm,
+		vm:         vm,
+		interrupts: interrupts,
 	}
 
 	repl.rl, err = readline.NewEx(&readline.Config{
@@ -0,0 +1,272 @@
+package vesper
+
+import (
+	"math"
+	"unicode/utf8"
+)
+
+// The sequence functions treat every collection as a sequence of elements: lists, arrays and
+// vectors of their elements, strings of their characters, blobs of their bytes, and structs,
+// hash maps and hash tables of (key value) lists, in an order that is the same each time, so
+// that first and rest agree. null is the empty sequence. The values of extension objects take
+// part by implementing Sequence.
+
+func sequenceValue(obj *Object) (Sequence, bool) {
+	s, ok := obj.Value.(Sequence)
+	return s, ok
+}
+
+// IsSequence returns true if the object is a collection that the sequence functions accept
+func IsSequence(obj *Object) bool {
+	switch obj.Type {
+	case NullType, ListType, ArrayType, StringType, BlobType, StructType, HashtableType:
+		return true
+	}
+	_, ok := sequenceValue(obj)
+	return ok
+}
+
+func notSequenceError(name string, obj *Object) error {
+	return Error(ArgumentErrorKey, name, " expected a sequence, got a ", obj.Type)
+}
+
+// Seq returns the elements of the sequence as a list
+func Seq(obj *Object) (*Object, error) {
+	if obj == Null {
+		return EmptyList, nil
+	}
+	if !IsSequence(obj) {
+		return nil, notSequenceError("seq", obj)
+	}
+	return ToList(obj)
+}
+
+// Count returns the number of elements in the sequence
+func Count(obj *Object) (int, error) {
+	switch obj.Type {
+	case NullType:
+		return 0, nil
+	case ListType:
+		return ListLength(obj), nil
+	case ArrayType:
+		return len(obj.elements), nil
+	case StringType:
+		return utf8.RuneCountInString(obj.text), nil
+	case BlobType:
+		return len(BlobValue(obj)), nil
+	case StructType:
+		return len(obj.bindings), nil
+	case HashtableType:
+		return hashtableValue(obj).count, nil
+	}
+	if s, ok := sequenceValue(obj); ok {
+		return s.Count(), nil
+	}
+	return 0, notSequenceError("count", obj)
+}
+
+// IsEmpty returns true if the sequence has no elements
+func IsEmpty(obj *Object) (bool, error) {
+	switch obj.Type {
+	case ListType:
+		return obj == EmptyList, nil
+	case StringType:
+		return obj.text == "", nil
+	}
+	n, err := Count(obj)
+	if err != nil {
+		return false, notSequenceError("empty?", obj)
+	}
+	return n == 0, nil
+}
+
+// Nth returns the element of the sequence at the index, counting from 0
+func Nth(obj *Object, idx int) (*Object, error) {
+	if i := idx; i >= 0 {
+		switch obj.Type {
+		case ListType:
+			for lst := obj; lst != EmptyList; lst = lst.cdr {
+				if i == 0 {
+					return lst.car, nil
+				}
+				i--
+			}
+		case ArrayType:
+			if i < len(obj.elements) {
+				return obj.elements[i], nil
+			}
+		case StringType:
+			for _, r := range obj.text {
+				if i == 0 {
+					return Character(r), nil
+				}
+				i--
+			}
+		case BlobType:
+			if b := BlobValue(obj); i < len(b) {
+				return Int(int64(b[i])), nil
+			}
+		default:
+			if s, ok := obj.Value.(Indexed); ok {
+				if i < s.Count() {
+					return s.Nth(i), nil
+				}
+				break
+			}
+			lst, err := Seq(obj)
+			if err != nil {
+				return nil, notSequenceError("nth", obj)
+			}
+			return Nth(lst, i)
+		}
+	} else if !IsSequence(obj) {
+		return nil, notSequenceError("nth", obj)
+	}
+	return nil, Error(ArgumentErrorKey, "nth index out of range: ", idx)
+}
+
+// First returns the first element of the sequence, or null if it is empty
+func First(obj *Object) (*Object, error) {
+	switch obj.Type {
+	case ListType:
+		return Car(obj), nil
+	case ArrayType:
+		if len(obj.elements) > 0 {
+			return obj.elements[0], nil
+		}
+		return Null, nil
+	}
+	empty, err := IsEmpty(obj)
+	if err != nil {
+		return nil, notSequenceError("first", obj)
+	}
+	if empty {
+		return Null, nil
+	}
+	return Nth(obj, 0)
+}
+
+// Rest returns a list of the elements of the sequence after the first
+func Rest(obj *Object) (*Object, error) {
+	switch obj.Type {
+	case ListType:
+		return Cdr(obj), nil
+	case ArrayType:
+		if len(obj.elements) > 0 {
+			return ListFromValues(obj.elements[1:]), nil
+		}
+		return EmptyList, nil
+	}
+	lst, err := Seq(obj)
+	if err != nil {
+		return nil, notSequenceError("rest", obj)
+	}
+	return Cdr(lst), nil
+}
+
+// Conj returns a new version of the sequence with the value added: at the front of a list, at
+// the end of an array, string, blob or vector, and as a key/value pair to a struct or hash map
+func Conj(obj *Object, val *Object) (*Object, error) {
+	switch obj.Type {
+	case NullType:
+		return List(val), nil
+	case ListType:
+		return Cons(val, obj), nil
+	case ArrayType:
+		el := make([]*Object, len(obj.elements), len(obj.elements)+1)
+		copy(el, obj.elements)
+		return ArrayFromElementsNoCopy(append(el, val)), nil
+	case StringType:
+		switch val.Type {
+		case CharacterType:
+			return String(obj.text + string(rune(val.fval))), nil
+		case StringType:
+			return String(obj.text + val.text), nil
+		}
+		return nil, Error(ArgumentErrorKey, "conj expected a <character> or <string> for a <string>, got ", val)
+	case BlobType:
+		b, err := AsByteValue(val)
+		if err != nil || val.fval != float64(b) {
+			return nil, Error(ArgumentErrorKey, "conj expected a byte for a <blob>, got ", val)
+		}
+		return Blob(append(append([]byte(nil), BlobValue(obj)...), b)), nil
+	case StructType:
+		pair, err := ToArray(val)
+		if err != nil || len(pair.elements) != 2 {
+			return nil, Error(ArgumentErrorKey, "conj expected a key/value pair for a <struct>, got ", val)
+		}
+		return assoc(obj, pair.elements[0], pair.elements[1])
+	}
+	if s, ok := sequenceValue(obj); ok {
+		return s.Conj(val)
+	}
+	return nil, Error(ArgumentErrorKey, "conj cannot accept ", obj.Type)
+}
+
+// VM Primitives
+
+func vesperSeq(argv []*Object) (*Object, error) {
+	return Seq(argv[0])
+}
+
+func vesperCount(argv []*Object) (*Object, error) {
+	n, err := Count(argv[0])
+	if err != nil {
+		return nil, err
+	}
+	return Int(int64(n)), nil
+}
+
+func vesperEmptyP(argv []*Object) (*Object, error) {
+	empty, err := IsEmpty(argv[0])
+	if err != nil {
+		return nil, err
+	}
+	return toVesperBool(empty)
+}
+
+func vesperNth(argv []*Object) (*Object, error) {
+	idx := argv[1]
+	if idx.fval != math.Trunc(idx.fval) {
+		return nil, Error(ArgumentErrorKey, "nth expected an integer index, got ", idx)
+	}
+	i, ok := elementIndex(idx, math.MaxInt32)
+	if !ok {
+		return nil, Error(ArgumentErrorKey, "nth index out of range: ", idx)
+	}
+	return Nth(argv[0], i)
+}
+
+func vesperFirst(argv []*Object) (*Object, error) {
+	return First(argv[0])
+}
+
+func vesperRest(argv []*Object) (*Object, error) {
+	return Rest(argv[0])
+}
+
+// (conj coll val ...) adds each of the values in turn
+func vesperConj(argv []*Object) (*Object, error) {
+	if len(argv) < 1 {
+		return nil, Error(ArgumentErrorKey, "conj expected at least 1 argument, got none")
+	}
+	coll := argv[0]
+	for _, val := range argv[1:] {
+		var err error
+		coll, err = Conj(coll, val)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return coll, nil
+}
+
+func initSequenceFunctions(vm *VM) {
+	vm.DefineFunction("seq", vesperSeq, ListType, AnyType)
+	vm.DefineFunction("count", vesperCount, NumberType, AnyType)
+	vm.DefineFunction("empty?", vesperEmptyP, BooleanType, AnyType)
+	vm.DefineFunction("nth", vesperNth, AnyType, AnyType, NumberType)
+	vm.DefineFunction("first", vesperFirst, AnyType, AnyType)
+	vm.DefineFunction("rest", vesperRest, ListType, AnyType)
+	vm.DefineFunctionRestArgs("conj", vesperConj, AnyType, AnyType)
+}
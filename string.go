@@ -64,6 +64,10 @@ func ToString(a *Object) (*Object, error) {
 		}
 		return String(string(chars)), nil
 	default:
+		switch a.Value.(type) {
+		case stringable, Writer:
+			return String(a.String()), nil
+		}
 		return nil, Error(ArgumentErrorKey, "to-string: cannot convert argument to <string>: ", a)
 	}
 }
@@ -1,6 +1,7 @@
 package vesper
 
 import (
+	"sort"
 	"strings"
 )
 
@@ -10,7 +11,48 @@ func IsValidStructKey(o *Object) bool {
 	case StringType, SymbolType, KeywordType, TypeType:
 		return true
 	}
-	return false
+	_, ok := o.Value.(Hasher)
+	return ok
+}
+
+// hashedKeys indexes the keys of a struct that implement Hasher by their hash, so that a key
+// can be found by value without comparing it with every key of the struct. It is kept in the
+// Value of a struct that has such keys, and is maintained by Put and Unput.
+type hashedKeys map[uint64][]*Object
+
+// structKey returns the key that the struct uses for the given key. Keys are compared by
+// identity, except for extension values that implement Hasher, which are compared by value.
+func structKey(strct *Object, key *Object) *Object {
+	h, ok := key.Value.(Hasher)
+	if !ok {
+		return key
+	}
+	if _, ok := strct.bindings[key]; ok {
+		return key
+	}
+	index, _ := strct.Value.(hashedKeys)
+	for _, k := range index[h.Hash()] {
+		if k.Type == key.Type && h.Equal(k.Value) {
+			return k
+		}
+	}
+	return key
+}
+
+// copyStruct returns a new struct with the same bindings as the struct, with room for extra more
+func copyStruct(strct *Object, extra int) *Object {
+	result := MakeStruct(len(strct.bindings) + extra)
+	for k, v := range strct.bindings {
+		result.bindings[k] = v
+	}
+	if index, ok := strct.Value.(hashedKeys); ok {
+		copied := make(hashedKeys, len(index))
+		for hash, keys := range index {
+			copied[hash] = append([]*Object(nil), keys...)
+		}
+		result.Value = copied
+	}
+	return result
 }
 
 // EmptyStruct - a <struct> with no bindings
@@ -26,42 +68,28 @@ func MakeStruct(capacity int) *Object {
 
 // Struct - create a new <struct> object from the arguments, which can be other structs, or key/value pairs
 func Struct(fieldvals []*Object) (*Object, error) {
-	strct := &Object{
-		Type:     StructType,
-		bindings: make(map[*Object]*Object),
-	}
+	strct := MakeStruct(0)
 	count := len(fieldvals)
 	i := 0
-	var bindings map[*Object]*Object
 	for i < count {
 		o := Value(fieldvals[i])
 		i++
 		switch o.Type {
 		case StructType: // not a valid key, just copy bindings from it
-			if bindings == nil {
-				bindings = make(map[*Object]*Object, len(o.bindings))
-			}
 			for k, v := range o.bindings {
-				bindings[k] = v
+				Put(strct, k, v)
+			}
+		default:
+			if !IsValidStructKey(o) {
+				return nil, Error(ArgumentErrorKey, "Bad struct key: ", o)
 			}
-		case StringType, SymbolType, KeywordType, TypeType:
 			if i == count {
 				return nil, Error(ArgumentErrorKey, "Mismatched keyword/value in arglist: ", o)
 			}
-			if bindings == nil {
-				bindings = make(map[*Object]*Object)
-			}
-			bindings[o] = fieldvals[i]
+			Put(strct, o, fieldvals[i])
 			i++
-		default:
-			return nil, Error(ArgumentErrorKey, "Bad struct key: ", o)
 		}
 	}
-	if bindings == nil {
-		strct.bindings = make(map[*Object]*Object)
-	} else {
-		strct.bindings = bindings
-	}
 	return strct, nil
 }
 
@@ -75,16 +103,24 @@ func StructLength(strct *Object) int {
 // This is called by the VM, when a keyword is used as a function.
 func Get(obj *Object, key *Object) (*Object, error) {
 	s := Value(obj)
-	if s.Type != StructType {
-		return nil, Error(ArgumentErrorKey, "get expected a <struct> argument, got a ", obj.Type)
+	if g, ok := s.Value.(*goObject); ok {
+		return g.get(key)
+	}
+	switch s.Type {
+	case HashMapType, VectorType:
+		if v, ok := getElement(s, key); ok {
+			return v, nil
+		}
+		return Null, nil
+	case StructType:
+		return structGet(s, key), nil
 	}
-	return structGet(s, key), nil
+	return nil, Error(ArgumentErrorKey, "get expected a <struct>, <hash-map> or <vector> argument, got a ", obj.Type)
 }
 
 func structGet(s *Object, key *Object) *Object {
-	switch key.Type {
-	case KeywordType, SymbolType, TypeType, StringType:
-		result, ok := s.bindings[key]
+	if IsValidStructKey(key) {
+		result, ok := s.bindings[structKey(s, key)]
 		if ok {
 			return result
 		}
@@ -92,8 +128,8 @@ func structGet(s *Object, key *Object) *Object {
 	return Null
 }
 
-// Has returns whether the struct has the given key.
-// Returns an error if the object is not a struct.
+// Has returns whether the struct, hash map or vector has the given key.
+// Returns an error if the object is not one of those.
 func Has(obj *Object, key *Object) (bool, error) {
 	tmp, err := Get(obj, key)
 	if err != nil || IsNull(tmp) {
@@ -104,12 +140,42 @@ func Has(obj *Object, key *Object) (bool, error) {
 
 // Put adds the given object to the struct with the given key
 func Put(obj *Object, key *Object, val *Object) {
-	obj.bindings[key] = val
+	k := structKey(obj, key)
+	if h, ok := k.Value.(Hasher); ok {
+		if _, present := obj.bindings[k]; !present {
+			index, _ := obj.Value.(hashedKeys)
+			if index == nil {
+				index = make(hashedKeys)
+				obj.Value = index
+			}
+			hash := h.Hash()
+			index[hash] = append(index[hash], k)
+		}
+	}
+	obj.bindings[k] = val
 }
 
 // Unput deletes the given key from the struct
 func Unput(obj *Object, key *Object) {
-	delete(obj.bindings, key)
+	k := structKey(obj, key)
+	if h, ok := k.Value.(Hasher); ok {
+		if index, ok := obj.Value.(hashedKeys); ok {
+			hash := h.Hash()
+			keys := index[hash]
+			for i, ik := range keys {
+				if ik == k {
+					keys = append(keys[:i:i], keys[i+1:]...)
+					break
+				}
+			}
+			if len(keys) == 0 {
+				delete(index, hash)
+			} else {
+				index[hash] = keys
+			}
+		}
+	}
+	delete(obj.bindings, k)
 }
 
 func sliceContains(slice []*Object, obj *Object) bool {
@@ -179,7 +245,7 @@ func StructEqual(s1 *Object, s2 *Object) bool {
 	bindings2 := s2.bindings
 	if size == len(bindings2) {
 		for k, v := range bindings1 {
-			v2, ok := bindings2[k]
+			v2, ok := bindings2[structKey(s2, k)]
 			if !ok {
 				return false
 			}
@@ -192,19 +258,38 @@ func StructEqual(s1 *Object, s2 *Object) bool {
 	return false
 }
 
+// sortedKeys returns the keys of the struct in a stable order, so that walking a struct, or
+// writing it, gives the same order each time. Keys are ordered by type, and then by their text,
+// or for extension values by their written form.
+func sortedKeys(s *Object) []*Object {
+	keys := make([]*Object, 0, len(s.bindings))
+	for k := range s.bindings {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		k1, k2 := keys[i], keys[j]
+		if k1.Type != k2.Type {
+			return k1.Type.text < k2.Type.text
+		}
+		switch k1.Type {
+		case StringType, SymbolType, KeywordType, TypeType:
+			return k1.text < k2.text
+		}
+		return Write(k1) < Write(k2)
+	})
+	return keys
+}
+
 func structToString(s *Object) string {
 	var buf strings.Builder
 	buf.WriteString("{")
-	first := true
-	for k, v := range s.bindings {
-		if first {
-			first = false
-		} else {
+	for i, k := range sortedKeys(s) {
+		if i > 0 {
 			buf.WriteString(" ")
 		}
 		buf.WriteString(k.String())
 		buf.WriteString(" ")
-		buf.WriteString(v.String())
+		buf.WriteString(s.bindings[k].String())
 	}
 	buf.WriteString("}")
 	return buf.String()
@@ -213,8 +298,8 @@ func structToString(s *Object) string {
 func structToList(s *Object) (*Object, error) {
 	result := EmptyList
 	tail := EmptyList
-	for k, v := range s.bindings {
-		tmp := List(k, v)
+	for _, k := range sortedKeys(s) {
+		tmp := List(k, s.bindings[k])
 		if result == EmptyList {
 			result = List(tmp)
 			tail = result
@@ -229,10 +314,8 @@ func structToList(s *Object) (*Object, error) {
 func structToArray(s *Object) *Object {
 	size := len(s.bindings)
 	el := make([]*Object, size)
-	j := 0
-	for k, v := range s.bindings {
-		el[j] = Array(k, v)
-		j++
+	for j, k := range sortedKeys(s) {
+		el[j] = Array(k, s.bindings[k])
 	}
 	return ArrayFromElements(el, size)
 }
@@ -250,7 +333,7 @@ func StructValues(s *Object) *Object {
 func structKeyList(s *Object) *Object {
 	result := EmptyList
 	tail := EmptyList
-	for key := range s.bindings {
+	for _, key := range sortedKeys(s) {
 		if result == EmptyList {
 			result = List(key)
 			tail = result
@@ -265,7 +348,8 @@ func structKeyList(s *Object) *Object {
 func structValueList(s *Object) *Object {
 	result := EmptyList
 	tail := EmptyList
-	for _, v := range s.bindings {
+	for _, k := range sortedKeys(s) {
+		v := s.bindings[k]
 		if result == EmptyList {
 			result = List(v)
 			tail = result
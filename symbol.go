@@ -1,10 +1,12 @@
 package vesper
 
+import "sync"
+
 var defaultSymtab = initSymbolTable()
 
 // Intern - internalize the name into the global symbol table
 func (vm *VM) Intern(name string) *Object {
-	sym, ok := vm.Symbols[name]
+	sym, ok := vm.lookupSymbol(name)
 	if !ok {
 		sym = &Object{text: name}
 		if IsValidKeywordName(name) {
@@ -20,11 +22,22 @@ func (vm *VM) Intern(name string) *Object {
 			}
 			sym.Type = StringType
 		}
-		vm.Symbols[name] = sym
+		// another goroutine may have interned the same name in the meantime
+		actual, _ := vm.symbols.LoadOrStore(name, sym)
+		sym = actual.(*Object)
 	}
 	return sym
 }
 
+// lookupSymbol returns the interned symbol with the name, if there is one
+func (vm *VM) lookupSymbol(name string) (*Object, bool) {
+	sym, ok := vm.symbols.Load(name)
+	if !ok {
+		return nil, false
+	}
+	return sym.(*Object), true
+}
+
 // IsValidSymbolName returns true if the string is a valid symbol
 func IsValidSymbolName(name string) bool {
 	return len(name) > 0
@@ -120,20 +133,20 @@ func (vm *VM) ToSymbol(obj *Object) (*Object, error) {
 	return nil, Error(ArgumentErrorKey, "to-symbol expected a <keyword>, <type>, <symbol>, or <string>, got a ", obj.Type)
 }
 
-func initSymbolTable() map[string]*Object {
-	syms := make(map[string]*Object)
+func initSymbolTable() *sync.Map {
+	syms := new(sync.Map)
 	TypeType = &Object{text: "<type>"}
 	TypeType.Type = TypeType //mutate to bootstrap type type
-	syms[TypeType.text] = TypeType
+	syms.Store(TypeType.text, TypeType)
 
 	KeywordType = &Object{Type: TypeType, text: "<keyword>"}
-	syms[KeywordType.text] = KeywordType
+	syms.Store(KeywordType.text, KeywordType)
 
 	SymbolType = &Object{Type: TypeType, text: "<symbol>"}
-	syms[SymbolType.text] = SymbolType
+	syms.Store(SymbolType.text, SymbolType)
 
 	StringType = &Object{Type: TypeType, text: "<string>"}
-	syms[StringType.text] = StringType
+	syms.Store(StringType.text, StringType)
 
 	// Fixup empty string
 	EmptyString.Type = StringType
@@ -0,0 +1,549 @@
+package vesper
+
+import (
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+var gensymCounter uint64
+
+// Gensym returns a new uninterned symbol, which is never identical to any symbol read or interned
+func Gensym(prefix string) *Object {
+	n := atomic.AddUint64(&gensymCounter, 1)
+	return &Object{Type: SymbolType, text: prefix + strconv.FormatUint(n, 10)}
+}
+
+// autoGensym returns the fresh symbol for an auto-gensym symbol such as tmp# in a quasiquote
+// form, so that every occurrence within the form refers to the same generated symbol.
+func autoGensym(sym *Object, gensyms map[*Object]*Object) *Object {
+	if len(sym.text) < 2 || !strings.HasSuffix(sym.text, "#") {
+		return sym
+	}
+	if gen, ok := gensyms[sym]; ok {
+		return gen
+	}
+	gen := Gensym(strings.TrimSuffix(sym.text, "#") + "__")
+	gensyms[sym] = gen
+	return gen
+}
+
+// A syntaxRules is a macro expander defined by pattern and template clauses, as in Scheme:
+//
+//	(define-syntax swap!
+//	  (syntax-rules ()
+//	    ((_ a b) (let ((tmp a)) (set! a b) (set! b tmp)))))
+//
+// The head of each pattern is ignored. Within a pattern, _ matches anything, literals match
+// only themselves, and any other symbol is a pattern variable. A subpattern followed by ...
+// matches zero or more forms. Symbols that the template binds with fn, let, letrec or catch
+// are renamed on each expansion, so that they cannot capture variables at the use site. Free
+// symbols in the template that name globals where the rules are defined refer to those globals
+// wherever the macro is used, so that local bindings at the use site cannot capture them either.
+type syntaxRules struct {
+	vm       *VM
+	literals map[*Object]bool
+	rules    []*syntaxRule
+}
+
+type syntaxRule struct {
+	pattern  *Object
+	template *Object
+	binders  []*Object
+}
+
+// syntaxBindings maps pattern variables to the forms they matched. Variables under an
+// ellipsis are bound to a []interface{} with one entry per match.
+type syntaxBindings map[*Object]interface{}
+
+// (syntax-rules (literal ...) (pattern template) ...)
+//  ->
+// (make-syntax-rules '(literal ...) '((pattern template) ...))
+func (vm *VM) expandSyntaxRules(expr *Object) (*Object, error) {
+	if ListLength(expr) < 2 {
+		return nil, Error(SyntaxErrorKey, expr)
+	}
+	literals := Cadr(expr)
+	clauses := Cddr(expr)
+	if _, err := vm.newSyntaxRules(literals, clauses); err != nil {
+		return nil, err
+	}
+	quote := vm.Intern("quote")
+	return List(vm.Intern("make-syntax-rules"), List(quote, literals), List(quote, clauses)), nil
+}
+
+// (define-syntax name (syntax-rules ...))
+//  ->
+// (defmacro name (make-syntax-rules ...))
+func (vm *VM) expandDefineSyntax(expr *Object) (*Object, error) {
+	if ListLength(expr) != 3 || !IsSymbol(Cadr(expr)) {
+		return nil, Error(SyntaxErrorKey, expr)
+	}
+	expander, err := vm.macroexpandObject(Caddr(expr))
+	if err != nil {
+		return nil, err
+	}
+	return List(vm.Intern("defmacro"), Cadr(expr), expander), nil
+}
+
+func (vm *VM) newSyntaxRules(literals *Object, clauses *Object) (*syntaxRules, error) {
+	sr := &syntaxRules{vm: vm, literals: make(map[*Object]bool)}
+	if !IsList(literals) {
+		return nil, Error(SyntaxErrorKey, "syntax-rules literals must be a list: ", literals)
+	}
+	for tmp := literals; tmp != EmptyList; tmp = Cdr(tmp) {
+		if !IsSymbol(Car(tmp)) {
+			return nil, Error(SyntaxErrorKey, "syntax-rules literal is not a symbol: ", Car(tmp))
+		}
+		sr.literals[Car(tmp)] = true
+	}
+	if !IsList(clauses) {
+		return nil, Error(SyntaxErrorKey, clauses)
+	}
+	for tmp := clauses; tmp != EmptyList; tmp = Cdr(tmp) {
+		clause := Car(tmp)
+		if !IsList(clause) || ListLength(clause) != 2 || !IsList(Car(clause)) || Car(clause) == EmptyList {
+			return nil, Error(SyntaxErrorKey, "bad syntax-rules clause: ", clause)
+		}
+		pattern := Car(clause)
+		if err := sr.checkPattern(Cdr(pattern)); err != nil {
+			return nil, err
+		}
+		vars := make(map[*Object]bool)
+		sr.patternVars(Cdr(pattern), vars)
+		rule := &syntaxRule{pattern: pattern, template: Cadr(clause)}
+		seen := make(map[*Object]bool)
+		sr.templateBinders(rule.template, vars, seen)
+		for sym := range seen {
+			rule.binders = append(rule.binders, sym)
+		}
+		rule.template = sr.resolveTemplate(rule.template, vars, seen)
+		sr.rules = append(sr.rules, rule)
+	}
+	return sr, nil
+}
+
+func (sr *syntaxRules) isEllipsis(obj *Object) bool {
+	return obj == sr.vm.Intern("...")
+}
+
+// checkPattern makes sure an ellipsis only ever follows a subpattern, at most once per list
+func (sr *syntaxRules) checkPattern(pat *Object) error {
+	if IsArray(pat) {
+		pat, _ = ToList(pat)
+	}
+	if !IsList(pat) {
+		return nil
+	}
+	ellipses := 0
+	for i := 0; pat != EmptyList; i++ {
+		if !IsList(pat) {
+			return sr.checkPattern(pat)
+		}
+		p := Car(pat)
+		if sr.isEllipsis(p) {
+			ellipses++
+			if i == 0 || ellipses > 1 {
+				return Error(SyntaxErrorKey, "misplaced ellipsis in syntax-rules pattern")
+			}
+		} else if err := sr.checkPattern(p); err != nil {
+			return err
+		}
+		pat = Cdr(pat)
+	}
+	return nil
+}
+
+func (sr *syntaxRules) patternVars(pat *Object, vars map[*Object]bool) {
+	switch pat.Type {
+	case SymbolType:
+		if !sr.isEllipsis(pat) && pat != sr.vm.Intern("_") && !sr.literals[pat] {
+			vars[pat] = true
+		}
+	case ListType:
+		for ; pat != EmptyList; pat = Cdr(pat) {
+			if !IsList(pat) {
+				sr.patternVars(pat, vars)
+				return
+			}
+			sr.patternVars(Car(pat), vars)
+		}
+	case ArrayType:
+		for _, p := range pat.elements {
+			sr.patternVars(p, vars)
+		}
+	}
+}
+
+// templateBinders finds the symbols that the template itself binds as local variables
+func (sr *syntaxRules) templateBinders(tmpl *Object, vars map[*Object]bool, binders map[*Object]bool) {
+	vm := sr.vm
+	add := func(sym *Object) {
+		if IsSymbol(sym) && !vars[sym] && !sr.isEllipsis(sym) && sym != vm.Intern("&") {
+			binders[sym] = true
+		}
+	}
+	if IsArray(tmpl) {
+		for _, t := range tmpl.elements {
+			sr.templateBinders(t, vars, binders)
+		}
+		return
+	}
+	if !IsList(tmpl) || tmpl == EmptyList {
+		return
+	}
+	switch Car(tmpl) {
+	case vm.Intern("fn"):
+		sr.paramBinders(Cadr(tmpl), add)
+	case vm.Intern("defn"):
+		sr.paramBinders(Caddr(tmpl), add)
+	case vm.Intern("let"), vm.Intern("letrec"):
+		bindings := Cadr(tmpl)
+		if IsSymbol(bindings) {
+			add(bindings)
+			bindings = Caddr(tmpl)
+		}
+		if IsArray(bindings) {
+			bindings, _ = ToList(bindings)
+		}
+		for ; IsList(bindings) && bindings != EmptyList; bindings = Cdr(bindings) {
+			b := Car(bindings)
+			if IsArray(b) {
+				b, _ = ToList(b)
+			}
+			if IsList(b) {
+				add(Car(b))
+			}
+		}
+	case vm.Intern("catch"):
+		if _, sym, _, ok := crackCatch(tmpl); ok {
+			add(sym)
+		}
+	}
+	for ; IsList(tmpl) && tmpl != EmptyList; tmpl = Cdr(tmpl) {
+		sr.templateBinders(Car(tmpl), vars, binders)
+	}
+}
+
+func (sr *syntaxRules) paramBinders(params *Object, add func(*Object)) {
+	if IsArray(params) {
+		for _, p := range params.elements {
+			if IsList(p) {
+				p = Car(p)
+			}
+			add(p)
+		}
+		return
+	}
+	for ; params != EmptyList; params = Cdr(params) {
+		if !IsList(params) {
+			add(params)
+			return
+		}
+		if p := Car(params); IsArray(p) {
+			sr.paramBinders(p, add)
+		} else {
+			add(p)
+		}
+	}
+}
+
+// resolveTemplate replaces the free symbols of a template that name globals with references to
+// them that do not depend on where the expansion is compiled: a builtin primitive is replaced by
+// the primitive itself, as in the expansions of the builtin macros, and a global defined by a
+// module by its qualified name. Pattern variables, the symbols that the template binds, quoted
+// forms, case keys and the names that the template defines are left as they are.
+func (sr *syntaxRules) resolveTemplate(tmpl *Object, vars map[*Object]bool, binders map[*Object]bool) *Object {
+	vm := sr.vm
+	switch tmpl.Type {
+	case SymbolType:
+		if vars[tmpl] || binders[tmpl] {
+			return tmpl
+		}
+		return sr.resolveFree(tmpl, true)
+	case ArrayType:
+		lst, _ := ToList(tmpl)
+		arr, _ := ToArray(sr.resolveTemplate(lst, vars, binders))
+		return arr
+	case ListType:
+		if tmpl == EmptyList {
+			return tmpl
+		}
+		switch head := Car(tmpl); head {
+		case vm.Intern("quote"), vm.Intern("quasiquote"):
+			return tmpl
+		case vm.Intern("def"), vm.Intern("defn"), vm.Intern("defmacro"), vm.Intern("undef"):
+			if IsList(Cdr(tmpl)) && Cdr(tmpl) != EmptyList {
+				return Cons(head, Cons(Cadr(tmpl), sr.resolveElements(Cddr(tmpl), vars, binders)))
+			}
+		case vm.Intern("set!"):
+			// a global may be assigned, but not a primitive
+			if IsList(Cdr(tmpl)) && Cdr(tmpl) != EmptyList {
+				target := Cadr(tmpl)
+				if IsSymbol(target) && !vars[target] && !binders[target] {
+					target = sr.resolveFree(target, false)
+				}
+				return Cons(head, Cons(target, sr.resolveElements(Cddr(tmpl), vars, binders)))
+			}
+		case vm.Intern("case"):
+			if IsList(Cdr(tmpl)) && Cdr(tmpl) != EmptyList {
+				var clauses []*Object
+				rest := Cddr(tmpl)
+				for ; IsList(rest) && rest != EmptyList; rest = Cdr(rest) {
+					clause := Car(rest)
+					if IsList(clause) && clause != EmptyList {
+						clause = Cons(Car(clause), sr.resolveElements(Cdr(clause), vars, binders))
+					}
+					clauses = append(clauses, clause)
+				}
+				lst := rest
+				for i := len(clauses) - 1; i >= 0; i-- {
+					lst = Cons(clauses[i], lst)
+				}
+				return Cons(head, Cons(sr.resolveTemplate(Cadr(tmpl), vars, binders), lst))
+			}
+		}
+		return sr.resolveElements(tmpl, vars, binders)
+	}
+	return tmpl
+}
+
+// resolveElements resolves each of the elements of a possibly dotted list
+func (sr *syntaxRules) resolveElements(lst *Object, vars map[*Object]bool, binders map[*Object]bool) *Object {
+	if !IsList(lst) {
+		return sr.resolveTemplate(lst, vars, binders)
+	}
+	if lst == EmptyList {
+		return lst
+	}
+	return Cons(sr.resolveTemplate(Car(lst), vars, binders), sr.resolveElements(Cdr(lst), vars, binders))
+}
+
+// resolveFree returns the reference to use for a free symbol of a template, or the symbol itself
+// if it does not name a global or macro, such as a special form or a keyword of a form
+func (sr *syntaxRules) resolveFree(sym *Object, primitive bool) *Object {
+	vm := sr.vm
+	if sr.isEllipsis(sym) {
+		return sym
+	}
+	resolved, err := vm.resolveGlobal(sym)
+	if err != nil {
+		return sym
+	}
+	if !vm.IsDefined(resolved) && vm.GetMacro(resolved) == nil && !vm.currentModule().defines(sym) {
+		return sym
+	}
+	if prim := vm.builtin(resolved.text); primitive && prim != nil && vm.GetGlobal(resolved) == prim {
+		return prim
+	}
+	return resolved
+}
+
+// expand is the macro expander: it expands the form with the first rule whose pattern matches
+func (sr *syntaxRules) expand(argv []*Object) (*Object, error) {
+	form := argv[0]
+	for _, rule := range sr.rules {
+		b := make(syntaxBindings)
+		if !sr.matchList(Cdr(rule.pattern), Cdr(form), b) {
+			continue
+		}
+		renames := make(map[*Object]*Object, len(rule.binders))
+		for _, sym := range rule.binders {
+			renames[sym] = Gensym(sym.text + "__")
+		}
+		return sr.instantiate(rule.template, b, renames)
+	}
+	return nil, Error(SyntaxErrorKey, "no syntax-rules pattern matches ", form)
+}
+
+func (sr *syntaxRules) match(pat *Object, form *Object, b syntaxBindings) bool {
+	switch pat.Type {
+	case SymbolType:
+		if pat == sr.vm.Intern("_") {
+			return true
+		}
+		if sr.literals[pat] {
+			return form == pat
+		}
+		b[pat] = form
+		return true
+	case ListType:
+		return sr.matchList(pat, form, b)
+	case ArrayType:
+		if !IsArray(form) {
+			return false
+		}
+		p, _ := ToList(pat)
+		f, _ := ToList(form)
+		return sr.matchList(p, f, b)
+	default:
+		return Equal(pat, form)
+	}
+}
+
+func (sr *syntaxRules) matchList(pat *Object, form *Object, b syntaxBindings) bool {
+	for pat != EmptyList {
+		if !IsList(pat) {
+			// dotted tail pattern matches the rest of the form
+			return sr.match(pat, form, b)
+		}
+		p := Car(pat)
+		next := Cdr(pat)
+		if IsList(next) && next != EmptyList && sr.isEllipsis(Car(next)) {
+			pat = Cdr(next)
+			n := pairCount(form) - pairCount(pat)
+			if n < 0 {
+				return false
+			}
+			matches := make([]syntaxBindings, 0, n)
+			for i := 0; i < n; i++ {
+				mb := make(syntaxBindings)
+				if !sr.match(p, Car(form), mb) {
+					return false
+				}
+				matches = append(matches, mb)
+				form = Cdr(form)
+			}
+			vars := make(map[*Object]bool)
+			sr.patternVars(p, vars)
+			for v := range vars {
+				seq := make([]interface{}, len(matches))
+				for i, mb := range matches {
+					seq[i] = mb[v]
+				}
+				b[v] = seq
+			}
+			continue
+		}
+		if !IsList(form) || form == EmptyList {
+			return false
+		}
+		if !sr.match(p, Car(form), b) {
+			return false
+		}
+		pat = next
+		form = Cdr(form)
+	}
+	return form == EmptyList
+}
+
+// pairCount returns the number of elements in a possibly dotted list
+func pairCount(lst *Object) int {
+	n := 0
+	for ; IsList(lst) && lst != EmptyList; lst = Cdr(lst) {
+		n++
+	}
+	return n
+}
+
+func (sr *syntaxRules) instantiate(tmpl *Object, b syntaxBindings, renames map[*Object]*Object) (*Object, error) {
+	switch tmpl.Type {
+	case SymbolType:
+		if v, ok := b[tmpl]; ok {
+			if obj, ok := v.(*Object); ok {
+				return obj, nil
+			}
+			return nil, Error(SyntaxErrorKey, "syntax-rules pattern variable used without ellipsis: ", tmpl)
+		}
+		if sym, ok := renames[tmpl]; ok {
+			return sym, nil
+		}
+		return tmpl, nil
+	case ListType:
+		var result []*Object
+		tail := EmptyList
+		for tmpl != EmptyList {
+			if !IsList(tmpl) {
+				obj, err := sr.instantiate(tmpl, b, renames)
+				if err != nil {
+					return nil, err
+				}
+				tail = obj
+				break
+			}
+			elem := Car(tmpl)
+			next := Cdr(tmpl)
+			if IsList(next) && next != EmptyList && sr.isEllipsis(Car(next)) {
+				items, err := sr.instantiateEllipsis(elem, b, renames)
+				if err != nil {
+					return nil, err
+				}
+				result = append(result, items...)
+				tmpl = Cdr(next)
+				continue
+			}
+			obj, err := sr.instantiate(elem, b, renames)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, obj)
+			tmpl = next
+		}
+		lst := tail
+		for i := len(result) - 1; i >= 0; i-- {
+			lst = Cons(result[i], lst)
+		}
+		return lst, nil
+	case ArrayType:
+		lst, _ := ToList(tmpl)
+		lst, err := sr.instantiate(lst, b, renames)
+		if err != nil {
+			return nil, err
+		}
+		return ToArray(lst)
+	default:
+		return tmpl, nil
+	}
+}
+
+// instantiateEllipsis instantiates elem once for each match of the ellipsis variables it contains
+func (sr *syntaxRules) instantiateEllipsis(elem *Object, b syntaxBindings, renames map[*Object]*Object) ([]*Object, error) {
+	vars := make(map[*Object]bool)
+	sr.patternVars(elem, vars)
+	n := -1
+	var seqs []*Object
+	for v := range vars {
+		if seq, ok := b[v].([]interface{}); ok {
+			if n >= 0 && len(seq) != n {
+				return nil, Error(SyntaxErrorKey, "syntax-rules ellipsis variables have different lengths: ", elem)
+			}
+			n = len(seq)
+			seqs = append(seqs, v)
+		}
+	}
+	if n < 0 {
+		return nil, Error(SyntaxErrorKey, "no syntax-rules ellipsis variable in template: ", elem)
+	}
+	result := make([]*Object, 0, n)
+	for i := 0; i < n; i++ {
+		eb := make(syntaxBindings, len(b))
+		for k, v := range b {
+			eb[k] = v
+		}
+		for _, v := range seqs {
+			eb[v] = b[v].([]interface{})[i]
+		}
+		obj, err := sr.instantiate(elem, eb, renames)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, obj)
+	}
+	return result, nil
+}
+
+func vesperGensym(argv []*Object) (*Object, error) {
+	return Gensym(argv[0].text), nil
+}
+
+func (vm *VM) vesperSyntaxRules(argv []*Object) (*Object, error) {
+	return vm.expandSyntaxRules(argv[0])
+}
+
+func (vm *VM) vesperMakeSyntaxRules(argv []*Object) (*Object, error) {
+	sr, err := vm.newSyntaxRules(argv[0], argv[1])
+	if err != nil {
+		return nil, err
+	}
+	return Primitive("syntax-rules", sr.expand, AnyType, []*Object{AnyType}, nil, nil, nil), nil
+}
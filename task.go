@@ -0,0 +1,300 @@
+package vesper
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// TaskType - the type of the task object returned by go
+var TaskType = defaultVM.Intern("<task>")
+
+// The states of a task, as returned by task-status
+var (
+	TaskRunning   = defaultVM.Intern("running:")
+	TaskDone      = defaultVM.Intern("done:")
+	TaskFailed    = defaultVM.Intern("failed:")
+	TaskCancelled = defaultVM.Intern("cancelled:")
+)
+
+// A task is a handle on a function running in its own goroutine. It records the
+// result or error of the function, so that it can be collected with await.
+type task struct {
+	name   string
+	cancel context.CancelFunc
+	done   chan struct{} // closed when the task is no longer running
+	mutex  sync.Mutex
+	status *Object
+	result *Object
+	err    error
+}
+
+func (t *task) String() string {
+	s := "#[task"
+	if t.name != "" {
+		s += " " + t.name
+	}
+	return s + " " + t.currentStatus().text + "]"
+}
+
+// currentStatus returns the current state of the task
+func (t *task) currentStatus() *Object {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.status
+}
+
+// finish records the outcome of the task, unless it has already finished or been cancelled
+func (t *task) finish(status *Object, result *Object, err error) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.status != TaskRunning {
+		return false
+	}
+	t.status = status
+	t.result = result
+	t.err = err
+	close(t.done)
+	return true
+}
+
+// stop cancels the task if it is still running. The goroutine is interrupted the next
+// time its VM checks for cancellation, but waiters see the cancellation immediately.
+func (t *task) stop() bool {
+	t.cancel()
+	return t.finish(TaskCancelled, nil, Error(InterruptKey, "task cancelled: ", t.name))
+}
+
+// wait blocks until the task finishes or the timeout, in seconds, expires. A negative
+// timeout waits forever, and a zero timeout just polls the task. It returns an error if
+// the context is done first.
+func (t *task) wait(ctx context.Context, timeout float64) (bool, error) {
+	if timeout < 0 {
+		select {
+		case <-t.done:
+			return true, nil
+		case <-ctx.Done():
+			return false, interruptError(ctx)
+		}
+	}
+	select {
+	case <-t.done:
+		return true, nil
+	default:
+	}
+	if NumberEqual(timeout, 0.0) {
+		return false, nil
+	}
+	timer := time.NewTimer(secondsToDuration(timeout))
+	defer timer.Stop()
+	select {
+	case <-t.done:
+		return true, nil
+	case <-timer.C:
+		return false, nil
+	case <-ctx.Done():
+		return false, interruptError(ctx)
+	}
+}
+
+// outcome returns the result of a finished task, or its error if it failed or was cancelled
+func (t *task) outcome() (*Object, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.result, t.err
+}
+
+func secondsToDuration(seconds float64) time.Duration {
+	return time.Millisecond * time.Duration(seconds*1000.0)
+}
+
+// taskValue returns the task object for the Vesper task, or nil if it is not a task
+func taskValue(obj *Object) *task {
+	v, _ := obj.Value.(*task)
+	return v
+}
+
+// spawn starts a goroutine running the function with the arguments on the stack, and returns its task
+func (vm *VM) spawn(fun *Object, argc int, stack []*Object, sp int) (*Object, error) {
+	if err := vm.requireCapability(GoroutineCapability, "go"); err != nil {
+		return nil, err
+	}
+	if fun.Type == FunctionType {
+		if fun.code != nil {
+			env, err := vm.buildFrame(nil, 0, nil, fun, argc, stack, sp)
+			if err != nil {
+				return nil, err
+			}
+			// the task outlives the evaluation that started it, so it runs with a context of
+			// its own, which only cancel stops, and the VM's limits apply to it afresh
+			ctx, cancel := context.WithCancel(context.Background())
+			ctx, cancelLimits := vm.limitContext(ctx)
+			t := &task{name: fun.code.name, cancel: cancel, done: make(chan struct{}), status: TaskRunning}
+			go func(code *Code, env *frame) {
+				defer cancel()
+				defer cancelLimits()
+				result, err := vm.exec(ctx, code, env, make([]*Object, vm.StackSize))
+				if err != nil {
+					t.finish(TaskFailed, nil, err)
+					if vm.Flags.Verbose {
+						println("; [*** error in goroutine '", code.name, "': ", err.Error(), "]")
+					}
+				} else {
+					t.finish(TaskDone, result, nil)
+					if vm.Flags.Verbose {
+						println("; [goroutine '", code.name, "' exited cleanly]")
+					}
+				}
+			}(fun.code, env)
+			return NewObject(TaskType, t), nil
+		}
+		// apply, go and callcc cannot be called directly in a goroutine
+		// TODO: Check this is no longer the case
+	}
+	return nil, Error(ArgumentErrorKey, "Bad function for go: ", fun)
+}
+
+func toTasks(lst *Object) ([]*task, error) {
+	var tasks []*task
+	for ; lst != EmptyList; lst = Cdr(lst) {
+		t := taskValue(Car(lst))
+		if t == nil {
+			return nil, Error(ArgumentErrorKey, "Expected a list of <task>, got a ", Car(lst).Type)
+		}
+		tasks = append(tasks, t)
+	}
+	return tasks, nil
+}
+
+// selectTask waits until one of the tasks has finished, returning its index, or -1 on timeout.
+// It returns an error if the context is done first.
+func selectTask(ctx context.Context, tasks []*task, timer <-chan time.Time, poll bool) (int, error) {
+	cases := make([]reflect.SelectCase, 0, len(tasks)+2)
+	for _, t := range tasks {
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(t.done)})
+	}
+	if poll {
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectDefault})
+	} else if timer != nil {
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(timer)})
+	}
+	interrupt := -1
+	if done := ctx.Done(); done != nil && !poll {
+		interrupt = len(cases)
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(done)})
+	}
+	chosen, _, _ := reflect.Select(cases)
+	switch chosen {
+	case interrupt:
+		return -1, interruptError(ctx)
+	case len(tasks):
+		return -1, nil
+	}
+	return chosen, nil
+}
+
+func newTimeout(timeout float64) (<-chan time.Time, func()) {
+	if timeout <= 0 {
+		return nil, func() {}
+	}
+	timer := time.NewTimer(secondsToDuration(timeout))
+	return timer.C, func() { timer.Stop() }
+}
+
+// VM Primitives
+
+func vesperTaskP(argv []*Object) (*Object, error) {
+	return toVesperBool(argv[0].Type == TaskType)
+}
+
+func vesperTaskStatus(argv []*Object) (*Object, error) {
+	return taskValue(argv[0]).currentStatus(), nil
+}
+
+func vesperCancel(argv []*Object) (*Object, error) {
+	return toVesperBool(taskValue(argv[0]).stop())
+}
+
+func vesperAwait(ctx context.Context, argv []*Object) (*Object, error) {
+	t := taskValue(argv[0])
+	finished, err := t.wait(ctx, argv[1].fval)
+	if err != nil {
+		return nil, err
+	}
+	if !finished {
+		return Null, nil
+	}
+	return t.outcome()
+}
+
+// (wait-all tasks) returns the results of the tasks, in order. If any task fails, the others
+// are cancelled and its error is raised.
+func vesperWaitAll(ctx context.Context, argv []*Object) (*Object, error) {
+	tasks, err := toTasks(argv[0])
+	if err != nil {
+		return nil, err
+	}
+	timeout := argv[1].fval
+	timer, stop := newTimeout(timeout)
+	defer stop()
+	pending := append([]*task(nil), tasks...)
+	for len(pending) > 0 {
+		i, err := selectTask(ctx, pending, timer, NumberEqual(timeout, 0.0))
+		if err != nil {
+			return nil, err
+		}
+		if i < 0 {
+			return Null, nil
+		}
+		t := pending[i]
+		pending = append(pending[:i], pending[i+1:]...)
+		if _, err := t.outcome(); err != nil {
+			for _, other := range pending {
+				other.stop()
+			}
+			return nil, err
+		}
+	}
+	results := make([]*Object, len(tasks))
+	for i, t := range tasks {
+		results[i], _ = t.outcome()
+	}
+	return ListFromValues(results), nil
+}
+
+// (wait-any tasks) returns the first of the tasks to finish
+func vesperWaitAny(ctx context.Context, argv []*Object) (*Object, error) {
+	tasks, err := toTasks(argv[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(tasks) == 0 {
+		return nil, Error(ArgumentErrorKey, "wait-any expected at least one task")
+	}
+	timeout := argv[1].fval
+	timer, stop := newTimeout(timeout)
+	defer stop()
+	i, err := selectTask(ctx, tasks, timer, NumberEqual(timeout, 0.0))
+	if err != nil {
+		return nil, err
+	}
+	if i < 0 {
+		return Null, nil
+	}
+	for lst := argv[0]; ; lst = Cdr(lst) {
+		if i == 0 {
+			return Car(lst), nil
+		}
+		i--
+	}
+}
+
+func initTaskFunctions(vm *VM) {
+	vm.DefineFunction("task?", vesperTaskP, BooleanType, AnyType)
+	vm.DefineFunction("task-status", vesperTaskStatus, KeywordType, TaskType)
+	vm.DefineFunction("cancel", vesperCancel, BooleanType, TaskType)
+	vm.DefineContextFunction("await", vesperAwait, AnyType, []*Object{TaskType, NumberType}, MinusOne)
+	vm.DefineContextFunction("wait-all", vesperWaitAll, ListType, []*Object{ListType, NumberType}, MinusOne)
+	vm.DefineContextFunction("wait-any", vesperWaitAny, TaskType, []*Object{ListType, NumberType}, MinusOne)
+}
@@ -1,8 +1,11 @@
 package vesper
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -33,6 +36,19 @@ func Sleep(delayInSeconds float64) {
 	time.Sleep(dur)
 }
 
+// SleepContext sleeps for the given number of seconds, or until the context is done, when it
+// returns the context's error
+func SleepContext(ctx context.Context, delayInSeconds float64) error {
+	timer := time.NewTimer(time.Duration(delayInSeconds * float64(time.Second)))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // Now returns the time in seconds  since the epoch
 func Now() float64 {
 	now := time.Now()
@@ -46,32 +62,60 @@ func str(o interface{}) string {
 	return fmt.Sprintf("%v", o)
 }
 
-func copyEnv(src map[string]*Object) map[string]*Object {
-	m := make(map[string]*Object, len(src))
-	for k, v := range src {
-		m[k] = v
+// copyTable returns a new table with the same entries as src, which may be nil
+func copyTable(src *sync.Map) *sync.Map {
+	m := new(sync.Map)
+	if src != nil {
+		src.Range(func(k, v interface{}) bool {
+			m.Store(k, v)
+			return true
+		})
 	}
 	return m
 }
 
-func copyMacros(src map[*Object]*Macro) map[*Object]*Macro {
-	m := make(map[*Object]*Macro, len(src))
-	for k, v := range src {
-		m[k] = v
+// A constantPool is the append only table of the constants referenced by compiled code.
+// Adding a constant publishes a new slice, so that readers never need to take the lock.
+type constantPool struct {
+	mutex  sync.Mutex
+	index  map[*Object]int
+	values atomic.Value // []*Object
+}
+
+func newConstantPool(src *constantPool) *constantPool {
+	p := &constantPool{index: make(map[*Object]int)}
+	var values []*Object
+	if src != nil {
+		src.mutex.Lock()
+		for k, v := range src.index {
+			p.index[k] = v
+		}
+		values = append(values, src.all()...)
+		src.mutex.Unlock()
 	}
-	return m
+	p.values.Store(values)
+	return p
 }
 
-func copyConstantMap(src map[*Object]int) map[*Object]int {
-	m := make(map[*Object]int, len(src))
-	for k, v := range src {
-		m[k] = v
+// put returns the index of the constant, adding it to the pool if it is not already present
+func (p *constantPool) put(val *Object) int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	idx, present := p.index[val]
+	if !present {
+		values := p.all()
+		idx = len(values)
+		// appending only writes past the end of the slice that readers can see
+		p.values.Store(append(values, val))
+		p.index[val] = idx
 	}
-	return m
+	return idx
 }
 
-func copyConstants(src []*Object) []*Object {
-	m := make([]*Object, len(src))
-	copy(m, src)
-	return m
+func (p *constantPool) get(idx int) *Object {
+	return p.values.Load().([]*Object)[idx]
+}
+
+func (p *constantPool) all() []*Object {
+	return p.values.Load().([]*Object)
 }
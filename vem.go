@@ -0,0 +1,669 @@
+package vesper
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"os"
+)
+
+// A .vem module is the compiled form of a source file: a header, followed by the
+// top level thunks of the file in order. Each code object carries its own table
+// of constants, which the ops refer to by index, so a module does not depend on
+// the constant pool of the VM that wrote it. Nested closures are written inline
+// as code constants.
+
+const (
+	// vemMagic identifies a compiled module file
+	vemMagic = "\x00vem"
+	// VemVersion is the version of the compiled module format. It is bumped whenever
+	// the format or the instruction set changes incompatibly.
+	VemVersion = 7
+)
+
+const (
+	vemNull = iota
+	vemTrue
+	vemFalse
+	vemEmptyList
+	vemFixnum
+	vemBignum
+	vemRatio
+	vemFloat
+	vemCharacter
+	vemString
+	vemSymbol
+	vemUninterned
+	vemBlob
+	vemList
+	vemArray
+	vemStruct
+	vemCode
+	vemPrimitive
+	vemVector
+	vemHashMap
+	vemJumpTable
+)
+
+// opConstantOperand returns true if the operand of the instruction is an index into the constant pool
+func opConstantOperand(op int) bool {
+	switch op {
+	case opLiteral, opGlobal, opDefGlobal, opUndefGlobal, opDefMacro, opUse, opClosure,
+		opModule, opExport, opImport, opJumpTable:
+		return true
+	}
+	return false
+}
+
+// opLength returns the number of ints the instruction occupies, including the opcode
+func opLength(op int) int {
+	switch op {
+	case opLocal, opSetLocal, opRecur:
+		return 3
+	case opLiteral, opGlobal, opDefGlobal, opUndefGlobal, opDefMacro, opUse, opClosure,
+		opModule, opExport, opImport, opCall, opTailCall, opJumpFalse, opJump, opArray, opStruct, opTry,
+		opJumpTable:
+		return 2
+	}
+	return 1
+}
+
+type vemWriter struct {
+	vm         *VM
+	w          *bufio.Writer
+	uninterned map[*Object]int
+	buf        [binary.MaxVarintLen64]byte
+}
+
+type vemReader struct {
+	vm         *VM
+	r          *bufio.Reader
+	uninterned []*Object
+}
+
+// WriteModule writes the thunks in the compiled module format
+func (vm *VM) WriteModule(w io.Writer, thunks []*Object) error {
+	mw := &vemWriter{vm: vm, w: bufio.NewWriter(w), uninterned: make(map[*Object]int)}
+	mw.w.WriteString(vemMagic)
+	mw.writeUint(VemVersion)
+	mw.writeUint(uint64(len(thunks)))
+	for _, thunk := range thunks {
+		if err := mw.writeCode(thunk.code); err != nil {
+			return err
+		}
+	}
+	if err := mw.w.Flush(); err != nil {
+		return Error(IOErrorKey, err.Error())
+	}
+	return nil
+}
+
+// ReadModule reads the thunks of a compiled module, adding their constants to the VM
+func (vm *VM) ReadModule(r io.Reader) ([]*Object, error) {
+	mr := &vemReader{vm: vm, r: bufio.NewReader(r)}
+	magic := make([]byte, len(vemMagic))
+	if _, err := io.ReadFull(mr.r, magic); err != nil || string(magic) != vemMagic {
+		return nil, Error(IOErrorKey, "Not a compiled vesper module")
+	}
+	version, err := mr.readUint()
+	if err != nil {
+		return nil, err
+	}
+	if version != VemVersion {
+		return nil, Error(IOErrorKey, fmt.Sprintf("Unsupported module version %d, expected %d", version, VemVersion))
+	}
+	count, err := mr.readUint()
+	if err != nil {
+		return nil, err
+	}
+	var thunks []*Object
+	for i := uint64(0); i < count; i++ {
+		thunk, err := mr.readCode()
+		if err != nil {
+			return nil, err
+		}
+		thunks = append(thunks, thunk)
+	}
+	return thunks, nil
+}
+
+// CompileModuleFile compiles a source file and writes it to the output file as a compiled module
+func (vm *VM) CompileModuleFile(name string, output string) error {
+	thunks, err := vm.compileFileThunks(name)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	err = vm.WriteModule(&buf, thunks)
+	if err != nil {
+		return err
+	}
+	return SpitFile(output, buf.String())
+}
+
+// loadModuleFile executes the thunks of a compiled module in order
+func (vm *VM) loadModuleFile(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return Error(IOErrorKey, err.Error())
+	}
+	defer f.Close()
+	thunks, err := vm.ReadModule(f)
+	if err != nil {
+		return err
+	}
+	for _, thunk := range thunks {
+		_, err = vm.importCode(context.Background(), thunk)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (mw *vemWriter) writeUint(n uint64) {
+	l := binary.PutUvarint(mw.buf[:], n)
+	mw.w.Write(mw.buf[:l])
+}
+
+func (mw *vemWriter) writeInt(n int64) {
+	l := binary.PutVarint(mw.buf[:], n)
+	mw.w.Write(mw.buf[:l])
+}
+
+func (mw *vemWriter) writeString(s string) {
+	mw.writeUint(uint64(len(s)))
+	mw.w.WriteString(s)
+}
+
+func (mw *vemWriter) writeObjects(objs []*Object) error {
+	mw.writeUint(uint64(len(objs)))
+	for _, o := range objs {
+		if err := mw.writeObject(o); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (mw *vemWriter) writeOptionalObjects(objs []*Object) error {
+	if objs == nil {
+		mw.w.WriteByte(0)
+		return nil
+	}
+	mw.w.WriteByte(1)
+	return mw.writeObjects(objs)
+}
+
+func (mw *vemWriter) writeCode(code *Code) error {
+	// renumber the constants used by the code into a table local to it
+	var constants []*Object
+	indexes := make(map[int]int)
+	ops := make([]int, len(code.ops))
+	copy(ops, code.ops)
+	for pc := 0; pc < len(ops); pc += opLength(ops[pc]) {
+		if opConstantOperand(ops[pc]) {
+			idx, ok := indexes[ops[pc+1]]
+			if !ok {
+				idx = len(constants)
+				indexes[ops[pc+1]] = idx
+				constants = append(constants, mw.vm.constants.get(ops[pc+1]))
+			}
+			ops[pc+1] = idx
+		}
+	}
+	mw.writeString(code.name)
+	mw.writeUint(uint64(code.argc))
+	if err := mw.writeOptionalObjects(code.defaults); err != nil {
+		return err
+	}
+	if err := mw.writeOptionalObjects(code.keys); err != nil {
+		return err
+	}
+	if err := mw.writeObjects(constants); err != nil {
+		return err
+	}
+	mw.writeUint(uint64(len(ops)))
+	for _, op := range ops {
+		mw.writeInt(int64(op))
+	}
+	mw.writeUint(uint64(len(code.lines)))
+	for _, line := range code.lines {
+		mw.writeUint(uint64(line.pc))
+		mw.writeString(line.pos.File)
+		mw.writeUint(uint64(line.pos.Line))
+		mw.writeUint(uint64(line.pos.Column))
+	}
+	return nil
+}
+
+func (mw *vemWriter) writeObject(obj *Object) error {
+	switch obj.Type {
+	case NullType:
+		mw.w.WriteByte(vemNull)
+	case BooleanType:
+		if obj == True {
+			mw.w.WriteByte(vemTrue)
+		} else {
+			mw.w.WriteByte(vemFalse)
+		}
+	case NumberType:
+		switch n := obj.Value.(type) {
+		case fixnum:
+			mw.w.WriteByte(vemFixnum)
+			mw.writeInt(obj.ival)
+		case *big.Int:
+			mw.w.WriteByte(vemBignum)
+			mw.writeString(n.String())
+		case *big.Rat:
+			mw.w.WriteByte(vemRatio)
+			mw.writeString(n.String())
+		default:
+			mw.w.WriteByte(vemFloat)
+			mw.writeUint(math.Float64bits(obj.fval))
+		}
+	case CharacterType:
+		mw.w.WriteByte(vemCharacter)
+		mw.writeUint(uint64(RuneValue(obj)))
+	case StringType:
+		mw.w.WriteByte(vemString)
+		mw.writeString(obj.text)
+	case SymbolType, KeywordType, TypeType:
+		if sym, ok := mw.vm.lookupSymbol(obj.text); ok && sym == obj {
+			mw.w.WriteByte(vemSymbol)
+			mw.writeString(obj.text)
+		} else {
+			// uninterned symbols keep their identity within the module
+			idx, ok := mw.uninterned[obj]
+			if !ok {
+				idx = len(mw.uninterned)
+				mw.uninterned[obj] = idx
+			}
+			mw.w.WriteByte(vemUninterned)
+			mw.writeUint(uint64(idx))
+			mw.writeString(obj.Type.text)
+			mw.writeString(obj.text)
+		}
+	case BlobType:
+		mw.w.WriteByte(vemBlob)
+		mw.writeString(string(BlobValue(obj)))
+	case ListType:
+		if obj == EmptyList {
+			mw.w.WriteByte(vemEmptyList)
+			break
+		}
+		var elements []*Object
+		for obj.Type == ListType && obj != EmptyList {
+			elements = append(elements, obj.car)
+			obj = obj.cdr
+		}
+		mw.w.WriteByte(vemList)
+		if err := mw.writeObjects(elements); err != nil {
+			return err
+		}
+		return mw.writeObject(obj)
+	case ArrayType:
+		mw.w.WriteByte(vemArray)
+		return mw.writeObjects(obj.elements)
+	case StructType:
+		mw.w.WriteByte(vemStruct)
+		mw.writeUint(uint64(len(obj.bindings)))
+		for k, v := range obj.bindings {
+			if err := mw.writeObject(k); err != nil {
+				return err
+			}
+			if err := mw.writeObject(v); err != nil {
+				return err
+			}
+		}
+	case VectorType:
+		mw.w.WriteByte(vemVector)
+		return mw.writeObjects(vectorValue(obj).elements())
+	case HashMapType:
+		mw.w.WriteByte(vemHashMap)
+		m := hashMapValue(obj)
+		keyvals := make([]*Object, 0, m.count*2)
+		m.root.each(func(e *hamtEntry) {
+			keyvals = append(keyvals, e.key, e.value)
+		})
+		return mw.writeObjects(keyvals)
+	case jumpTableType:
+		// written as the keys and offsets of the table, followed by the offset of the else clause
+		t := obj.Value.(*jumpTable)
+		el := make([]*Object, 0, len(t.keys)*2+1)
+		for _, key := range t.keys {
+			k, _ := jumpKeyOf(key)
+			el = append(el, key, Int(int64(t.offsets[k])))
+		}
+		mw.w.WriteByte(vemJumpTable)
+		return mw.writeObjects(append(el, Int(int64(t.otherwise))))
+	case CodeType:
+		mw.w.WriteByte(vemCode)
+		return mw.writeCode(obj.code)
+	case FunctionType:
+		// primitives are written by name, and read as the primitive of that name in the
+		// VM that loads the module
+		if obj.primitive == nil || mw.vm.builtin(obj.primitive.name) != obj {
+			return Error(ArgumentErrorKey, "Cannot write a ", obj.Type, " to a compiled module")
+		}
+		mw.w.WriteByte(vemPrimitive)
+		mw.writeString(obj.primitive.name)
+	default:
+		return Error(ArgumentErrorKey, "Cannot write a ", obj.Type, " to a compiled module")
+	}
+	return nil
+}
+
+func (mr *vemReader) corrupt() error {
+	return Error(IOErrorKey, "Corrupt compiled vesper module")
+}
+
+func (mr *vemReader) readUint() (uint64, error) {
+	n, err := binary.ReadUvarint(mr.r)
+	if err != nil {
+		return 0, mr.corrupt()
+	}
+	return n, nil
+}
+
+func (mr *vemReader) readInt() (int64, error) {
+	n, err := binary.ReadVarint(mr.r)
+	if err != nil {
+		return 0, mr.corrupt()
+	}
+	return n, nil
+}
+
+func (mr *vemReader) readString() (string, error) {
+	n, err := mr.readUint()
+	if err != nil {
+		return "", err
+	}
+	if n > math.MaxInt32 {
+		return "", mr.corrupt()
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(mr.r, buf); err != nil {
+		return "", mr.corrupt()
+	}
+	return string(buf), nil
+}
+
+func (mr *vemReader) readObjects() ([]*Object, error) {
+	n, err := mr.readUint()
+	if err != nil {
+		return nil, err
+	}
+	objs := []*Object{}
+	for i := uint64(0); i < n; i++ {
+		obj, err := mr.readObject()
+		if err != nil {
+			return nil, err
+		}
+		objs = append(objs, obj)
+	}
+	return objs, nil
+}
+
+func (mr *vemReader) readOptionalObjects() ([]*Object, error) {
+	present, err := mr.r.ReadByte()
+	if err != nil {
+		return nil, mr.corrupt()
+	}
+	if present == 0 {
+		return nil, nil
+	}
+	return mr.readObjects()
+}
+
+func (mr *vemReader) readCode() (*Object, error) {
+	name, err := mr.readString()
+	if err != nil {
+		return nil, err
+	}
+	argc, err := mr.readUint()
+	if err != nil {
+		return nil, err
+	}
+	defaults, err := mr.readOptionalObjects()
+	if err != nil {
+		return nil, err
+	}
+	keys, err := mr.readOptionalObjects()
+	if err != nil {
+		return nil, err
+	}
+	constants, err := mr.readObjects()
+	if err != nil {
+		return nil, err
+	}
+	n, err := mr.readUint()
+	if err != nil {
+		return nil, err
+	}
+	var ops []int
+	for i := uint64(0); i < n; i++ {
+		op, err := mr.readInt()
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, int(op))
+	}
+	// map the local constant indexes back into the constant pool of the VM
+	for pc := 0; pc < len(ops); pc += opLength(ops[pc]) {
+		op := ops[pc]
+		if op < 0 || op >= opCount || pc+opLength(op) > len(ops) {
+			return nil, mr.corrupt()
+		}
+		if opConstantOperand(op) {
+			idx := ops[pc+1]
+			if idx < 0 || idx >= len(constants) {
+				return nil, mr.corrupt()
+			}
+			ops[pc+1] = mr.vm.putConstant(constants[idx])
+		}
+	}
+	n, err = mr.readUint()
+	if err != nil {
+		return nil, err
+	}
+	var lines []codePosition
+	for i := uint64(0); i < n; i++ {
+		pc, err := mr.readUint()
+		if err != nil {
+			return nil, err
+		}
+		file, err := mr.readString()
+		if err != nil {
+			return nil, err
+		}
+		line, err := mr.readUint()
+		if err != nil {
+			return nil, err
+		}
+		col, err := mr.readUint()
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, codePosition{int(pc), &Position{File: file, Line: int(line), Column: int(col)}})
+	}
+	code := MakeCode(mr.vm, int(argc), defaults, keys, name)
+	code.code.ops = ops
+	code.code.lines = lines
+	return code, nil
+}
+
+func (mr *vemReader) readObject() (*Object, error) {
+	tag, err := mr.r.ReadByte()
+	if err != nil {
+		return nil, mr.corrupt()
+	}
+	switch tag {
+	case vemNull:
+		return Null, nil
+	case vemTrue:
+		return True, nil
+	case vemFalse:
+		return False, nil
+	case vemEmptyList:
+		return EmptyList, nil
+	case vemFixnum:
+		n, err := mr.readInt()
+		if err != nil {
+			return nil, err
+		}
+		return Int(n), nil
+	case vemBignum:
+		s, err := mr.readString()
+		if err != nil {
+			return nil, err
+		}
+		n, ok := new(big.Int).SetString(s, 10)
+		if !ok {
+			return nil, mr.corrupt()
+		}
+		return BigInt(n), nil
+	case vemRatio:
+		s, err := mr.readString()
+		if err != nil {
+			return nil, err
+		}
+		r, ok := new(big.Rat).SetString(s)
+		if !ok {
+			return nil, mr.corrupt()
+		}
+		return Rational(r), nil
+	case vemFloat:
+		bits, err := mr.readUint()
+		if err != nil {
+			return nil, err
+		}
+		return Number(math.Float64frombits(bits)), nil
+	case vemCharacter:
+		c, err := mr.readUint()
+		if err != nil {
+			return nil, err
+		}
+		return Character(rune(c)), nil
+	case vemString:
+		s, err := mr.readString()
+		if err != nil {
+			return nil, err
+		}
+		return String(s), nil
+	case vemSymbol:
+		s, err := mr.readString()
+		if err != nil {
+			return nil, err
+		}
+		return mr.vm.Intern(s), nil
+	case vemUninterned:
+		idx, err := mr.readUint()
+		if err != nil {
+			return nil, err
+		}
+		t, err := mr.readString()
+		if err != nil {
+			return nil, err
+		}
+		s, err := mr.readString()
+		if err != nil {
+			return nil, err
+		}
+		if idx < uint64(len(mr.uninterned)) {
+			return mr.uninterned[idx], nil
+		}
+		if idx != uint64(len(mr.uninterned)) {
+			return nil, mr.corrupt()
+		}
+		sym := &Object{Type: mr.vm.Intern(t), text: s}
+		mr.uninterned = append(mr.uninterned, sym)
+		return sym, nil
+	case vemBlob:
+		s, err := mr.readString()
+		if err != nil {
+			return nil, err
+		}
+		return Blob([]byte(s)), nil
+	case vemList:
+		elements, err := mr.readObjects()
+		if err != nil {
+			return nil, err
+		}
+		tail, err := mr.readObject()
+		if err != nil {
+			return nil, err
+		}
+		for i := len(elements) - 1; i >= 0; i-- {
+			tail = Cons(elements[i], tail)
+		}
+		return tail, nil
+	case vemArray:
+		elements, err := mr.readObjects()
+		if err != nil {
+			return nil, err
+		}
+		return ArrayFromElementsNoCopy(elements), nil
+	case vemStruct:
+		n, err := mr.readUint()
+		if err != nil {
+			return nil, err
+		}
+		strct := MakeStruct(int(n))
+		for i := uint64(0); i < n; i++ {
+			k, err := mr.readObject()
+			if err != nil {
+				return nil, err
+			}
+			v, err := mr.readObject()
+			if err != nil {
+				return nil, err
+			}
+			Put(strct, k, v)
+		}
+		return strct, nil
+	case vemVector:
+		elements, err := mr.readObjects()
+		if err != nil {
+			return nil, err
+		}
+		return Vector(elements...), nil
+	case vemHashMap:
+		keyvals, err := mr.readObjects()
+		if err != nil {
+			return nil, err
+		}
+		if len(keyvals)%2 != 0 {
+			return nil, mr.corrupt()
+		}
+		return HashMap(keyvals...)
+	case vemJumpTable:
+		el, err := mr.readObjects()
+		if err != nil {
+			return nil, err
+		}
+		t, err := jumpTableFromArray(ArrayFromElementsNoCopy(el))
+		if err != nil {
+			return nil, mr.corrupt()
+		}
+		return t, nil
+	case vemCode:
+		return mr.readCode()
+	case vemPrimitive:
+		name, err := mr.readString()
+		if err != nil {
+			return nil, err
+		}
+		prim := mr.vm.builtin(name)
+		if prim == nil {
+			return nil, Error(IOErrorKey, "Compiled vesper module uses an undefined primitive: ", name)
+		}
+		return prim, nil
+	}
+	return nil, mr.corrupt()
+}
@@ -1,20 +1,41 @@
 package vesper
 
 import (
+	"context"
 	"fmt"
-	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // VM - the Vesper VM
+//
+// A VM may be used from several goroutines at once, as it is by tasks started with go.
+// Its symbol, global, macro and constant tables are safe for concurrent use, and running
+// code reads them without taking locks. Loading a file that declares a module changes the
+// current module for the duration of the load, so other goroutines should not compile code
+// while such a load is in progress. Vesper lists, arrays and structs are not synchronized,
+// and must not be modified by one goroutine while another is using them. StackSize,
+// MaxStackSize, MaxFrameDepth, Flags and Extensions should be set before the VM is shared.
 type VM struct {
-	StackSize    int
-	Symbols      map[string]*Object
-	MacroMap     map[*Object]*Macro
-	ConstantsMap map[*Object]int
-	Constants    []*Object
-	Extensions   []Extension
-	Flags        Flags
+	executed      int64     // instructions executed, counted while there is an instruction limit
+	StackSize     int       // the initial size of the operand stack of each execution
+	MaxStackSize  int       // the size the operand stack may grow to, or 0 for no limit
+	MaxFrameDepth int       // the maximum depth of nested function calls, or 0 for no limit
+	symbols       *sync.Map // string -> *Object
+	globals       *sync.Map // *Object -> *Object
+	macros        *sync.Map // *Object -> *Macro
+	signatures    *sync.Map // string -> []*Object, see arglistSignatures
+	goTypes       *sync.Map // reflect.Type -> *goType, see DefineGoType
+	primitives    *sync.Map // string -> *Object, the primitive functions defined by name
+	constants     *constantPool
+	modulesMutex  sync.Mutex
+	modules       map[string]*module
+	module        atomic.Value // *module, the module that code is compiled in
+	limits        Limits
+	denied        Capabilities
+	Extensions    []Extension
+	Flags         Flags
 }
 
 // Flags a set of flags for the virtual machine
@@ -24,40 +45,54 @@ type Flags struct {
 	Interactive bool
 }
 
-const defaultStackSize = 1000
+const (
+	defaultStackSize     = 1000
+	defaultMaxStackSize  = 1000000
+	defaultMaxFrameDepth = 100000
 
-var interrupted = false
-var interrupts chan os.Signal
-
-func checkInterrupt() bool {
-	if interrupts != nil {
-		select {
-		case msg := <-interrupts:
-			if msg != nil {
-				interrupted = true
-				return true
-			}
-		default:
-			return false
-		}
-	}
-	return false
-}
+	// the initial stack size of a function called back from a primitive, which are
+	// usually small, such as comparators. The stack grows if they need more.
+	callbackStackSize = 64
+)
 
 // NewVM creates a new VM
 func NewVM() *VM {
 	return CloneVM(defaultVM)
 }
 
-// CloneVM creates a clone of the original VM
+// CloneVM creates a clone of the original VM. The clone starts with the same
+// global bindings, but later definitions in either VM are not seen by the other.
 func CloneVM(copy *VM) *VM {
-	return &VM{
-		StackSize:    copy.StackSize,
-		Symbols:      copyEnv(copy.Symbols),
-		MacroMap:     copyMacros(copy.MacroMap),
-		ConstantsMap: copyConstantMap(copy.ConstantsMap),
-		Constants:    copyConstants(copy.Constants),
+	copy.modulesMutex.Lock()
+	modules := copyModules(copy.modules)
+	copy.modulesMutex.Unlock()
+	vm := &VM{
+		StackSize:     copy.StackSize,
+		MaxStackSize:  copy.MaxStackSize,
+		MaxFrameDepth: copy.MaxFrameDepth,
+		symbols:       copyTable(copy.symbols),
+		globals:       copyTable(copy.globals),
+		macros:        copyTable(copy.macros),
+		signatures:    copyTable(copy.signatures),
+		goTypes:       copyTable(copy.goTypes),
+		primitives:    copyTable(copy.primitives),
+		constants:     newConstantPool(copy.constants),
+		modules:       modules,
+		limits:        copy.limits,
+		denied:        copy.denied,
 	}
+	vm.module.Store(copy.currentModule().copy())
+	return vm
+}
+
+// tryHandler records the state to restore when an error is raised inside the
+// body of a try form.
+type tryHandler struct {
+	fun *Object // the handler closure, called with the error object
+	ops []int
+	pc  int
+	sp  int
+	env *frame
 }
 
 func addContext(env *frame, err error) error {
@@ -87,6 +122,40 @@ func (vm *VM) keywordCall(fun *Object, argc int, pc int, stack []*Object, sp int
 	return pc, sp, nil
 }
 
+// numericOp performs the two argument arithmetic and comparison instructions, which the
+// compiler emits in place of calls to the corresponding primitives.
+func numericOp(op int, n1 *Object, n2 *Object) (*Object, error) {
+	if n1.Type != NumberType || n2.Type != NumberType {
+		names := map[int]string{opAdd: "+", opSub: "-", opMul: "*", opDiv: "/", opNumEqual: "=",
+			opNumLess: "<", opNumLessEqual: "<=", opNumGreater: ">", opNumGreaterEqual: ">="}
+		i, arg := 1, n1
+		if n1.Type == NumberType {
+			i, arg = 2, n2
+		}
+		return nil, Error(ArgumentErrorKey, fmt.Sprintf("%s expected a %s for argument %d, got a %s", names[op], NumberType.text, i, arg.Type.text))
+	}
+	switch op {
+	case opAdd:
+		return numberAdd(n1, n2), nil
+	case opSub:
+		return numberSub(n1, n2), nil
+	case opMul:
+		return numberMul(n1, n2), nil
+	case opDiv:
+		return numberDiv(n1, n2)
+	case opNumEqual:
+		return toVesperBool(numberCompare(n1, n2) == 0)
+	case opNumLess:
+		return toVesperBool(numberCompare(n1, n2) < 0)
+	case opNumLessEqual:
+		return toVesperBool(numberCompare(n1, n2) <= 0)
+	case opNumGreater:
+		return toVesperBool(numberCompare(n1, n2) > 0)
+	default:
+		return toVesperBool(numberCompare(n1, n2) >= 0)
+	}
+}
+
 func argcError(name string, min int, max int, provided int) error {
 	s := "1 argument"
 	if min == max {
@@ -101,9 +170,17 @@ func argcError(name string, min int, max int, provided int) error {
 	return Error(ArgumentErrorKey, fmt.Sprintf("%s expected %s, got %d", name, s, provided))
 }
 
-func (vm *VM) callPrimitive(prim *primitive, argv []*Object) (*Object, error) {
+func (vm *VM) callPrimitive(ctx context.Context, prim *primitive, argv []*Object) (*Object, error) {
+	result, err := vm.applyPrimitive(ctx, prim, argv)
+	if err == nil && vm.limits.MaxCollectionSize > 0 {
+		err = vm.checkResultSize(result, argv)
+	}
+	return result, err
+}
+
+func (vm *VM) applyPrimitive(ctx context.Context, prim *primitive, argv []*Object) (*Object, error) {
 	if prim.defaults != nil {
-		return vm.callPrimitiveWithDefaults(prim, argv)
+		return vm.callPrimitiveWithDefaults(ctx, prim, argv)
 	}
 	argc := len(argv)
 	if argc != prim.argc {
@@ -115,10 +192,10 @@ func (vm *VM) callPrimitive(prim *primitive, argv []*Object) (*Object, error) {
 			return nil, Error(ArgumentErrorKey, fmt.Sprintf("%s expected a %s for argument %d, got a %s", prim.name, prim.args[i].text, i+1, argv[i].Type.text))
 		}
 	}
-	return prim.fun(argv)
+	return prim.call(vm, ctx, argv)
 }
 
-func (vm *VM) callPrimitiveWithDefaults(prim *primitive, argv []*Object) (*Object, error) {
+func (vm *VM) callPrimitiveWithDefaults(ctx context.Context, prim *primitive, argv []*Object) (*Object, error) {
 	provided := len(argv)
 	minargc := prim.argc
 	if len(prim.defaults) == 0 {
@@ -141,7 +218,7 @@ func (vm *VM) callPrimitiveWithDefaults(prim *primitive, argv []*Object) (*Objec
 				}
 			}
 		}
-		return prim.fun(argv)
+		return prim.call(vm, ctx, argv)
 	}
 	maxargc := len(prim.args)
 	if provided < minargc {
@@ -198,16 +275,13 @@ func (vm *VM) callPrimitiveWithDefaults(prim *primitive, argv []*Object) (*Objec
 			return nil, Error(ArgumentErrorKey, fmt.Sprintf("%s expected a %s for argument %d, got a %s", prim.name, prim.args[i].text, i+1, argv[i].Type.text))
 		}
 	}
-	return prim.fun(argv)
+	return prim.call(vm, ctx, argv)
 }
 
-func (vm *VM) funcall(fun *Object, argc int, ops []int, savedPc int, stack []*Object, sp int, env *frame) ([]int, int, int, *frame, error) {
+func (vm *VM) funcall(ctx context.Context, fun *Object, argc int, ops []int, savedPc int, stack []*Object, sp int, env *frame, handlers *[]tryHandler) ([]int, int, int, *frame, error) {
 opCallAgain:
 	if fun.Type == FunctionType {
 		if fun.code != nil {
-			if interrupted || checkInterrupt() {
-				return nil, 0, 0, nil, addContext(env, Error(InterruptKey))
-			}
 			if fun.code.defaults == nil {
 				f := &frame{
 					previous: env,
@@ -216,6 +290,12 @@ opCallAgain:
 					locals:   fun.frame,
 					code:     fun.code,
 				}
+				if env != nil {
+					f.depth = env.depth + 1
+					if err := vm.checkStackDepth(f); err != nil {
+						return nil, 0, 0, nil, addContext(env, err)
+					}
+				}
 				expectedArgc := fun.code.argc
 				if argc != expectedArgc {
 					return nil, 0, 0, nil, Error(ArgumentErrorKey, "Wrong number of args to ", fun, " (expected ", expectedArgc, ", got ", argc, ")")
@@ -231,7 +311,7 @@ opCallAgain:
 			}
 			f, err := vm.buildFrame(env, savedPc, ops, fun, argc, stack, sp)
 			if err != nil {
-				return vm.catch(err, stack, env)
+				return nil, 0, 0, nil, addContext(env, err)
 			}
 			sp += argc
 			env = f
@@ -239,9 +319,9 @@ opCallAgain:
 			return ops, 0, sp, env, err
 		}
 		if fun.primitive != nil {
-			val, err := vm.callPrimitive(fun.primitive, stack[sp:sp+argc])
+			val, err := vm.callPrimitive(ctx, fun.primitive, stack[sp:sp+argc])
 			if err != nil {
-				return vm.catch(err, stack, env)
+				return nil, 0, 0, nil, addContext(env, err)
 			}
 			sp = sp + argc - 1
 			stack[sp] = val
@@ -250,13 +330,13 @@ opCallAgain:
 		if fun == Apply {
 			if argc < 2 {
 				err := Error(ArgumentErrorKey, "apply expected at least 2 arguments, got ", argc)
-				return vm.catch(err, stack, env)
+				return nil, 0, 0, nil, addContext(env, err)
 			}
 			fun = stack[sp]
 			args := stack[sp+argc-1]
 			if !IsList(args) {
 				err := Error(ArgumentErrorKey, "apply expected a <list> as its final argument")
-				return vm.catch(err, stack, env)
+				return nil, 0, 0, nil, addContext(env, err)
 			}
 			arglist := args
 			for i := argc - 2; i > 0; i-- {
@@ -264,6 +344,10 @@ opCallAgain:
 			}
 			sp += argc
 			argc = ListLength(arglist)
+			if argc > sp {
+				err := Error(StackOverflowKey, "too many arguments for apply: ", argc)
+				return nil, 0, 0, nil, addContext(env, err)
+			}
 			i := 0
 			sp -= argc
 			for arglist != EmptyList {
@@ -276,16 +360,22 @@ opCallAgain:
 		if fun == CallCC {
 			if argc != 1 {
 				err := Error(ArgumentErrorKey, "callcc expected 1 argument, got ", argc)
-				return vm.catch(err, stack, env)
+				return nil, 0, 0, nil, addContext(env, err)
 			}
 			fun = stack[sp]
-			stack[sp] = Continuation(env, ops, savedPc, stack[sp+1:])
+			k := Continuation(env, ops, savedPc, stack[sp+1:])
+			k.continuation.handlers = saveHandlers(*handlers, len(stack))
+			stack[sp] = k
 			goto opCallAgain
 		}
 		if fun.continuation != nil {
 			if argc != 1 {
 				err := Error(ArgumentErrorKey, "#[continuation] expected 1 argument, got ", argc)
-				return vm.catch(err, stack, env)
+				return nil, 0, 0, nil, addContext(env, err)
+			}
+			if len(fun.continuation.stack) >= len(stack) {
+				err := Error(StackOverflowKey, "continuation stack too large: ", len(fun.continuation.stack))
+				return nil, 0, 0, nil, addContext(env, err)
 			}
 			arg := stack[sp]
 			sp = len(stack) - len(fun.continuation.stack)
@@ -293,15 +383,16 @@ opCallAgain:
 			copy(segment, fun.continuation.stack)
 			sp--
 			stack[sp] = arg
+			*handlers = restoreHandlers(fun.continuation.handlers, len(stack))
 			return fun.continuation.ops, fun.continuation.pc, sp, fun.frame, nil
 		}
 		if fun == GoFunc {
-			err := vm.spawn(stack[sp], argc-1, stack, sp+1)
+			t, err := vm.spawn(stack[sp], argc-1, stack, sp+1)
 			if err != nil {
-				return vm.catch(err, stack, env)
+				return nil, 0, 0, nil, addContext(env, err)
 			}
 			sp = sp + argc - 1
-			stack[sp] = Null
+			stack[sp] = t
 			return ops, savedPc, sp, env, err
 		}
 		return nil, 0, 0, nil, Error(InternalErrorKey, "unsupported instruction")
@@ -309,20 +400,20 @@ opCallAgain:
 	if fun.Type == KeywordType {
 		if argc != 1 {
 			err := Error(ArgumentErrorKey, fun.text, " expected 1 argument, got ", argc)
-			return vm.catch(err, stack, env)
+			return nil, 0, 0, nil, addContext(env, err)
 		}
 		v, err := Get(stack[sp], fun)
 		if err != nil {
-			return vm.catch(err, stack, env)
+			return nil, 0, 0, nil, addContext(env, err)
 		}
 		stack[sp] = v
 		return ops, savedPc, sp, env, err
 	}
 	err := Error(ArgumentErrorKey, "Not a function: ", fun)
-	return vm.catch(err, stack, env)
+	return nil, 0, 0, nil, addContext(env, err)
 }
 
-func (vm *VM) tailcall(fun *Object, argc int, ops []int, stack []*Object, sp int, env *frame) ([]int, int, int, *frame, error) {
+func (vm *VM) tailcall(ctx context.Context, fun *Object, argc int, ops []int, stack []*Object, sp int, env *frame, handlers *[]tryHandler) ([]int, int, int, *frame, error) {
 opTailCallAgain:
 	if fun.Type == FunctionType {
 		if fun.code != nil {
@@ -337,15 +428,15 @@ opTailCallAgain:
 			}
 			f, err := vm.buildFrame(env.previous, env.pc, env.ops, fun, argc, stack, sp)
 			if err != nil {
-				return vm.catch(err, stack, env)
+				return nil, 0, 0, nil, addContext(env, err)
 			}
 			sp += argc
 			return fun.code.ops, 0, sp, f, nil
 		}
 		if fun.primitive != nil {
-			val, err := vm.callPrimitive(fun.primitive, stack[sp:sp+argc])
+			val, err := vm.callPrimitive(ctx, fun.primitive, stack[sp:sp+argc])
 			if err != nil {
-				return vm.catch(err, stack, env)
+				return nil, 0, 0, nil, addContext(env, err)
 			}
 			sp = sp + argc - 1
 			stack[sp] = val
@@ -354,13 +445,13 @@ opTailCallAgain:
 		if fun == Apply {
 			if argc < 2 {
 				err := Error(ArgumentErrorKey, "apply expected at least 2 arguments, got ", argc)
-				return vm.catch(err, stack, env)
+				return nil, 0, 0, nil, addContext(env, err)
 			}
 			fun = stack[sp]
 			args := stack[sp+argc-1]
 			if !IsList(args) {
 				err := Error(ArgumentErrorKey, "apply expected its last argument to be a <list>")
-				return vm.catch(err, stack, env)
+				return nil, 0, 0, nil, addContext(env, err)
 			}
 			arglist := args
 			for i := argc - 2; i > 0; i-- {
@@ -368,6 +459,10 @@ opTailCallAgain:
 			}
 			sp += argc
 			argc = ListLength(arglist)
+			if argc > sp {
+				err := Error(StackOverflowKey, "too many arguments for apply: ", argc)
+				return nil, 0, 0, nil, addContext(env, err)
+			}
 			i := 0
 			sp -= argc
 			for arglist != EmptyList {
@@ -380,7 +475,11 @@ opTailCallAgain:
 		if fun.continuation != nil {
 			if argc != 1 {
 				err := Error(ArgumentErrorKey, "#[continuation] expected 1 argument, got ", argc)
-				return vm.catch(err, stack, env)
+				return nil, 0, 0, nil, addContext(env, err)
+			}
+			if len(fun.continuation.stack) >= len(stack) {
+				err := Error(StackOverflowKey, "continuation stack too large: ", len(fun.continuation.stack))
+				return nil, 0, 0, nil, addContext(env, err)
 			}
 			arg := stack[sp]
 			sp = len(stack) - len(fun.continuation.stack)
@@ -388,24 +487,27 @@ opTailCallAgain:
 			copy(segment, fun.continuation.stack)
 			sp--
 			stack[sp] = arg
+			*handlers = restoreHandlers(fun.continuation.handlers, len(stack))
 			return fun.continuation.ops, fun.continuation.pc, sp, fun.frame, nil
 		}
 		if fun == CallCC {
 			if argc != 1 {
 				err := Error(ArgumentErrorKey, "callcc expected 1 argument, got ", argc)
-				return vm.catch(err, stack, env)
+				return nil, 0, 0, nil, addContext(env, err)
 			}
 			fun = stack[sp]
-			stack[sp] = Continuation(env.previous, env.ops, env.pc, stack[sp:])
+			k := Continuation(env.previous, env.ops, env.pc, stack[sp:])
+			k.continuation.handlers = saveHandlers(*handlers, len(stack))
+			stack[sp] = k
 			goto opTailCallAgain
 		}
 		if fun == GoFunc {
-			err := vm.spawn(stack[sp], argc-1, stack, sp+1)
+			t, err := vm.spawn(stack[sp], argc-1, stack, sp+1)
 			if err != nil {
-				return vm.catch(err, stack, env)
+				return nil, 0, 0, nil, addContext(env, err)
 			}
 			sp = sp + argc - 1
-			stack[sp] = Null
+			stack[sp] = t
 			return env.ops, env.pc, sp, env.previous, nil
 		}
 		return nil, 0, 0, nil, Error(InternalErrorKey, "Not a function: ", fun)
@@ -413,85 +515,141 @@ opTailCallAgain:
 	if fun.Type == KeywordType {
 		if argc != 1 {
 			err := Error(ArgumentErrorKey, fun.text, " expected 1 argument, got ", argc)
-			return vm.catch(err, stack, env)
+			return nil, 0, 0, nil, addContext(env, err)
 		}
 		v, err := Get(stack[sp], fun)
 		if err != nil {
-			return vm.catch(err, stack, env)
+			return nil, 0, 0, nil, addContext(env, err)
 		}
 		stack[sp] = v
 		return env.ops, env.pc, sp, env.previous, nil
 	}
 	err := Error(ArgumentErrorKey, "Not a function:", fun)
-	return vm.catch(err, stack, env)
+	return nil, 0, 0, nil, addContext(env, err)
 }
 
 func (vm *VM) keywordTailcall(fun *Object, argc int, ops []int, stack []*Object, sp int, env *frame) ([]int, int, int, *frame, error) {
 	if argc != 1 {
 		err := Error(ArgumentErrorKey, fun.text, " expected 1 argument, got ", argc)
-		return vm.catch(err, stack, env)
+		return nil, 0, 0, nil, addContext(env, err)
 	}
 	v, err := Get(stack[sp], fun)
 	if err != nil {
-		return vm.catch(err, stack, env)
+		return nil, 0, 0, nil, addContext(env, err)
 	}
 	stack[sp] = v
 	return env.ops, env.pc, sp, env.previous, nil
 }
 
 func (vm *VM) execCompileTime(code *Code, arg *Object) (*Object, error) {
-	args := []*Object{arg}
-	prev := vm.Flags.Verbose
-	vm.Flags.Verbose = false
-	res, err := vm.Execute(code, args)
-	vm.Flags.Verbose = prev
-	return res, err
+	return vm.execute(context.Background(), code, []*Object{arg}, false)
 }
 
-func (vm *VM) catch(err error, stack []*Object, env *frame) ([]int, int, int, *frame, error) {
-	errobj, ok := err.(*Object)
-	if !ok {
-		errobj = MakeError(ErrorKey, String(err.Error()))
+// evalState is kept by exec in the context of an evaluation. It holds the frame depth of the
+// call being made, so that functions called back from a primitive continue from that depth, and
+// the number of instructions executed since the limits were last checked.
+type evalState struct {
+	depth int
+	ticks int
+}
+
+type evalStateKey struct{}
+
+// callback returns a function that calls fun, for a primitive that was given it as an argument,
+// such as the comparator of sort. The calls run within the evaluation that called the primitive,
+// so unlike CallContext they do not start a new one: primitives and keywords are applied
+// directly, and closures run with the context and the instruction count, and so the limits, of
+// the caller. Their frames are deeper than the caller's, so that recursion through a callback is
+// subject to the frame depth limits. The stack they run on is reused from one call to the next,
+// so the function must not be called concurrently.
+func (vm *VM) callback(ctx context.Context, fun *Object) func(args ...*Object) (*Object, error) {
+	stack := make([]*Object, callbackStackSize)
+	depth := 0
+	state, ok := ctx.Value(evalStateKey{}).(*evalState)
+	if ok {
+		depth = state.depth + 1
 	}
-	handler := GetGlobal(vm.Intern("*top-handler*"))
-	if handler != nil && handler.Type == FunctionType {
-		if handler.code != nil {
-			if handler.code.argc == 1 {
-				sp := len(stack) - 1
-				stack[sp] = errobj
-				return vm.funcall(handler, 1, nil, 0, stack, sp, nil)
+	run := func(code *Code, env *frame) (*Object, error) {
+		if !ok {
+			return vm.exec(ctx, code, env, stack)
+		}
+		// continue the caller's count of instructions, leaving its depth as it was
+		caller := state.depth
+		result, err := vm.run(ctx, state, code, env, stack)
+		state.depth = caller
+		return result, err
+	}
+	return func(args ...*Object) (*Object, error) {
+		switch fun.Type {
+		case FunctionType:
+			if fun.primitive != nil {
+				return vm.callPrimitive(ctx, fun.primitive, args)
 			}
+			if fun.code != nil {
+				env, err := vm.buildFrame(nil, 0, nil, fun, len(args), args, 0)
+				if err != nil {
+					return nil, err
+				}
+				env.depth = depth
+				if err := vm.checkStackDepth(env); err != nil {
+					return nil, err
+				}
+				return run(fun.code, env)
+			}
+		case KeywordType:
+			if len(args) != 1 {
+				return nil, Error(ArgumentErrorKey, fun.text, " expected 1 argument, got ", len(args))
+			}
+			return Get(args[0], fun)
+		}
+		// apply, callcc and the like need the call instruction
+		code := callCode(vm, len(args))
+		env := &frame{elements: append([]*Object{fun}, args...), code: code, depth: depth}
+		if err := vm.checkStackDepth(env); err != nil {
+			return nil, err
 		}
+		return run(code, env)
 	}
-	return nil, 0, 0, nil, addContext(env, err)
 }
 
-func (vm *VM) spawn(fun *Object, argc int, stack []*Object, sp int) error {
-	if fun.Type == FunctionType {
-		if fun.code != nil {
-			env, err := vm.buildFrame(nil, 0, nil, fun, argc, stack, sp)
-			if err != nil {
-				return err
+// catch transfers control to the innermost active try handler, or failing that to
+// the *top-handler* global. If neither exists, the error is returned.
+func (vm *VM) catch(ctx context.Context, err error, stack []*Object, handlers *[]tryHandler) ([]int, int, int, *frame, error) {
+	errobj := errorObject(err)
+	if n := len(*handlers); n > 0 {
+		h := (*handlers)[n-1]
+		*handlers = (*handlers)[:n-1]
+		sp := h.sp - 1
+		stack[sp] = errobj
+		return vm.funcall(ctx, h.fun, 1, h.ops, h.pc, stack, sp, h.env, handlers)
+	}
+	handler := vm.GetGlobal(vm.Intern("*top-handler*"))
+	if handler != nil && handler.Type == FunctionType {
+		if handler.code != nil {
+			if handler.code.argc == 1 {
+				sp := len(stack) - 1
+				stack[sp] = errobj
+				return vm.funcall(ctx, handler, 1, nil, 0, stack, sp, nil, handlers)
 			}
-			go func(code *Code, env *frame) {
-				_, err := vm.exec(code, env)
-				if err != nil {
-					// TODO: How do we handle errors?
-					println("; [*** error in goroutine '", code.name, "': ", err, "]")
-				} else if vm.Flags.Verbose {
-					println("; [goroutine '", code.name, "' exited cleanly]")
-				}
-			}(fun.code, env)
-			return nil
 		}
-		// apply, go and callcc cannot be called directly in a goroutine
-		// TODO: Check this is no longer the case
 	}
-	return Error(ArgumentErrorKey, "Bad function for go: ", fun)
+	return nil, 0, 0, nil, err
 }
 
 // Execute runs the given code with the given arguments
 func (vm *VM) Execute(code *Code, args []*Object) (*Object, error) {
+	return vm.ExecuteContext(context.Background(), code, args)
+}
+
+// ExecuteContext runs the given code with the given arguments. If the context is cancelled or its
+// deadline passes, the execution stops with an interrupt: error, as do any blocked calls to
+// functions such as recv, send and sleep. Tasks that it started with go keep running, until
+// they finish or are stopped with cancel.
+func (vm *VM) ExecuteContext(ctx context.Context, code *Code, args []*Object) (*Object, error) {
+	return vm.execute(ctx, code, args, vm.Flags.Verbose)
+}
+
+func (vm *VM) execute(ctx context.Context, code *Code, args []*Object, verbose bool) (*Object, error) {
 	if len(args) != code.argc {
 		return nil, Error(ArgumentErrorKey, "Wrong number of arguments")
 	}
@@ -501,7 +659,9 @@ func (vm *VM) Execute(code *Code, args []*Object) (*Object, error) {
 	}
 	copy(env.elements, args)
 	startTime := time.Now()
-	result, err := vm.exec(code, env)
+	ctx, cancel := vm.limitContext(ctx)
+	defer cancel()
+	result, err := vm.exec(ctx, code, env, make([]*Object, vm.StackSize))
 	dur := time.Since(startTime)
 	if err != nil {
 		return nil, err
@@ -509,7 +669,7 @@ func (vm *VM) Execute(code *Code, args []*Object) (*Object, error) {
 	if result == nil {
 		return nil, Error(InternalErrorKey, "result should never be nil if no error")
 	}
-	if vm.Flags.Verbose {
+	if verbose {
 		println("; executed in ", dur.String())
 		if !vm.Flags.Interactive {
 			println("; => ", result.String())
@@ -518,20 +678,85 @@ func (vm *VM) Execute(code *Code, args []*Object) (*Object, error) {
 	return result, err
 }
 
-func (vm *VM) exec(code *Code, env *frame) (*Object, error) {
-	stack := make([]*Object, vm.StackSize)
-	sp := vm.StackSize
+// cancelCheckInterval is the number of instructions executed between checks for cancellation and limits
+const cancelCheckInterval = 1024
+
+// stackMargin is the number of free slots kept below the top of the operand stack, which is
+// more than any instruction pushes
+const stackMargin = 8
+
+// growStack returns a larger copy of the stack, with sp and the stack pointers of the handlers
+// moved to match, so that at least n more values can be pushed. The stack grows down from its
+// end, so the values keep their distance from the end. It returns a stack-overflow: error if the
+// stack would be larger than the VM's MaxStackSize.
+func (vm *VM) growStack(stack []*Object, sp int, n int, handlers []tryHandler) ([]*Object, int, error) {
+	used := len(stack) - sp
+	size := len(stack) * 2
+	if size < used+n {
+		size = used + n
+	}
+	if max := vm.MaxStackSize; max > 0 && size > max {
+		if used+n > max {
+			return stack, sp, Error(StackOverflowKey, "maximum stack size exceeded: ", max)
+		}
+		size = max
+	}
+	newStack := make([]*Object, size)
+	delta := size - len(stack)
+	copy(newStack[delta:], stack)
+	for i := range handlers {
+		handlers[i].sp += delta
+	}
+	return newStack, sp + delta, nil
+}
+
+// callStackNeeded returns the number of free slots that calling fun with the arguments on the stack
+// needs, for calls that can push more values than they pop
+func callStackNeeded(fun *Object, argc int, stack []*Object, sp int) int {
+	if fun == Apply && argc >= 2 {
+		if args := stack[sp+argc]; IsList(args) {
+			return ListLength(args) + stackMargin
+		}
+	} else if fun.continuation != nil {
+		// the continuation replaces the stack with its own
+		return len(fun.continuation.stack) - (len(stack) - sp) + stackMargin
+	}
+	return 0
+}
+
+// exec runs the code in the frame, using the stack for its operands. The stack grows as needed,
+// from the end of the slice.
+func (vm *VM) exec(ctx context.Context, code *Code, env *frame, stack []*Object) (*Object, error) {
+	if err := vm.checkInstructionCount(); err != nil {
+		return nil, err
+	}
+	state := &evalState{}
+	result, err := vm.run(context.WithValue(ctx, evalStateKey{}, state), state, code, env, stack)
+	vm.countInstructions(state)
+	return result, err
+}
+
+// run is the dispatch loop of exec, which keeps the state of the evaluation in state
+func (vm *VM) run(ctx context.Context, state *evalState, code *Code, env *frame, stack []*Object) (*Object, error) {
+	if len(stack) < stackMargin {
+		stack = make([]*Object, stackMargin)
+	}
+	sp := len(stack)
 	ops := code.ops
 	pc := 0
 	var err error
+	var handlers []tryHandler
+	checking := ctx.Done() != nil || vm.limits.MaxInstructions > 0
 	for {
 		op := ops[pc]
+		// the frame and pc of the op, in case it raises an error
+		opEnv, opPc := env, pc
 		switch op {
 		case opNone:
 
 		case opLiteral:
 			sp--
-			stack[sp] = vm.Constants[ops[pc+1]]
+			stack[sp] = vm.constants.get(ops[pc+1])
 			pc += 2
 
 		case opLocal:
@@ -559,17 +784,33 @@ func (vm *VM) exec(code *Code, env *frame) (*Object, error) {
 		case opJump:
 			pc += ops[pc+1]
 
+		case opJumpTable:
+			table := vm.constants.get(ops[pc+1]).Value.(*jumpTable)
+			pc += table.offset(stack[sp])
+			sp++
+
+		case opDup:
+			sp--
+			stack[sp] = stack[sp+1]
+			pc++
+
 		case opTailCall:
 			fun := stack[sp]
 			argc := ops[pc+1]
+			state.depth = env.depth
+			if n := callStackNeeded(fun, argc, stack, sp); n > sp {
+				if stack, sp, err = vm.growStack(stack, sp, n, handlers); err != nil {
+					err = addContext(env, err)
+					break
+				}
+			}
 			if fun.primitive != nil {
 				nextSp := sp + argc
-				val, err := vm.callPrimitive(fun.primitive, stack[sp+1:nextSp+1])
+				var val *Object
+				val, err = vm.callPrimitive(ctx, fun.primitive, stack[sp+1:nextSp+1])
 				if err != nil {
-					_, _, _, env, err = vm.catch(err, stack, env)
-					if err != nil {
-						return nil, err
-					}
+					err = addContext(env, err)
+					break
 				}
 				stack[nextSp] = val
 				sp = nextSp
@@ -580,65 +821,49 @@ func (vm *VM) exec(code *Code, env *frame) (*Object, error) {
 					return stack[sp], nil
 				}
 			} else if fun.Type == FunctionType {
-				ops, pc, sp, env, err = vm.tailcall(fun, argc, ops, stack, sp+1, env)
-				if err != nil {
-					return nil, err
-				}
-				if env == nil {
+				ops, pc, sp, env, err = vm.tailcall(ctx, fun, argc, ops, stack, sp+1, env, &handlers)
+				if err == nil && env == nil {
 					return stack[sp], nil
 				}
 			} else if fun.Type == KeywordType {
 				ops, pc, sp, env, err = vm.keywordTailcall(fun, argc, ops, stack, sp+1, env)
-				if err != nil {
-					ops, pc, sp, env, err = vm.catch(err, stack, env)
-					if err != nil {
-						return nil, err
-					}
-				} else {
-					if env == nil {
-						return stack[sp], nil
-					}
+				if err == nil && env == nil {
+					return stack[sp], nil
 				}
 			} else {
-				ops, pc, sp, env, err = vm.catch(Error(ArgumentErrorKey, "Not callable: ", fun), stack, env)
-				if err != nil {
-					return nil, err
-				}
+				err = addContext(env, Error(ArgumentErrorKey, "Not callable: ", fun))
 			}
 
 		case opCall:
 			argc := ops[pc+1]
 			fun := stack[sp]
+			state.depth = env.depth
+			if n := callStackNeeded(fun, argc, stack, sp); n > sp {
+				if stack, sp, err = vm.growStack(stack, sp, n, handlers); err != nil {
+					err = addContext(env, err)
+					break
+				}
+			}
 			if fun.primitive != nil {
 				nextSp := sp + argc
-				val, err := vm.callPrimitive(fun.primitive, stack[sp+1:nextSp+1])
+				var val *Object
+				val, err = vm.callPrimitive(ctx, fun.primitive, stack[sp+1:nextSp+1])
 				if err != nil {
-					ops, pc, _, env, err = vm.catch(err, stack, env)
-					if err != nil {
-						return nil, err
-					}
+					err = addContext(env, err)
+					break
 				}
 				stack[nextSp] = val
 				sp = nextSp
 				pc += 2
 			} else if fun.Type == FunctionType {
-				ops, pc, sp, env, err = vm.funcall(fun, argc, ops, pc+2, stack, sp+1, env)
-				if err != nil {
-					return nil, err
-				}
+				ops, pc, sp, env, err = vm.funcall(ctx, fun, argc, ops, pc+2, stack, sp+1, env, &handlers)
 			} else if fun.Type == KeywordType {
 				pc, sp, err = vm.keywordCall(fun, argc, pc+2, stack, sp+1)
 				if err != nil {
-					ops, pc, sp, env, err = vm.catch(err, stack, env)
-					if err != nil {
-						return nil, err
-					}
+					err = addContext(env, err)
 				}
 			} else {
-				ops, pc, sp, env, err = vm.catch(Error(ArgumentErrorKey, "Not callable: ", fun), stack, env)
-				if err != nil {
-					return nil, err
-				}
+				err = addContext(env, Error(ArgumentErrorKey, "Not callable: ", fun))
 			}
 
 		case opReturn:
@@ -651,7 +876,7 @@ func (vm *VM) exec(code *Code, env *frame) (*Object, error) {
 
 		case opClosure:
 			sp--
-			stack[sp] = Closure(vm.Constants[ops[pc+1]].code, env)
+			stack[sp] = Closure(vm.constants.get(ops[pc+1]).code, env)
 			pc = pc + 2
 
 		case opPop:
@@ -659,21 +884,38 @@ func (vm *VM) exec(code *Code, env *frame) (*Object, error) {
 			pc++
 
 		case opGlobal:
-			sym := vm.Constants[ops[pc+1]]
+			val, ok := vm.globals.Load(vm.constants.get(ops[pc+1]))
 			sp--
 			// Check for undefined globals
-			if sym == nil || sym.car == nil {
+			if !ok {
 				stack[sp] = Null
 			} else {
-				stack[sp] = sym.car
+				stack[sp] = val.(*Object)
 			}
 			pc += 2
 
 		case opDefGlobal:
-			sym := vm.Constants[ops[pc+1]]
+			sym := vm.constants.get(ops[pc+1])
 			vm.defGlobal(sym, stack[sp])
 			pc += 2
 
+		case opRecur:
+			// leave the frames of any lets in the loop's body, and start the next iteration,
+			// in a new frame if closures may have kept the variables of this one
+			loopEnv := env
+			for i := ops[pc+1]; i > 0; i-- {
+				loopEnv = loopEnv.locals
+			}
+			if ops[pc+2] != 0 {
+				loopEnv = loopEnv.copy()
+			}
+			n := loopEnv.code.argc - 1
+			copy(loopEnv.elements[1:], stack[sp:sp+n])
+			sp += n
+			env = loopEnv
+			ops = env.code.ops
+			pc = 0
+
 		case opSetLocal:
 			tmpEnv := env
 			i := ops[pc+1]
@@ -686,21 +928,46 @@ func (vm *VM) exec(code *Code, env *frame) (*Object, error) {
 			pc += 3
 
 		case opUse:
-			sym := vm.Constants[ops[pc+1]]
-			err := vm.Use(sym)
+			sym := vm.constants.get(ops[pc+1])
+			err = vm.requireCapability(FileCapability, "use")
+			if err == nil {
+				err = vm.Use(sym)
+			}
 			if err != nil {
-				ops, pc, sp, env, err = vm.catch(err, stack, env)
-				if err != nil {
-					return nil, err
-				}
+				err = addContext(env, err)
 			} else {
 				sp--
 				stack[sp] = sym
 				pc += 2
 			}
 
+		case opModule:
+			sym := vm.constants.get(ops[pc+1])
+			vm.enterModule(sym)
+			sp--
+			stack[sp] = sym
+			pc += 2
+
+		case opExport:
+			names := vm.constants.get(ops[pc+1])
+			vm.exportNames(names)
+			sp--
+			stack[sp] = names
+			pc += 2
+
+		case opImport:
+			spec := vm.constants.get(ops[pc+1])
+			err = vm.importModule(spec)
+			if err != nil {
+				err = addContext(env, err)
+			} else {
+				sp--
+				stack[sp] = Car(spec)
+				pc += 2
+			}
+
 		case opDefMacro:
-			sym := vm.Constants[ops[pc+1]]
+			sym := vm.constants.get(ops[pc+1])
 			vm.defMacro(sym, stack[sp])
 			stack[sp] = sym
 			pc += 2
@@ -720,15 +987,60 @@ func (vm *VM) exec(code *Code, env *frame) (*Object, error) {
 			pc += 2
 
 		case opUndefGlobal:
-			sym := vm.Constants[ops[pc+1]]
-			undefGlobal(sym)
+			sym := vm.constants.get(ops[pc+1])
+			vm.undefGlobal(sym)
 			pc += 2
 
+		case opTry:
+			handlers = append(handlers, tryHandler{
+				fun: stack[sp],
+				ops: ops,
+				pc:  pc + ops[pc+1],
+				sp:  sp + 1,
+				env: env,
+			})
+			sp++
+			pc += 2
+
+		case opEndTry:
+			handlers = handlers[:len(handlers)-1]
+			pc++
+
+		case opAdd, opSub, opMul, opDiv, opNumEqual, opNumLess, opNumLessEqual, opNumGreater, opNumGreaterEqual:
+			var val *Object
+			val, err = numericOp(op, stack[sp], stack[sp+1])
+			if err != nil {
+				err = addContext(env, err)
+				break
+			}
+			sp++
+			stack[sp] = val
+			pc++
+
 		case opCount:
 			// Do nothing
 
 		default:
 			return Null, Error(InternalErrorKey, "Unknown opcode: ", ops[pc])
 		}
+		if sp < stackMargin && err == nil {
+			if stack, sp, err = vm.growStack(stack, sp, stackMargin, handlers); err != nil {
+				err = addContext(env, err)
+			}
+		}
+		if checking && err == nil {
+			state.ticks++
+			if state.ticks == cancelCheckInterval {
+				state.ticks = 0
+				err = vm.checkLimits(ctx)
+			}
+		}
+		if err != nil {
+			err = withTrace(errorObject(err), stackTrace(opEnv, opPc))
+			ops, pc, sp, env, err = vm.catch(ctx, err, stack, &handlers)
+			if err != nil {
+				return nil, err
+			}
+		}
 	}
 }
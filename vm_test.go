@@ -0,0 +1,267 @@
+package vesper
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// eval reads and evaluates the forms of src in turn, returning the value of the last one
+func eval(vm *VM, src string) (*Object, error) {
+	forms, err := vm.ReadAll(String(src), nil)
+	if err != nil {
+		return nil, err
+	}
+	result := Null
+	for ; forms != EmptyList; forms = Cdr(forms) {
+		result, err = vm.Eval(Car(forms))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// expectEval fails the test unless src evaluates to a value that is written as expected
+func expectEval(t *testing.T, vm *VM, src string, expected string) {
+	t.Helper()
+	result, err := eval(vm, src)
+	if err != nil {
+		t.Fatalf("%s: unexpected error: %v", src, err)
+	}
+	if s := Write(result); s != expected {
+		t.Fatalf("%s: expected %s, got %s", src, expected, s)
+	}
+}
+
+// expectError fails the test unless src raises an error whose message contains the text
+func expectError(t *testing.T, vm *VM, src string, text string) {
+	t.Helper()
+	result, err := eval(vm, src)
+	if err == nil {
+		t.Fatalf("%s: expected an error, got %s", src, Write(result))
+	}
+	if !strings.Contains(err.Error(), text) {
+		t.Fatalf("%s: expected an error containing %q, got %v", src, text, err)
+	}
+}
+
+// writeFile writes a file in the test's temporary directory, returning its path
+func writeFile(t *testing.T, dir string, name string, text string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func tempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "vesper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func TestCompileModuleRunsOnlyCompileTimeForms(t *testing.T) {
+	dir := tempDir(t)
+	src := writeFile(t, dir, "prog.vsp", `
+(defn helper (x) (* x 2))
+(defmacro dbl (x) (helper x))
+(def ran true)
+(def answer (dbl 21))
+(car 5)
+`)
+	out := filepath.Join(dir, "prog.vem")
+	vm := NewVM().Init()
+	if err := vm.CompileModuleFile(src, out); err != nil {
+		t.Fatalf("compile failed: %v", err)
+	}
+	if vm.IsDefined(vm.Intern("ran")) {
+		t.Fatal("compiling the file ran its forms")
+	}
+	loader := NewVM().Init()
+	err := loader.LoadFile(out)
+	if err == nil || !strings.Contains(err.Error(), "car expected a <list>") {
+		t.Fatalf("expected the error of the last form when loading, got %v", err)
+	}
+	expectEval(t, loader, "(list ran answer)", "(true 42)")
+}
+
+func TestCompiledModuleRoundTrip(t *testing.T) {
+	dir := tempDir(t)
+	src := writeFile(t, dir, "types.vsp", `
+(def v (vector 1 2 3))
+(def m '{1 "one" 2 "two"})
+(def big 100000000000000000000)
+(def r 1/3)
+(defn kind (x) (case x ((1 2) 'small) ((1.0) 'float) ((a: "s" #\c) 'other) (else 'big)))
+`)
+	out := filepath.Join(dir, "types.vem")
+	vm := NewVM().Init()
+	if err := vm.CompileModuleFile(src, out); err != nil {
+		t.Fatalf("compile failed: %v", err)
+	}
+	loader := NewVM().Init()
+	if err := loader.LoadFile(out); err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	expectEval(t, loader, "(list v (get m 2) big r)", `([1 2 3] "two" 100000000000000000000 1/3)`)
+	expectEval(t, loader, `(map kind (list 1 2 1.0 2.0 a: "s" #\c 9))`, "(small small float big other other other big)")
+}
+
+func TestInstructionLimitCountsShortEvaluations(t *testing.T) {
+	vm := NewVM().Init()
+	vm.SetLimits(Limits{MaxInstructions: 5000})
+	var err error
+	for i := 0; i < 10000 && err == nil; i++ {
+		_, err = eval(vm, "(+ 1 2)")
+	}
+	if err == nil || !strings.Contains(err.Error(), "instruction limit exceeded") {
+		t.Fatalf("expected the instruction limit to be exceeded, got %v", err)
+	}
+}
+
+func TestInstructionLimitCountsCallbacks(t *testing.T) {
+	vm := NewVM().Init()
+	vm.SetLimits(Limits{MaxInstructions: 100000})
+	expectError(t, vm, `
+(defn slow< (a b) (loop ((i 0)) (if (< i 20) (recur (+ i 1)) (< a b))))
+(sort (map (fn (i) (- 500 i)) (range 0 500)) slow<)`, "instruction limit exceeded")
+}
+
+func TestCallbacksCheckCancellation(t *testing.T) {
+	vm := NewVM().Init()
+	expectEval(t, vm, "(def xs (map (fn (i) (- 500 i)) (range 0 500))) (count xs)", "500")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	form, err := vm.Read(String("(sort xs (fn (a b) (< a b)))"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = vm.EvalContext(ctx, form)
+	if err == nil || !strings.Contains(err.Error(), "interrupt") {
+		t.Fatalf("expected the sort to be interrupted, got %v", err)
+	}
+}
+
+func TestCollectionLimitCountsHashtables(t *testing.T) {
+	vm := NewVM().Init()
+	vm.SetLimits(Limits{MaxCollectionSize: 100})
+	expectError(t, vm, "(apply hashtable (range 0 300))", "collection size limit exceeded")
+	expectError(t, vm, `
+(def h (hashtable))
+(loop ((i 0)) (if (< i 200) (do (hashtable-put! h i i) (recur (+ i 1))) i))`, "collection size limit exceeded")
+	expectEval(t, vm, "(hashtable-count h)", "100")
+	expectEval(t, vm, "(do (hashtable-put! h 5 10) (hashtable-get h 5))", "10")
+}
+
+func TestCollectionLimitCountsVectorsAndHashMaps(t *testing.T) {
+	vm := NewVM().Init()
+	vm.SetLimits(Limits{MaxCollectionSize: 100})
+	expectError(t, vm, "(loop ((v (vector)) (i 0)) (if (< i 200) (recur (conj v i) (+ i 1)) (count v)))", "collection size limit exceeded")
+	expectError(t, vm, "(loop ((m (hash-map)) (i 0)) (if (< i 200) (recur (assoc m i i) (+ i 1)) (count m)))", "collection size limit exceeded")
+	expectEval(t, vm, "(loop ((v (vector)) (i 0)) (if (< i 100) (recur (conj v i) (+ i 1)) (count v)))", "100")
+}
+
+func TestDefinitionShadowsImport(t *testing.T) {
+	dir := tempDir(t)
+	writeFile(t, dir, "mylib.vsp", `
+(module mylib)
+(defn parse (s) (list 'mylib s))
+`)
+	prog := writeFile(t, dir, "prog.vsp", `
+(import mylib (parse))
+(def before (parse 1))
+(defn parse (s) (list 'local s))
+(def after (parse 2))
+`)
+	vm := NewVM().Init()
+	vm.DefineGlobal("*load-path*", String(dir))
+	if err := vm.LoadFile(prog); err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	expectEval(t, vm, "(list before after)", "((mylib 1) (local 2))")
+}
+
+func TestModuleForwardReferenceShadowsGlobal(t *testing.T) {
+	dir := tempDir(t)
+	writeFile(t, dir, "shapes.vsp", `
+(module shapes)
+(defn sides (shape) (count shape))
+(defn count (shape) (if (equal? shape 'square) 4 3))
+`)
+	vm := NewVM().Init()
+	vm.DefineGlobal("*load-path*", String(dir))
+	expectEval(t, vm, "(import shapes) (list (shapes/sides 'square) (shapes/sides 'triangle) (count '(1 2)))", "(4 3 2)")
+}
+
+func TestRestrictedModuleCannotUseRemovedPrimitive(t *testing.T) {
+	dir := tempDir(t)
+	writeFile(t, dir, "secret.txt", "secret")
+	src := writeFile(t, dir, "reader.vsp", `
+(defmacro read-file (name) (list slurp name))
+(def text (read-file "`+filepath.Join(dir, "secret.txt")+`"))
+`)
+	out := filepath.Join(dir, "reader.vem")
+	if err := NewVM().Init().CompileModuleFile(src, out); err != nil {
+		t.Fatalf("compile failed: %v", err)
+	}
+	vm := NewVM().Init()
+	if err := vm.LoadFile(out); err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	expectEval(t, vm, "text", `"secret"`)
+	restricted := NewVM().Init()
+	restricted.Restrict(FileCapability)
+	err := restricted.LoadFile(out)
+	if err == nil || !strings.Contains(err.Error(), "undefined primitive: slurp") {
+		t.Fatalf("expected the removed primitive to be rejected, got %v", err)
+	}
+}
+
+func TestGoFuncPanicIsError(t *testing.T) {
+	vm := NewVM().Init()
+	err := vm.DefineGoFunc("nth-rune", func(s string, i int) string { return string([]rune(s)[i]) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEval(t, vm, `(nth-rune "abc" 1)`, `"b"`)
+	expectError(t, vm, `(nth-rune "abc" 5)`, "nth-rune panicked: runtime error: index out of range")
+	expectEval(t, vm, `(try (nth-rune "abc" 5) (catch e 'caught))`, "caught")
+}
+
+func TestSyntaxRulesFreeIdentifiers(t *testing.T) {
+	vm := NewVM().Init()
+	expectEval(t, vm, `
+(define-syntax my-list (syntax-rules () ((_ a b) (list a b))))
+(define-syntax tag (syntax-rules () ((_ a) (cons 'list a))))
+(let ((list (fn (& xs) 'local))) (cons (my-list 1 2) (tag '(3))))`, "((1 2) list 3)")
+	dir := tempDir(t)
+	writeFile(t, dir, "wrap.vsp", `
+(module wrap)
+(export helper wrapped)
+(defn helper (x) (list 'wrapped x))
+(define-syntax wrapped (syntax-rules () ((_ x) (helper x))))
+`)
+	vm.DefineGlobal("*load-path*", String(dir))
+	expectEval(t, vm, `
+(import wrap (wrapped))
+(defn helper (x) (list 'mine x))
+(let ((helper car)) (wrapped 1))`, "(wrapped 1)")
+}
+
+func TestCaseDistinguishesExactness(t *testing.T) {
+	vm := NewVM().Init()
+	expectEval(t, vm, `
+(defn kind (x) (case x ((1) 'one) ((1.0) 'one-point-oh) ((2) 'two) (else 'other)))
+(list (kind 1) (kind 1.0) (kind 2) (kind 2.0) (equal? 1 1.0))`, "(one one-point-oh two other false)")
+	expectEval(t, vm, "(case 1.0 ((1) 'one) (else 'other))", "other")
+	expectEval(t, vm, "(case 9007199254740993 ((9007199254740992) 'low) ((9007199254740993) 'high) (else 'other))", "high")
+}